@@ -1,17 +1,21 @@
 module github.com/Jamlee/fastvpn
 
+go 1.18
+
 require (
 	github.com/aws/aws-sdk-go v1.15.88
-	github.com/labstack/gommon v0.2.8 // indirect
-	github.com/mattn/go-colorable v0.0.9 // indirect
-	github.com/mattn/go-isatty v0.0.4 // indirect
 	github.com/songgao/water v0.0.0-20190112225332-f6122f5b2fbd
 	github.com/urfave/cli v1.20.0
 	github.com/vishvananda/netlink v1.0.0
+	go.uber.org/zap v1.9.1
+	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9
+	golang.org/x/sys v0.0.0-20190318195719-6c81ef8f67ca
+)
+
+require (
+	github.com/jmespath/go-jmespath v0.0.0-20160202185014-0b12d6b521d8 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
 	github.com/vishvananda/netns v0.0.0-20180720170159-13995c7128cc // indirect
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	go.uber.org/zap v1.9.1
-	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9
-	golang.org/x/sys v0.0.0-20190318195719-6c81ef8f67ca // indirect
 )
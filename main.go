@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/Jamlee/fastvpn/pkg/vpn"
+	"github.com/Jamlee/fastvpn/pkg/vps"
 	"github.com/urfave/cli"
 )
 
@@ -16,9 +24,132 @@ func main() {
 		{
 			Name:  "server",
 			Usage: "start the vpn server service",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "listen",
+					Value:  "0.0.0.0",
+					Usage:  "address to listen on",
+					EnvVar: "FASTVPN_LISTEN",
+				},
+				cli.StringFlag{
+					Name:   "port",
+					Value:  "9001",
+					Usage:  "port to listen on",
+					EnvVar: "FASTVPN_PORT",
+				},
+				cli.StringFlag{
+					Name:   "network",
+					Value:  "192.168.45.1/24",
+					Usage:  "address and network of the vpn",
+					EnvVar: "FASTVPN_NETWORK",
+				},
+				cli.StringFlag{
+					Name:   "dev",
+					Value:  "tun1",
+					Usage:  "name of the tun device",
+					EnvVar: "FASTVPN_DEV",
+				},
+				cli.DurationFlag{
+					Name:   "idle-timeout",
+					Usage:  "shut down after this long without traffic, 0 never",
+					EnvVar: "FASTVPN_IDLE_TIMEOUT",
+				},
+				cli.DurationFlag{
+					Name:   "max-lifetime",
+					Usage:  "shut down after running this long, 0 never",
+					EnvVar: "FASTVPN_MAX_LIFETIME",
+				},
+				cli.StringFlag{
+					Name:   "shutdown-command",
+					Usage:  "command run on auto shutdown, like `systemctl poweroff`",
+					EnvVar: "FASTVPN_SHUTDOWN_COMMAND",
+				},
+				cli.BoolFlag{
+					Name:   "spot",
+					Usage:  "warn the clients when aws reclaims the spot vm running the server",
+					EnvVar: "FASTVPN_SPOT",
+				},
+				cli.IntFlag{
+					Name:   "tun-queues",
+					Value:  1,
+					Usage:  "queues of the tun device, each read and written by its own goroutine",
+					EnvVar: "FASTVPN_TUN_QUEUES",
+				},
+				cli.BoolFlag{
+					Name:   "tun-offload",
+					Usage:  "let the kernel pass tcp segments of up to 64k through the tun device",
+					EnvVar: "FASTVPN_TUN_OFFLOAD",
+				},
+				cli.IntFlag{
+					Name:   "mtu",
+					Usage:  "mtu of the tun device, 0 fits it to the outer path",
+					EnvVar: "FASTVPN_MTU",
+				},
+				cli.StringFlag{
+					Name:   "transport",
+					Value:  vpn.DefaultTransport,
+					Usage:  "transport of the clients, one of " + strings.Join(vpn.Transports(), ", "),
+					EnvVar: "FASTVPN_TRANSPORT",
+				},
+				cli.StringFlag{
+					Name:   "tls-cert",
+					Usage:  "certificate file of the tls and wss transports, self-signed if empty",
+					EnvVar: "FASTVPN_TLS_CERT",
+				},
+				cli.StringFlag{
+					Name:   "tls-key",
+					Usage:  "key file of the tls and wss transports",
+					EnvVar: "FASTVPN_TLS_KEY",
+				},
+				cli.StringFlag{
+					Name:   "ws-path",
+					Value:  "/",
+					Usage:  "url path of the ws and wss transports",
+					EnvVar: "FASTVPN_WS_PATH",
+				},
+				cli.BoolFlag{
+					Name:   "compress",
+					Usage:  "compress the packets of the clients asking for it",
+					EnvVar: "FASTVPN_COMPRESS",
+				},
+				cli.StringFlag{
+					Name:   "stats-file",
+					Usage:  "file the traffic counters are kept in",
+					EnvVar: "FASTVPN_STATS_FILE",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				server, err := vpn.NewServer("0.0.0.0", "9001", "192.168.45.1/24", "tun1")
+				tunOpts := vpn.TunOptions{Queues: c.Int("tun-queues"), Offload: c.Bool("tun-offload"), MTU: c.Int("mtu")}
+				transport, err := vpn.NewTransport(&vpn.TransportConfig{
+					Name:     c.String("transport"),
+					CertFile: c.String("tls-cert"),
+					KeyFile:  c.String("tls-key"),
+					Path:     c.String("ws-path"),
+				})
+				if err != nil {
+					return err
+				}
+				server, err := vpn.NewServer(c.String("listen"), c.String("port"), c.String("network"), c.String("dev"), tunOpts, transport)
 				if err == nil {
+					command := c.String("shutdown-command")
+					server.SetAutoShutdown(c.Duration("idle-timeout"), c.Duration("max-lifetime"), func() {
+						if command != "" {
+							if out, err := exec.Command("sh", "-c", command).CombinedOutput(); err != nil {
+								log.Printf("shutdown command failed: %s: %s", err, out)
+							}
+						}
+						os.Exit(0)
+					})
+					server.SetCompression(c.Bool("compress"))
+					if path := c.String("stats-file"); path != "" {
+						server.SetStatsFile(path)
+					}
+					if c.Bool("spot") {
+						go vps.WatchSpotInterruption(context.Background(), func(at time.Time) {
+							server.WarnShutdown("spot vm reclaimed", time.Until(at))
+						})
+					}
+					go logRoutes(server)
 					server.Run()
 				}
 				return err
@@ -27,12 +158,314 @@ func main() {
 		{
 			Name:  "client",
 			Usage: "start the vpn client service",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "server",
+					Usage:  "address and port of the vpn server, like 203.0.113.7:9001",
+					EnvVar: "FASTVPN_SERVER",
+				},
+				cli.StringFlag{
+					Name:   "network",
+					Value:  "192.168.45.2/24",
+					Usage:  "address of the client in the vpn network",
+					EnvVar: "FASTVPN_NETWORK",
+				},
+				cli.StringFlag{
+					Name:   "dev",
+					Value:  "tun1",
+					Usage:  "name of the tun device",
+					EnvVar: "FASTVPN_DEV",
+				},
+				cli.IntFlag{
+					Name:   "mtu",
+					Usage:  "mtu of the tun device, 0 fits it to the outer path",
+					EnvVar: "FASTVPN_MTU",
+				},
+				cli.StringFlag{
+					Name:   "transport",
+					Value:  vpn.DefaultTransport,
+					Usage:  "transport of the server, one of " + strings.Join(vpn.Transports(), ", "),
+					EnvVar: "FASTVPN_TRANSPORT",
+				},
+				cli.StringFlag{
+					Name:   "tls-fingerprint",
+					Usage:  "sha256 of the certificate of a tls or wss server, as vps status shows it",
+					EnvVar: "FASTVPN_TLS_FINGERPRINT",
+				},
+				cli.StringFlag{
+					Name:   "tls-server-name",
+					Usage:  "name the certificate of the server is checked against when no fingerprint is pinned",
+					EnvVar: "FASTVPN_TLS_SERVER_NAME",
+				},
+				cli.BoolFlag{
+					Name:   "tls-insecure",
+					Usage:  "accept any certificate of the server",
+					EnvVar: "FASTVPN_TLS_INSECURE",
+				},
+				cli.StringFlag{
+					Name:   "ws-path",
+					Value:  "/",
+					Usage:  "url path of the ws and wss transports",
+					EnvVar: "FASTVPN_WS_PATH",
+				},
+				cli.BoolFlag{
+					Name:   "compress",
+					Usage:  "ask the server to compress the packets",
+					EnvVar: "FASTVPN_COMPRESS",
+				},
+			},
 			Action: func(c *cli.Context) error {
-				server, err := vpn.NewServer("0.0.0.0", "9001", "192.168.45.1/24", "tun1")
-				if err == nil {
-					server.Run()
+				if c.String("server") == "" {
+					return fmt.Errorf("--server is required")
 				}
-				return err
+				transport, err := vpn.NewTransport(&vpn.TransportConfig{
+					Name:        c.String("transport"),
+					ServerName:  c.String("tls-server-name"),
+					Fingerprint: c.String("tls-fingerprint"),
+					Insecure:    c.Bool("tls-insecure"),
+					Path:        c.String("ws-path"),
+				})
+				if err != nil {
+					return err
+				}
+				client, err := vpn.NewClient(c.String("server"), c.String("network"), c.String("dev"), vpn.TunOptions{MTU: c.Int("mtu")}, transport)
+				if err != nil {
+					return err
+				}
+				client.SetCompression(c.Bool("compress"))
+				return client.Run()
+			},
+		},
+		{
+			Name:  "vps",
+			Usage: "manage the vm running the vpn server",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "provider",
+					Value: "aws",
+					Usage: "vps provider, one of " + strings.Join(vps.Providers(), ", "),
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Value: vps.DefaultName,
+					Usage: "name of the deployment, to run several servers",
+				},
+				cli.StringFlag{
+					Name:   "owner",
+					Value:  vps.DefaultOwner(),
+					Usage:  "user the deployments belong to, your login by default",
+					EnvVar: "FASTVPN_OWNER",
+				},
+				cli.StringFlag{
+					Name:  "region",
+					Usage: "region to run the vm in, provider default if empty",
+				},
+				cli.StringFlag{
+					Name:  "regions",
+					Usage: "comma separated regions, up picks the one with the lowest latency",
+				},
+				cli.StringFlag{
+					Name:  "country",
+					Usage: "only use regions in this country, like JP or DE",
+				},
+				cli.StringFlag{
+					Name:  "image",
+					Value: vps.DefaultImage,
+					Usage: "os of the vm: ubuntu, debian or amazon-linux",
+				},
+				cli.StringFlag{
+					Name:  "arch",
+					Usage: "cpu architecture of the vm, amd64 or arm64, guessed from the instance type if empty",
+				},
+				cli.StringFlag{
+					Name:  "instance-type",
+					Usage: "size of the vm, the smallest of the architecture if empty",
+				},
+				cli.StringFlag{
+					Name:  "transport",
+					Value: vps.DefaultTransport,
+					Usage: "transport of the vpn server, tcp, tls, ws or wss",
+				},
+				cli.IntFlag{
+					Name:  "port",
+					Value: vps.DefaultPort,
+					Usage: "port of the vpn server",
+				},
+				cli.StringFlag{
+					Name:  "ssh-cidr",
+					Usage: "network allowed to ssh into the vm, your public ip if empty",
+				},
+				cli.BoolFlag{
+					Name:  "ipv6",
+					Usage: "open the vpn port to ipv6 clients too",
+				},
+				cli.StringFlag{
+					Name:  "server-url",
+					Usage: "url the vm downloads the server binary from, it is uploaded over ssh if empty",
+				},
+				cli.StringFlag{
+					Name:  "server-sha256",
+					Usage: "sha256 of the binary at the server url",
+				},
+				cli.StringFlag{
+					Name:  "server-binary",
+					Usage: "linux server binary for the arch of the vm to upload, this executable if empty",
+				},
+				cli.DurationFlag{
+					Name:  "idle-timeout",
+					Value: vps.DefaultIdleTimeout,
+					Usage: "terminate the vm after this long without vpn traffic, 0 never",
+				},
+				cli.DurationFlag{
+					Name:  "max-lifetime",
+					Value: vps.DefaultMaxLifetime,
+					Usage: "terminate the vm after running this long, 0 never",
+				},
+				cli.BoolFlag{
+					Name:  "keep-stopped",
+					Usage: "stop the vm on down and start it again on up instead of recreating it",
+				},
+				cli.BoolFlag{
+					Name:  "static-ip",
+					Usage: "keep the address of a kept vm across stops",
+				},
+				cli.BoolFlag{
+					Name:  "spot",
+					Usage: "run on a spot vm, falls back to on-demand when there is no capacity",
+				},
+				cli.StringFlag{
+					Name:  "spot-max-price",
+					Usage: "highest hourly price of the spot vm in usd, the on-demand price if empty",
+				},
+				cli.StringFlag{
+					Name:  "zone",
+					Usage: "availability zone of the vm, provider default if empty",
+				},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "up",
+					Usage: "create and bootstrap the vm",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "reprovision",
+							Usage: "keep running and start a spot vm in another zone when it is reclaimed",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						cfg := newConfig(c)
+						p, err := vps.New(cfg)
+						if err != nil {
+							return err
+						}
+						ctx, cancel := interruptContext()
+						defer cancel()
+						ctx = vps.WithProgress(ctx, &progress{})
+						region := cfg.Region
+						if err = vps.PickRegion(ctx, p, cfg); err != nil {
+							return err
+						}
+						if cfg.Region != region {
+							if p, err = vps.New(cfg); err != nil {
+								return err
+							}
+						}
+						if err = vps.StartInstance(ctx, p, cfg); err != nil || !c.Bool("reprovision") {
+							return err
+						}
+						return vps.KeepSpotAlive(ctx, p, cfg)
+					},
+				},
+				{
+					Name:  "status",
+					Usage: "show your vms in every region",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "show the vms of every owner",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						cfg := newConfig(c)
+						ps, err := vps.Regional(cfg)
+						if err != nil {
+							return err
+						}
+						owner := cfg.Owner
+						if c.Bool("all") {
+							owner = ""
+						}
+						for _, p := range ps {
+							if err = vps.StatusInstance(p, owner); err != nil {
+								return err
+							}
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "cost",
+					Usage: "show the runtime, estimated cost and traffic of your vms",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "show the vms of every owner",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						cfg := newConfig(c)
+						ps, err := vps.Regional(cfg)
+						if err != nil {
+							return err
+						}
+						owner := cfg.Owner
+						if c.Bool("all") {
+							owner = ""
+						}
+						ctx, cancel := interruptContext()
+						defer cancel()
+						return vps.Cost(ctx, ps, cfg, owner)
+					},
+				},
+				{
+					Name:  "gc",
+					Usage: "remove resources left behind by failed runs",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dry-run",
+							Usage: "only list the orphaned resources",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						ps, err := vps.Regional(newConfig(c))
+						if err != nil {
+							return err
+						}
+						for _, p := range ps {
+							if err = vps.GC(p, c.Bool("dry-run")); err != nil {
+								return err
+							}
+						}
+						return nil
+					},
+				},
+				{
+					Name:  "down",
+					Usage: "destroy the vms in every region, or stop them with --keep-stopped",
+					Action: func(c *cli.Context) error {
+						cfg := newConfig(c)
+						ps, err := vps.Regional(cfg)
+						if err != nil {
+							return err
+						}
+						for _, p := range ps {
+							if err = vps.StopInstance(p, cfg); err != nil {
+								return err
+							}
+						}
+						return nil
+					},
+				},
 			},
 		},
 		{
@@ -46,6 +479,110 @@ func main() {
 
 	err := app.Run(os.Args)
 	if err != nil {
+		if hint := vps.Hint(err); hint != "" {
+			log.Fatalf("%s\n%s", err, hint)
+		}
 		log.Fatal(err)
 	}
 }
+
+// newConfig reads the flags of the vps command
+func newConfig(c *cli.Context) *vps.Config {
+	parent := c.Parent()
+	return &vps.Config{
+		Provider:     parent.String("provider"),
+		Name:         parent.String("name"),
+		Owner:        parent.String("owner"),
+		Region:       parent.String("region"),
+		Regions:      splitList(parent.String("regions")),
+		Country:      parent.String("country"),
+		Image:        parent.String("image"),
+		Arch:         parent.String("arch"),
+		InstanceType: parent.String("instance-type"),
+		Transport:    parent.String("transport"),
+		Port:         parent.Int("port"),
+		SSHCIDR:      parent.String("ssh-cidr"),
+		IPv6:         parent.Bool("ipv6"),
+		ServerURL:    parent.String("server-url"),
+		ServerSHA256: parent.String("server-sha256"),
+		ServerBinary: parent.String("server-binary"),
+		IdleTimeout:  parent.Duration("idle-timeout"),
+		MaxLifetime:  parent.Duration("max-lifetime"),
+		KeepStopped:  parent.Bool("keep-stopped"),
+		StaticIP:     parent.Bool("static-ip"),
+		Spot:         parent.Bool("spot"),
+		SpotMaxPrice: parent.String("spot-max-price"),
+		Zone:         parent.String("zone"),
+	}
+}
+
+// splitList splits a comma separated flag, skipping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// progress prints a line per stage of a vps command, updated while it waits
+type progress struct {
+	n     int
+	stage string
+	start time.Time
+}
+
+func (p *progress) Step(name string) {
+	p.n++
+	p.stage = name
+	p.start = time.Now()
+	p.line(name)
+}
+
+func (p *progress) Waiting(name string, elapsed time.Duration) {
+	p.line(fmt.Sprintf("%s: %s %s", p.stage, name, elapsed.Round(time.Second)))
+}
+
+func (p *progress) Done(name string, err error) {
+	took := time.Since(p.start).Round(time.Second)
+	if err != nil {
+		p.line(fmt.Sprintf("%s failed after %s", name, took))
+	} else {
+		p.line(fmt.Sprintf("%s done in %s", name, took))
+	}
+	fmt.Println()
+}
+
+func (p *progress) line(s string) {
+	fmt.Printf("\r[%d] %-70s", p.n, s)
+}
+
+// logRoutes logs the routing table of the server on SIGUSR1
+func logRoutes(server *vpn.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	for range sig {
+		for _, route := range server.Routes() {
+			log.Printf("route %s", route)
+		}
+	}
+}
+
+// interruptContext is cancelled on Ctrl-C so long running work can roll back
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-sig:
+			log.Println("interrupted, cleaning up")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+	}()
+	return ctx, cancel
+}
@@ -1,32 +1,242 @@
 package vpn
 
 import (
+	"encoding/gob"
+	"fmt"
 	"net"
 	"sync"
 
-	"github.com/songgao/water"
+	"github.com/songgao/water/waterutil"
 )
 
+// Client connects a tun device to the server over a transport
 type Client struct {
-	newGateway string
-	serverAddr string
-	port       string
-
-	wg              sync.WaitGroup
-	serverIP        net.IP
+	serverAddr      string
+	addrWithNetmask string
 	localAddr       net.IP
-	additionalAddrs []net.IP
-	localNetMask    *net.IPNet
+	transport       Transport
+	tun             *tunDevice
+	mtu             int
+	compression     bool
 	isShuttingDown  bool
 
-	//channels between various components
-	packetsIn     chan *RawIPPacket
-	packetsDevOut chan *RawIPPacket
+	// packets read from the tun device on their way to the server, and the
+	// packets of the server on their way to the tun device, a queue each
+	packetsOut chan *RawIPPacket
+	packetsIn  []chan *RawIPPacket
+
+	wg sync.WaitGroup
+}
+
+// NewClient opens the tun device iName with the address addrWithNetmask in
+// the vpn network, the server at serverAddr is dialed over transport, plain
+// tcp when nil
+func NewClient(serverAddr, addrWithNetmask, iName string, tunOpts TunOptions, transport Transport) (*Client, error) {
+	if transport == nil {
+		transport = tcpTransport{}
+	}
+	addr, _, err := net.ParseCIDR(addrWithNetmask)
+	if err != nil {
+		return nil, err
+	}
+	mtu := tunOpts.MTU
+	if mtu == 0 {
+		host, _, err := net.SplitHostPort(serverAddr)
+		if err != nil {
+			return nil, err
+		}
+		dst := dialedIP(host)
+		mtu = EffectiveMTU(outerPathMTU(dst)-transport.Overhead(), dst.To4() == nil, addr.To4() == nil)
+	}
+	tun, err := openTun(iName, tunOpts)
+	if err != nil {
+		return nil, fmt.Errorf("can not create vpn iface %s: %s", iName, err)
+	}
+	if err = SetupTun(tun.Name(), addrWithNetmask, mtu, tunTxQueLen); err != nil {
+		tun.Close()
+		return nil, err
+	}
+	log.Infof("%s up with %s, mtu %d, %d queues, offload %t", tun.Name(), addrWithNetmask, mtu, len(tun.queues), tun.vnetHdr)
+	packetsIn := make([]chan *RawIPPacket, len(tun.queues))
+	for i := range packetsIn {
+		packetsIn[i] = make(chan *RawIPPacket, PacketInMaxBuff)
+	}
+	return &Client{
+		serverAddr:      serverAddr,
+		addrWithNetmask: addrWithNetmask,
+		localAddr:       addr,
+		transport:       transport,
+		tun:             tun,
+		mtu:             mtu,
+		packetsOut:      make(chan *RawIPPacket, PacketOutMaxBuff),
+		packetsIn:       packetsIn,
+	}, nil
+}
+
+// SetCompression makes the client offer compression in its hello
+func (c *Client) SetCompression(enabled bool) {
+	c.compression = enabled
+}
+
+// Run dials the server and carries the packets until the connection fails
+func (c *Client) Run() error {
+	conn, err := c.transport.Dial(c.serverAddr)
+	if err != nil {
+		return fmt.Errorf("dial %s: %s", c.serverAddr, err)
+	}
+	defer conn.Close()
+	log.Infof("connected to %s", c.serverAddr)
+
+	encoder, decoder := gob.NewEncoder(conn), gob.NewDecoder(conn)
+	hello, err := c.handshake(encoder, decoder)
+	if err != nil {
+		return err
+	}
+	log.Infof("session %s, compression %v", hello.Session, hello.Compression)
+	compressed := len(hello.Compression) > 0
 
-	tunInterface *water.Interface
-	tcpConn      net.Conn
+	for i, q := range c.tun.queues {
+		go tunWriteRoutine(c.tun, q, c.packetsIn[i], &c.wg, &c.isShuttingDown)
+		go tunReadRoutine(c.tun, q, c.toServer, &c.wg, &c.isShuttingDown)
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- c.writeRoutine(encoder, compressed) }()
+	go func() { errs <- c.readRoutine(decoder, compressed) }()
+	err = <-errs
+	c.isShuttingDown = true
+	c.tun.Close()
+	return err
+}
+
+// handshake says hello and tells the server the address of the client, it
+// returns the hello the server answered with
+func (c *Client) handshake(encoder *gob.Encoder, decoder *gob.Decoder) (*Hello, error) {
+	hello := &Hello{}
+	if c.compression {
+		hello.Compression = []string{CompressionDeflate}
+	}
+	encoder.Encode(PacketHello)
+	if err := encoder.Encode(hello); err != nil {
+		return nil, fmt.Errorf("send hello: %s", err)
+	}
+	for {
+		var packetType PacketType
+		if err := decoder.Decode(&packetType); err != nil {
+			return nil, fmt.Errorf("read hello: %s", err)
+		}
+		switch packetType {
+		case PacketHello:
+			var reply Hello
+			if err := decoder.Decode(&reply); err != nil {
+				return nil, fmt.Errorf("read hello: %s", err)
+			}
+			encoder.Encode(PacketLocalAddr)
+			if err := encoder.Encode(c.localAddr); err != nil {
+				return nil, fmt.Errorf("send address: %s", err)
+			}
+			return &reply, nil
+		case PacketShutdownWarning:
+			if err := c.readWarning(decoder); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("got packet type %d before the hello", packetType)
+		}
+	}
+}
+
+// toServer queues a packet read from the tun device
+func (c *Client) toServer(pkt *RawIPPacket, _ int) {
+	select {
+	case c.packetsOut <- pkt:
+	default:
+		putPacket(pkt)
+	}
+}
+
+func (c *Client) writeRoutine(encoder *gob.Encoder, compressed bool) error {
+	var comp *compressor
+	if compressed {
+		comp = newCompressor()
+	}
+	var z RawIPPacket
+	for !c.isShuttingDown {
+		pkt := <-c.packetsOut
+		var err error
+		var raw []byte
+		if comp != nil {
+			raw = comp.compress(pkt.Raw)
+		}
+		if raw != nil {
+			z.Raw, z.Dest, z.Protocol = raw, pkt.Dest, pkt.Protocol
+			encoder.Encode(PacketIPCompressed)
+			err = encoder.Encode(&z)
+		} else {
+			encoder.Encode(PacketIP)
+			err = encoder.Encode(pkt)
+		}
+		putPacket(pkt)
+		if err != nil {
+			return fmt.Errorf("write to server: %s", err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) readRoutine(decoder *gob.Decoder, compressed bool) error {
+	var dec *decompressor
+	if compressed {
+		dec = newDecompressor()
+	}
+	for !c.isShuttingDown {
+		var packetType PacketType
+		if err := decoder.Decode(&packetType); err != nil {
+			return fmt.Errorf("read from server: %s", err)
+		}
+		switch packetType {
+		case PacketIP, PacketIPCompressed:
+			pkt := getDecodePacket()
+			if err := decoder.Decode(pkt); err != nil {
+				putPacket(pkt)
+				return fmt.Errorf("read packet: %s", err)
+			}
+			if packetType == PacketIPCompressed {
+				if dec == nil {
+					putPacket(pkt)
+					return fmt.Errorf("compressed packet without compression agreed")
+				}
+				z := pkt
+				var err error
+				pkt, err = dec.decompress(z)
+				putPacket(z)
+				if err != nil {
+					return fmt.Errorf("decompress packet: %s", err)
+				}
+			}
+			pkt.flow = flowHash(pkt.Raw)
+			pkt.Protocol = waterutil.IPv4Protocol(pkt.Raw)
+			c.packetsIn[pkt.flow%uint32(len(c.packetsIn))] <- pkt
+		case PacketShutdownWarning:
+			if err := c.readWarning(decoder); err != nil {
+				return err
+			}
+		case PacketHello:
+			var hello Hello
+			if err := decoder.Decode(&hello); err != nil {
+				return fmt.Errorf("read hello: %s", err)
+			}
+		default:
+			return fmt.Errorf("unknown packet type %d", packetType)
+		}
+	}
+	return nil
+}
 
-	// if false, packets are dropped
-	connectionOk  bool
-	connResetLock sync.Mutex
+func (c *Client) readWarning(decoder *gob.Decoder) error {
+	var w ShutdownWarning
+	if err := decoder.Decode(&w); err != nil {
+		return fmt.Errorf("read shutdown warning: %s", err)
+	}
+	log.Infof("server shuts down in %s: %s", w.In, w.Reason)
+	return nil
 }
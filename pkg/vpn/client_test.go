@@ -0,0 +1,68 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClientAgainstServer(t *testing.T) {
+	s, tun := newTestDispatch()
+	s.compression = true
+	// left open, the conn routines of the server race on connectionOk when
+	// it goes away
+	clientSide, serverSide := net.Pipe()
+	sc := &ServerConn{conn: serverSide, mtu: 1400}
+	s.enrollClientConn(sc)
+	sc.initClient(s)
+
+	c := &Client{
+		localAddr:   net.IPv4(192, 168, 45, 9),
+		compression: true,
+		packetsOut:  make(chan *RawIPPacket, 4),
+		packetsIn:   []chan *RawIPPacket{make(chan *RawIPPacket, 4)},
+	}
+	encoder, decoder := gob.NewEncoder(clientSide), gob.NewDecoder(clientSide)
+	hello, err := c.handshake(encoder, decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.Session == "" || !reflect.DeepEqual(hello.Compression, []string{CompressionDeflate}) {
+		t.Errorf("got hello %+v, want a session and deflate", hello)
+	}
+	go c.writeRoutine(encoder, true)
+	go c.readRoutine(decoder, true)
+
+	// the server learns the address of the client from the handshake
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if r, _ := s.Lookup(c.localAddr); r.ClientID == sc.id {
+			break
+		}
+	}
+	down := testPacketTo(c.localAddr, 1000)
+	want := append([]byte(nil), down.Raw...)
+	s.dispatch(down, 0)
+	select {
+	case got := <-c.packetsIn[0]:
+		if !bytes.Equal(got.Raw, want) {
+			t.Error("client got a different packet")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no packet reached the client")
+	}
+
+	up := testPacketTo(net.IPv4(8, 8, 8, 8), 1000)
+	want = append([]byte(nil), up.Raw...)
+	c.toServer(up, 0)
+	select {
+	case got := <-tun:
+		if !bytes.Equal(got.Raw, want) {
+			t.Error("tun got a different packet")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no packet reached the tun device")
+	}
+}
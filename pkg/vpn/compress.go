@@ -0,0 +1,153 @@
+package vpn
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// CompressionDeflate compresses each packet on its own with deflate, so
+	// any packet can be decompressed without the ones before it
+	CompressionDeflate = "deflate"
+
+	// smaller packets are not worth it
+	compressMinLen = 128
+	// a packet must shrink by a tenth to be sent compressed. After a packet
+	// that did not, the next ones are sent as they are, twice as many each
+	// time up to compressMaxSkip, as the flow is likely encrypted or packed.
+	compressMaxSkip = 256
+)
+
+var (
+	errTooBig     = errors.New("decompressed packet too big")
+	errNotAPacket = errors.New("decompressed data is not a whole ip packet")
+)
+
+// negotiateCompression returns the first compression offered that the
+// server supports, or "" when compression is off
+func negotiateCompression(offered []string, enabled bool) string {
+	if !enabled {
+		return ""
+	}
+	for _, name := range offered {
+		if name == CompressionDeflate {
+			return name
+		}
+	}
+	return ""
+}
+
+// compressor compresses the packets of one connection
+type compressor struct {
+	buf  bytes.Buffer
+	w    *flate.Writer
+	skip int
+	// packets to skip after the next miss
+	backoff int
+}
+
+func newCompressor() *compressor {
+	c := &compressor{backoff: 1}
+	c.w, _ = flate.NewWriter(&c.buf, flate.BestSpeed)
+	return c
+}
+
+// compress returns raw compressed, or nil when it is sent as it is. The
+// result is valid until the next call.
+func (c *compressor) compress(raw []byte) []byte {
+	if len(raw) < compressMinLen {
+		return nil
+	}
+	if c.skip > 0 {
+		c.skip--
+		return nil
+	}
+	c.buf.Reset()
+	c.w.Reset(&c.buf)
+	c.w.Write(raw)
+	c.w.Close()
+	if c.buf.Len() > len(raw)-len(raw)/10 {
+		c.skip = c.backoff
+		if c.backoff < compressMaxSkip {
+			c.backoff *= 2
+		}
+		return nil
+	}
+	c.backoff = 1
+	return c.buf.Bytes()
+}
+
+// decompressor decompresses the packets of one connection
+type decompressor struct {
+	src bytes.Reader
+	r   io.ReadCloser
+}
+
+func newDecompressor() *decompressor {
+	d := &decompressor{}
+	d.r = flate.NewReader(&d.src)
+	return d
+}
+
+// decompress returns a pooled packet holding pkt decompressed. The stream
+// must end cleanly and hold a whole ip packet, anything else is dropped.
+func (d *decompressor) decompress(pkt *RawIPPacket) (*RawIPPacket, error) {
+	d.src.Reset(pkt.Raw)
+	if err := d.r.(flate.Resetter).Reset(&d.src, nil); err != nil {
+		return nil, err
+	}
+	out := getPacket()
+	n, err := d.readAll(out.Raw)
+	if err == nil && ipPacketLen(out.Raw[:n]) != n {
+		err = errNotAPacket
+	}
+	if err != nil {
+		putPacket(out)
+		return nil, err
+	}
+	out.Raw = out.Raw[:n]
+	out.Dest = append(out.dest[:0], pkt.Dest...)
+	out.Protocol = pkt.Protocol
+	return out, nil
+}
+
+// readAll reads the stream to its end into buf, a truncated or corrupt
+// stream fails instead of ending early
+func (d *decompressor) readAll(buf []byte) (int, error) {
+	n := 0
+	for {
+		var m int
+		var err error
+		if n < len(buf) {
+			m, err = d.r.Read(buf[n:])
+			n += m
+		} else {
+			// a full buffer is fine if the stream ends right there
+			var extra [1]byte
+			if m, err = d.r.Read(extra[:]); m > 0 {
+				return n, errTooBig
+			}
+		}
+		switch err {
+		case io.EOF:
+			return n, nil
+		case nil:
+		default:
+			return n, err
+		}
+	}
+}
+
+// ipPacketLen returns the length an ip packet has by its header, or -1
+func ipPacketLen(raw []byte) int {
+	switch {
+	case len(raw) >= 20 && raw[0]>>4 == 4:
+		return int(binary.BigEndian.Uint16(raw[2:]))
+	case len(raw) >= 40 && raw[0]>>4 == 6:
+		return 40 + int(binary.BigEndian.Uint16(raw[4:]))
+	}
+	return -1
+}
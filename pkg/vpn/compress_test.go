@@ -0,0 +1,60 @@
+package vpn
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+)
+
+// deflate compresses b as one frame, the way compress does
+func deflate(b []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	// compressible, like text
+	pkt := tcpPacket(false, 0x18, nil, bytes.Repeat([]byte("GET / HTTP/1.1\r\n"), 60))
+	z := newCompressor().compress(pkt)
+	if z == nil {
+		t.Fatal("packet not compressed")
+	}
+	z = append([]byte(nil), z...)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		ok    bool
+	}{
+		{"whole", z, true},
+		{"ipv6", deflate(tcpPacket(true, 0x10, nil, make([]byte, 1000))), true},
+		{"truncated", z[:len(z)-3], false},
+		{"cut in half", z[:len(z)/2], false},
+		{"empty", nil, false},
+		{"part of a packet", deflate(pkt[:len(pkt)-100]), false},
+		{"not a packet", deflate(bytes.Repeat([]byte{0}, 500)), false},
+		{"too big", deflate(make([]byte, tunPacketBuffSize+1)), false},
+	}
+	d := newDecompressor()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := d.decompress(&RawIPPacket{Raw: tt.frame})
+			if !tt.ok {
+				if err == nil {
+					t.Errorf("got %d bytes, want an error", len(out.Raw))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.name == "whole" && !bytes.Equal(out.Raw, pkt) {
+				t.Error("decompressed to a different packet")
+			}
+			putPacket(out)
+		})
+	}
+}
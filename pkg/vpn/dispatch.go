@@ -0,0 +1,76 @@
+package vpn
+
+import (
+	"runtime"
+	"sync/atomic"
+)
+
+// the packets are routed by shards, goroutines each working through their own
+// queue in order. A packet goes to the shard of its flow, so the packets of a
+// flow keep their order while the flows are routed on all cores.
+
+// newShards makes a queue per core
+func newShards() []chan *ClientInBoundIPPacket {
+	shards := make([]chan *ClientInBoundIPPacket, runtime.GOMAXPROCS(0))
+	for i := range shards {
+		shards[i] = make(chan *ClientInBoundIPPacket, servMaxInboundPacketQueue)
+	}
+	return shards
+}
+
+// dispatch queues a packet on the shard of its flow, clientID is the client
+// it came from or 0 when read from the tun device
+func (s *Server) dispatch(pkt *RawIPPacket, clientID int) {
+	pkt.flow = flowHash(pkt.Raw)
+	pkt.in = ClientInBoundIPPacket{packet: pkt, clientID: clientID}
+	s.shards[pkt.flow%uint32(len(s.shards))] <- &pkt.in
+}
+
+func (s *Server) dispatchRoutine(shard chan *ClientInBoundIPPacket) {
+	for !s.isShuttingDown {
+		in := <-shard
+		n := len(in.packet.Raw)
+		if s.route(in.packet, in.clientID != 0) && in.clientID != 0 {
+			// packets between clients never leave the vm
+			atomic.AddUint64(&s.bytesBetween, uint64(n))
+		}
+	}
+}
+
+// route sends a packet to the client owning its destination, or when toTun
+// to the tun device. Packets between clients stay off the tun device. It
+// tells if the packet went to a client.
+func (s *Server) route(pkt *RawIPPacket, toTun bool) bool {
+	if pkt.Dest.IsMulticast() {
+		putPacket(pkt)
+		return false
+	}
+	// packets from the tun device never go back to it
+	sess, ok := s.cm.lookup(pkt.Dest)
+	if !ok || sess == nil && !toTun {
+		putPacket(pkt)
+		return false
+	}
+	mtu := s.mtu
+	if sess != nil {
+		mtu = sess.mtu()
+	}
+
+	if len(pkt.Raw) > mtu {
+		// the sender learns the mtu of the path, packets that may be
+		// fragmented go on and are split by the tcp stream
+		if reply := tooBig(pkt.Raw, mtu, s.addr); reply != nil {
+			putPacket(pkt)
+			reply.flow = flowHash(reply.Raw)
+			s.route(reply, true)
+			return false
+		}
+	}
+	clampMSS(pkt.Raw, mtu)
+	if sess != nil {
+		sess.write(pkt)
+		return true
+	}
+	s.routeToVpnNetWork(pkt)
+	return false
+}
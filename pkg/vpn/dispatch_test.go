@@ -0,0 +1,122 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDispatch returns a server routing through a single shard, the
+// packets to the tun device are left in the returned queue
+func newTestDispatch() (*Server, chan *RawIPPacket) {
+	s := newTestServer()
+	s.mtu = 1400
+	s.shards = []chan *ClientInBoundIPPacket{make(chan *ClientInBoundIPPacket, 16)}
+	tun := make(chan *RawIPPacket, 16)
+	s.tunOutboundIPPackets = []chan *RawIPPacket{tun}
+	go s.dispatchRoutine(s.shards[0])
+	return s, tun
+}
+
+// testPacketTo returns a tcp packet to dest, not from the pool
+func testPacketTo(dest net.IP, n int) *RawIPPacket {
+	raw := tcpPacket(false, 0x10, nil, testPayload(n))
+	copy(raw[16:20], dest.To4())
+	return &RawIPPacket{Raw: raw, Dest: destOf(raw)}
+}
+
+func TestDispatchCountsBetweenClients(t *testing.T) {
+	s, tun := newTestDispatch()
+	from, to := s.newTestConn(), s.newTestConn()
+	to.outBoundIPPacket = make(chan *RawIPPacket, 4)
+	s.setAddrForClient(to.id, net.IPv4(192, 168, 45, 7))
+
+	between := testPacketTo(net.IPv4(192, 168, 45, 7), 100)
+	s.dispatch(between, from.id)
+	// to the internet over the tun device, and down to a client
+	s.dispatch(testPacketTo(net.IPv4(8, 8, 8, 8), 200), from.id)
+	s.dispatch(testPacketTo(net.IPv4(192, 168, 45, 7), 300), 0)
+
+	if pkt := <-to.outBoundIPPacket; pkt != between {
+		t.Errorf("client got %d bytes, want the packet of the other client", len(pkt.Raw))
+	}
+	if pkt := <-tun; len(pkt.Raw) != 240 {
+		t.Errorf("tun got %d bytes, want 240", len(pkt.Raw))
+	}
+	<-to.outBoundIPPacket
+	// only the packet from a client to a client stays on the server
+	want := uint64(len(between.Raw))
+	var got uint64
+	for deadline := time.Now().Add(time.Second); got != want && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		got = atomic.LoadUint64(&s.bytesBetween)
+	}
+	if got != want {
+		t.Errorf("counted %d bytes between clients, want %d", got, want)
+	}
+}
+
+// flowPacket returns packet seq of the tcp flow from source port port
+func flowPacket(port uint16, seq uint32) *RawIPPacket {
+	raw := withSeq(tcpPacket(false, 0x10, nil, testPayload(10)), seq)
+	binary.BigEndian.PutUint16(raw[20:22], port)
+	return &RawIPPacket{Raw: raw, Dest: destOf(raw)}
+}
+
+func TestFlowHash(t *testing.T) {
+	a, b := flowPacket(1000, 1), flowPacket(1000, 2)
+	if flowHash(a.Raw) != flowHash(b.Raw) {
+		t.Error("packets of a flow hash apart")
+	}
+	ports := map[uint32]bool{}
+	for port := uint16(1000); port < 1064; port++ {
+		ports[flowHash(flowPacket(port, 1).Raw)] = true
+	}
+	if len(ports) < 60 {
+		t.Errorf("64 flows hash to %d values", len(ports))
+	}
+}
+
+// the flows are spread over the shards, each one keeps its order
+func TestDispatchKeepsFlowOrder(t *testing.T) {
+	const flows, packets = 16, 200
+	s, _ := newTestDispatch()
+	s.shards = make([]chan *ClientInBoundIPPacket, 4)
+	for i := range s.shards {
+		s.shards[i] = make(chan *ClientInBoundIPPacket, 16)
+		go s.dispatchRoutine(s.shards[i])
+	}
+	tun := make(chan *RawIPPacket, flows*packets)
+	s.tunOutboundIPPackets = []chan *RawIPPacket{tun}
+	from := s.newTestConn()
+
+	used := map[uint32]bool{}
+	for seq := uint32(0); seq < packets; seq++ {
+		for f := uint16(0); f < flows; f++ {
+			pkt := flowPacket(1000+f, seq)
+			s.dispatch(pkt, from.id)
+			used[pkt.flow%uint32(len(s.shards))] = true
+		}
+	}
+	if len(used) < 2 {
+		t.Errorf("%d flows went to %d shards", flows, len(used))
+	}
+
+	next := map[uint16]uint32{}
+	for i := 0; i < flows*packets; i++ {
+		var pkt *RawIPPacket
+		select {
+		case pkt = <-tun:
+		case <-time.After(time.Second):
+			t.Fatalf("got %d of %d packets", i, flows*packets)
+		}
+		port := binary.BigEndian.Uint16(pkt.Raw[20:22])
+		seq := binary.BigEndian.Uint32(pkt.Raw[24:28])
+		if seq != next[port] {
+			t.Fatalf("flow %d: got packet %d, want %d", port, seq, next[port])
+		}
+		next[port]++
+	}
+}
@@ -0,0 +1,297 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// what a packet costs on the way to a client: the outer ip and tcp headers,
+	// tcp timestamps and the gob framing of the packet, 34 bytes measured
+	outerIPv4HdrLen = 20
+	outerIPv6HdrLen = 40
+	outerTCPHdrLen  = 20 + 12
+	framingOverhead = 40
+
+	// the smallest mtu ipv6 allows, a tunnel carrying ipv6 never goes below
+	// it, and the smallest packet every ipv4 host takes
+	minTunMTU     = 1280
+	minTunIPv4MTU = 576
+
+	icmpv4Proto      = 1
+	icmpv6Proto      = 58
+	icmpv4Unreach    = 3
+	icmpv4FragNeeded = 4
+	icmpv6TooBig     = 2
+	// the reply carries as much of the packet as fits these
+	icmpv4MaxLen = 576
+	icmpv6MaxLen = minTunMTU
+
+	tcpFlagSYN = 0x02
+	tcpOptMSS  = 2
+)
+
+// the default route of a family is found as the route to these
+var (
+	internetIPv4 = net.IPv4(1, 1, 1, 1)
+	internetIPv6 = net.ParseIP("2606:4700:4700::1111")
+)
+
+// EffectiveMTU returns the largest packet that, framed and sent over tcp,
+// still fits one segment of an outer path with mtu pathMTU. outerIPv6 is the
+// family of the path, innerIPv6 tells if the tunnel carries ipv6.
+func EffectiveMTU(pathMTU int, outerIPv6, innerIPv6 bool) int {
+	mtu := pathMTU - outerTCPHdrLen - framingOverhead
+	if outerIPv6 {
+		mtu -= outerIPv6HdrLen
+	} else {
+		mtu -= outerIPv4HdrLen
+	}
+	return atLeastMinMTU(mtu, innerIPv6)
+}
+
+// atLeastMinMTU raises mtu to the least the inner family needs
+func atLeastMinMTU(mtu int, innerIPv6 bool) int {
+	if innerIPv6 && mtu < minTunMTU {
+		return minTunMTU
+	}
+	if mtu < minTunIPv4MTU {
+		return minTunIPv4MTU
+	}
+	return mtu
+}
+
+// listensOnIPv6 tells if the clients of a server listening on host come over
+// ipv6, the wildcard of a dual stack listener counts as ipv6, whose header is
+// the larger one
+func listensOnIPv6(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || ip != nil && ip.To4() == nil
+}
+
+// dialedIP resolves the host of the server a client dials, a name resolving
+// to ipv6 counts as ipv6 as the dialer may pick it. A name that does not
+// resolve gives the ipv4 default route.
+func dialedIP(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return internetIPv4
+	}
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			return ip
+		}
+	}
+	return ips[0]
+}
+
+// outerPathMTU returns the mtu of the route to dst, tunMtuSize when there is
+// none
+func outerPathMTU(dst net.IP) int {
+	routes, err := netlink.RouteGet(dst)
+	if err != nil || len(routes) == 0 {
+		return tunMtuSize
+	}
+	if routes[0].MTU > 0 {
+		return routes[0].MTU
+	}
+	link, err := netlink.LinkByIndex(routes[0].LinkIndex)
+	if err != nil || link.Attrs().MTU == 0 {
+		return tunMtuSize
+	}
+	return link.Attrs().MTU
+}
+
+// connMTU returns the largest packet that fits one segment of conn with the
+// overhead of its transport, the segment size comes from the kernel which
+// learns it from the path. innerIPv6 tells if the tunnel carries ipv6.
+func connMTU(conn net.Conn, overhead, max int, innerIPv6 bool) int {
+	tcpConn := tcpConnOf(conn)
+	if tcpConn == nil {
+		return max
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return max
+	}
+	mss := 0
+	raw.Control(func(fd uintptr) {
+		mss, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+	})
+	if err != nil || mss <= 0 {
+		return max
+	}
+	mtu := atLeastMinMTU(mss-framingOverhead-overhead, innerIPv6)
+	if mtu > max {
+		return max
+	}
+	return mtu
+}
+
+// clampMSS lowers the mss option of a tcp syn so the segments of the
+// connection fit mtu, fixing the checksum
+func clampMSS(raw []byte, mtu int) {
+	var tcp []byte
+	switch {
+	case len(raw) >= 20 && raw[0]>>4 == 4:
+		ihl := int(raw[0]&0xf) * 4
+		// only the first fragment has the tcp header
+		if raw[9] != ipProtoTCP || binary.BigEndian.Uint16(raw[6:])&0x1fff != 0 || len(raw) < ihl+20 {
+			return
+		}
+		tcp = raw[ihl:]
+		mtu -= 20
+	case len(raw) >= 60 && raw[0]>>4 == 6:
+		if raw[6] != ipProtoTCP {
+			return
+		}
+		tcp = raw[40:]
+		mtu -= 40
+	default:
+		return
+	}
+	if tcp[13]&tcpFlagSYN == 0 {
+		return
+	}
+	mss := uint16(mtu - 20)
+	hdrLen := int(tcp[12]>>4) * 4
+	if hdrLen > len(tcp) {
+		return
+	}
+	opts := tcp[20:hdrLen]
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case 0:
+			return
+		case 1:
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 {
+			return
+		}
+		if opts[i] == tcpOptMSS && opts[i+1] == 4 && i+4 <= len(opts) {
+			old := binary.BigEndian.Uint16(opts[i+2:])
+			if old > mss {
+				binary.BigEndian.PutUint16(opts[i+2:], mss)
+				sum := binary.BigEndian.Uint16(tcp[16:])
+				binary.BigEndian.PutUint16(tcp[16:], checksumUpdate(sum, old, mss))
+			}
+			return
+		}
+		i += int(opts[i+1])
+	}
+}
+
+// checksumUpdate returns the checksum sum after a 16 bit word changed from
+// old to new, rfc 1624
+func checksumUpdate(sum, old, new uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return ^uint16(s)
+}
+
+// tooBig returns the icmp fragmentation needed or packet too big reply to a
+// packet larger than mtu, or nil when the sender is not to be told: ipv4
+// packets that may be fragmented and icmp errors. src is the address of the
+// server, the destination of the packet stands in for it in the other family.
+func tooBig(raw []byte, mtu int, src net.IP) *RawIPPacket {
+	switch {
+	case len(raw) >= 20 && raw[0]>>4 == 4:
+		ihl := int(raw[0]&0xf) * 4
+		const dontFragment = 0x4000
+		if binary.BigEndian.Uint16(raw[6:])&dontFragment == 0 || isICMPError(raw[9], raw[ihl:]) {
+			return nil
+		}
+		from := src.To4()
+		if from == nil {
+			from = raw[16:20]
+		}
+		quote := raw
+		if len(quote) > icmpv4MaxLen-28 {
+			quote = quote[:icmpv4MaxLen-28]
+		}
+		pkt := getPacket()
+		out := pkt.Raw[:28+len(quote)]
+		ip, icmp := out[:20], out[20:]
+		for i := range out[:28] {
+			out[i] = 0
+		}
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(len(out)))
+		ip[8] = 64
+		ip[9] = icmpv4Proto
+		copy(ip[12:16], from)
+		copy(ip[16:20], raw[12:16])
+		binary.BigEndian.PutUint16(ip[10:], ^checksum(ip, 0))
+		icmp[0], icmp[1] = icmpv4Unreach, icmpv4FragNeeded
+		binary.BigEndian.PutUint16(icmp[6:], uint16(mtu))
+		copy(icmp[8:], quote)
+		binary.BigEndian.PutUint16(icmp[2:], ^checksum(icmp, 0))
+		pkt.Raw = out
+		pkt.Dest = append(pkt.dest[:0], raw[12:16]...)
+		pkt.Protocol = icmpv4Proto
+		return pkt
+
+	case len(raw) >= 40 && raw[0]>>4 == 6:
+		if isICMPError(raw[6], raw[40:]) {
+			return nil
+		}
+		from := src
+		if from == nil || from.To4() != nil {
+			from = raw[24:40]
+		}
+		quote := raw
+		if len(quote) > icmpv6MaxLen-48 {
+			quote = quote[:icmpv6MaxLen-48]
+		}
+		pkt := getPacket()
+		out := pkt.Raw[:48+len(quote)]
+		ip, icmp := out[:40], out[40:]
+		for i := range out[:48] {
+			out[i] = 0
+		}
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(icmp)))
+		ip[6] = icmpv6Proto
+		ip[7] = 64
+		copy(ip[8:24], from)
+		copy(ip[24:40], raw[8:24])
+		icmp[0] = icmpv6TooBig
+		binary.BigEndian.PutUint32(icmp[4:], uint32(mtu))
+		copy(icmp[8:], quote)
+		sum := pseudoHeaderSum(ip[8:24], ip[24:40], icmpv6Proto, len(icmp))
+		binary.BigEndian.PutUint16(icmp[2:], ^checksum(icmp, sum))
+		pkt.Raw = out
+		pkt.Dest = append(pkt.dest[:0], raw[8:24]...)
+		pkt.Protocol = icmpv6Proto
+		return pkt
+	}
+	return nil
+}
+
+// isICMPError tells if a packet with protocol proto and payload l4 is an icmp
+// error, which are never answered with another
+func isICMPError(proto byte, l4 []byte) bool {
+	if len(l4) == 0 {
+		return false
+	}
+	switch proto {
+	case icmpv4Proto:
+		switch l4[0] {
+		case 3, 4, 5, 11, 12:
+			return true
+		}
+	case icmpv6Proto:
+		return l4[0] < 128
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func mssOption(mss uint16, before, after []byte) []byte {
+	opts := append([]byte(nil), before...)
+	opts = append(opts, tcpOptMSS, 4, byte(mss>>8), byte(mss))
+	return append(opts, after...)
+}
+
+func TestEffectiveMTU(t *testing.T) {
+	tests := []struct {
+		name      string
+		pathMTU   int
+		outerIPv6 bool
+		innerIPv6 bool
+		want      int
+	}{
+		{"ipv4 in ipv4", 1500, false, false, 1408},
+		{"ipv4 in ipv6", 1500, true, false, 1388},
+		{"ipv6 in ipv4", 1500, false, true, 1408},
+		{"ipv6 in ipv6", 1500, true, true, 1388},
+		// ipv4 goes below what ipv6 needs when the path is small
+		{"ipv4 small path", 1300, false, false, 1208},
+		{"ipv6 small path", 1300, false, true, minTunMTU},
+		{"ipv4 tiny path", 400, true, false, minTunIPv4MTU},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EffectiveMTU(tt.pathMTU, tt.outerIPv6, tt.innerIPv6); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListensOnIPv6(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"0.0.0.0", false},
+		{"203.0.113.7", false},
+		{"::", true},
+		{"2001:db8::7", true},
+		// a dual stack listener
+		{"", true},
+	}
+	for _, tt := range tests {
+		if got := listensOnIPv6(tt.host); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestDialedIP(t *testing.T) {
+	if ip := dialedIP("2001:db8::7"); !ip.Equal(net.ParseIP("2001:db8::7")) {
+		t.Errorf("got %s for an ipv6 literal", ip)
+	}
+	if ip := dialedIP("203.0.113.7"); !ip.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Errorf("got %s for an ipv4 literal", ip)
+	}
+	if ip := dialedIP("name.invalid"); !ip.Equal(internetIPv4) {
+		t.Errorf("got %s for a name that does not resolve", ip)
+	}
+}
+
+func TestClampMSS(t *testing.T) {
+	const syn, ack = tcpFlagSYN, 0x10
+	nops := []byte{1, 1}
+	// sack permitted and window scale
+	rest := []byte{4, 2, 3, 3, 7, 1}
+	wscale := []byte{1, 3, 3, 7}
+	tests := []struct {
+		name     string
+		ipv6     bool
+		flags    byte
+		opts     []byte
+		mtu      int
+		wantOpts []byte
+	}{
+		{"ipv4 syn", false, syn, mssOption(1460, nil, nil), 1400, mssOption(1360, nil, nil)},
+		{"ipv4 syn ack", false, syn | ack, mssOption(1460, nops, rest), 1300, mssOption(1260, nops, rest)},
+		{"ipv6 syn", true, syn, mssOption(1440, nil, wscale), 1400, mssOption(1340, nil, wscale)},
+		{"mss already small", false, syn, mssOption(1200, nil, nil), 1400, mssOption(1200, nil, nil)},
+		{"not a syn", false, ack, mssOption(1460, nil, nil), 1400, mssOption(1460, nil, nil)},
+		{"no mss option", false, syn, append(nops, rest...), 1400, append(nops, rest...)},
+		{"end of options first", false, syn, mssOption(1460, []byte{0, 1, 1, 1}, nil), 1400, mssOption(1460, []byte{0, 1, 1, 1}, nil)},
+		{"bad option length", false, syn, mssOption(1460, []byte{8, 0, 1, 1}, nil), 1400, mssOption(1460, []byte{8, 0, 1, 1}, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tcpPacket(tt.ipv6, tt.flags, tt.opts, nil)
+			// the packet built with the clamped option has the checksum
+			// computed over all of it
+			want := tcpPacket(tt.ipv6, tt.flags, tt.wantOpts, nil)
+			clampMSS(got, tt.mtu)
+			if !bytes.Equal(got, want) {
+				t.Errorf("got\n%x\nwant\n%x", got, want)
+			}
+			checkTCPChecksums(t, got)
+		})
+	}
+}
+
+func TestClampMSSSkipsFragments(t *testing.T) {
+	pkt := tcpPacket(false, tcpFlagSYN, mssOption(1460, nil, nil), nil)
+	// a later fragment of which the bytes only look like a tcp header
+	binary.BigEndian.PutUint16(pkt[6:], 0x2000|185)
+	want := append([]byte(nil), pkt...)
+	clampMSS(pkt, 1400)
+	if !bytes.Equal(pkt, want) {
+		t.Errorf("fragment changed")
+	}
+}
+
+func TestChecksumUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new uint16
+	}{
+		{"lower", 1460, 1360},
+		{"higher", 536, 1400},
+		{"to zero", 0x1234, 0},
+		{"from zero", 0, 0xfffe},
+		{"all ones", 0xffff, 0x0001},
+		{"same", 0x05b4, 0x05b4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testPayload(64)
+			binary.BigEndian.PutUint16(b[10:], tt.old)
+			sum := ^checksum(b, 0)
+			binary.BigEndian.PutUint16(b[10:], tt.new)
+			want := ^checksum(b, 0)
+			got := checksumUpdate(sum, tt.old, tt.new)
+			// 0 and 0xffff are the same sum in one's complement
+			if got != want && !(got == 0 && want == 0xffff || got == 0xffff && want == 0) {
+				t.Errorf("got %#04x, want %#04x", got, want)
+			}
+		})
+	}
+}
+
+func icmpPacket(ipv6 bool, typ byte) []byte {
+	pkt := tcpPacket(ipv6, 0x10, nil, testPayload(1400))
+	if ipv6 {
+		pkt[6] = icmpv6Proto
+		pkt[40] = typ
+	} else {
+		pkt[9] = icmpv4Proto
+		pkt[20] = typ
+		pkt[10], pkt[11] = 0, 0
+		binary.BigEndian.PutUint16(pkt[10:], ^checksum(pkt[:20], 0))
+	}
+	return pkt
+}
+
+func TestTooBig(t *testing.T) {
+	server4 := net.IPv4(192, 168, 45, 1)
+	server6 := net.ParseIP("fd00::1")
+	noDF := tcpPacket(false, 0x10, nil, testPayload(1400))
+	binary.BigEndian.PutUint16(noDF[6:], 0)
+
+	tests := []struct {
+		name string
+		raw  []byte
+		src  net.IP
+		// the source the reply comes from, nil when there is no reply
+		from net.IP
+	}{
+		{"ipv4", tcpPacket(false, 0x10, nil, testPayload(1400)), server4, server4},
+		{"ipv4 from the destination", tcpPacket(false, 0x10, nil, testPayload(1400)), server6, net.IPv4(192, 168, 45, 2)},
+		{"ipv4 may be fragmented", noDF, server4, nil},
+		{"ipv4 icmp error", icmpPacket(false, icmpv4Unreach), server4, nil},
+		{"ipv4 icmp echo", icmpPacket(false, 8), server4, server4},
+		{"ipv6", tcpPacket(true, 0x10, nil, testPayload(1400)), server6, server6},
+		{"ipv6 from the destination", tcpPacket(true, 0x10, nil, testPayload(1400)), server4, net.ParseIP("fd00::1")},
+		{"ipv6 icmp error", icmpPacket(true, icmpv6TooBig), server6, nil},
+		{"ipv6 icmp echo", icmpPacket(true, 128), server6, server6},
+	}
+	const mtu = 1300
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := tooBig(tt.raw, mtu, tt.src)
+			if tt.from == nil {
+				if pkt != nil {
+					t.Errorf("got a reply %x", pkt.Raw)
+				}
+				return
+			}
+			if pkt == nil {
+				t.Fatal("got no reply")
+			}
+			defer putPacket(pkt)
+			out := pkt.Raw
+			var from, to, sender net.IP
+			var icmp []byte
+			if tt.raw[0]>>4 == 4 {
+				if len(out) != icmpv4MaxLen {
+					t.Errorf("reply is %d bytes, want %d", len(out), icmpv4MaxLen)
+				}
+				if sum := checksum(out[:20], 0); sum != 0xffff {
+					t.Errorf("ip header checksum adds up to %#04x", sum)
+				}
+				from, to, icmp = out[12:16], out[16:20], out[20:]
+				sender = tt.raw[12:16]
+				if icmp[0] != icmpv4Unreach || icmp[1] != icmpv4FragNeeded {
+					t.Errorf("icmp type %d code %d", icmp[0], icmp[1])
+				}
+				if got := binary.BigEndian.Uint16(icmp[6:]); got != mtu {
+					t.Errorf("mtu %d, want %d", got, mtu)
+				}
+				if sum := checksum(icmp, 0); sum != 0xffff {
+					t.Errorf("icmp checksum adds up to %#04x", sum)
+				}
+			} else {
+				if len(out) != icmpv6MaxLen {
+					t.Errorf("reply is %d bytes, want %d", len(out), icmpv6MaxLen)
+				}
+				from, to, icmp = out[8:24], out[24:40], out[40:]
+				sender = tt.raw[8:24]
+				if icmp[0] != icmpv6TooBig {
+					t.Errorf("icmp type %d", icmp[0])
+				}
+				if got := binary.BigEndian.Uint32(icmp[4:]); got != mtu {
+					t.Errorf("mtu %d, want %d", got, mtu)
+				}
+				if sum := checksum(icmp, pseudoHeaderSum(from, to, icmpv6Proto, len(icmp))); sum != 0xffff {
+					t.Errorf("icmp checksum adds up to %#04x", sum)
+				}
+			}
+			if !from.Equal(tt.from) || !to.Equal(sender) || !pkt.Dest.Equal(sender) {
+				t.Errorf("reply from %s to %s (dest %s), want from %s to %s", from, to, pkt.Dest, tt.from, sender)
+			}
+			if !bytes.Equal(icmp[8:], tt.raw[:len(icmp)-8]) {
+				t.Error("the reply does not quote the packet")
+			}
+		})
+	}
+}
@@ -1,21 +1,61 @@
 package vpn
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/vishvananda/netlink"
 )
 
+// SetupTun configures the tun device iName: its mtu, transmit queue length
+// and address, then brings it up and checks the kernel took all of it
+func SetupTun(iName, addrWithNetmask string, mtu, txQueueLen int) error {
+	link, err := netlink.LinkByName(iName)
+	if err != nil {
+		return fmt.Errorf("find %s: %s", iName, err)
+	}
+	if err = netlink.LinkSetMTU(link, mtu); err != nil {
+		return fmt.Errorf("set mtu of %s to %d: %s", iName, mtu, err)
+	}
+	if err = netlink.LinkSetTxQLen(link, txQueueLen); err != nil {
+		return fmt.Errorf("set txqueuelen of %s to %d: %s", iName, txQueueLen, err)
+	}
+	if err = SetDevIP(iName, addrWithNetmask, false); err != nil {
+		return err
+	}
+	if err = SetInterfaceStatus(iName, true, false); err != nil {
+		return err
+	}
+
+	if link, err = netlink.LinkByName(iName); err != nil {
+		return fmt.Errorf("find %s: %s", iName, err)
+	}
+	attrs := link.Attrs()
+	switch {
+	case attrs.Flags&net.FlagUp == 0:
+		return fmt.Errorf("%s is still down", iName)
+	case attrs.MTU != mtu:
+		return fmt.Errorf("mtu of %s is %d, not %d", iName, attrs.MTU, mtu)
+	case attrs.TxQLen != txQueueLen:
+		return fmt.Errorf("txqueuelen of %s is %d, not %d", iName, attrs.TxQLen, txQueueLen)
+	}
+	return nil
+}
+
 func SetInterfaceStatus(iName string, up bool, debug bool) error {
 	link, err := netlink.LinkByName(iName)
 	if err != nil {
-		if up {
-			netlink.LinkSetUp(link)
-		} else {
-			netlink.LinkSetDown(link)
-		}
+		return fmt.Errorf("find %s: %s", iName, err)
 	}
-	return err
+	if up {
+		err = netlink.LinkSetUp(link)
+	} else {
+		err = netlink.LinkSetDown(link)
+	}
+	if err != nil {
+		return fmt.Errorf("set %s up %t: %s", iName, up, err)
+	}
+	return nil
 }
 
 func SetDevIP(iName string, addrWithNetmask string, debug bool) error {
@@ -24,10 +64,13 @@ func SetDevIP(iName string, addrWithNetmask string, debug bool) error {
 		return err
 	}
 	link, err := netlink.LinkByName(iName)
-	if err == nil {
-		netlink.AddrAdd(link, addr)
+	if err != nil {
+		return fmt.Errorf("find %s: %s", iName, err)
 	}
-	return err
+	if err = netlink.AddrAdd(link, addr); err != nil {
+		return fmt.Errorf("add %s to %s: %s", addrWithNetmask, iName, err)
+	}
+	return nil
 }
 
 func SetDefaultGateway(gw, iName string, debug bool) error {
@@ -0,0 +1,56 @@
+package vpn
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestSetupTunErrors(t *testing.T) {
+	const missing = "fastvpn-none"
+	if err := SetupTun(missing, "192.168.45.1/24", 1400, tunTxQueLen); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("setup of a missing device: %v", err)
+	}
+	if err := SetInterfaceStatus(missing, true, false); err == nil {
+		t.Error("missing device brought up")
+	}
+	if err := SetDevIP(missing, "192.168.45.1", false); err == nil {
+		t.Error("address without netmask accepted")
+	}
+}
+
+// the setup is checked on a persistent tun device, it needs CAP_NET_ADMIN
+func TestSetupTun(t *testing.T) {
+	const name = "fastvpntest0"
+	link := &netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: name}, Mode: netlink.TUNTAP_MODE_TUN}
+	if err := netlink.LinkAdd(link); err != nil {
+		t.Skipf("can not add a device: %s", err)
+	}
+	defer netlink.LinkDel(link)
+
+	if err := SetupTun(name, "192.168.45.1/24", 1400, 2000); err != nil {
+		t.Fatal(err)
+	}
+	got, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := got.Attrs()
+	if attrs.Flags&net.FlagUp == 0 || attrs.MTU != 1400 || attrs.TxQLen != 2000 {
+		t.Errorf("device is up %t, mtu %d, txqueuelen %d", attrs.Flags&net.FlagUp != 0, attrs.MTU, attrs.TxQLen)
+	}
+	addrs, err := netlink.AddrList(got, netlink.FAMILY_V4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].IPNet.String() != "192.168.45.1/24" {
+		t.Errorf("addresses %v", addrs)
+	}
+
+	// the address is there already, the error is returned and not ignored
+	if err = SetupTun(name, "192.168.45.1/24", 1400, 2000); err == nil {
+		t.Error("adding the address twice succeeded")
+	}
+}
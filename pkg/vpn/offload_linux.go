@@ -0,0 +1,308 @@
+package vpn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// struct virtio_net_hdr in front of every packet of an IFF_VNET_HDR device
+	vnetHdrLen         = 10
+	vnetHdrFNeedsCsum  = 1
+	vnetHdrGSONone     = 0
+	vnetHdrGSOTCPv4    = 1
+	vnetHdrGSOTCPv6    = 4
+	vnetHdrGSOECN      = 0x80
+	tunOffloadBuffSize = vnetHdrLen + 65535
+
+	// TUNSETOFFLOAD flags, checksums and tcp segmentation over ipv4 and ipv6
+	tunFCsum = 0x01
+	tunFTSO4 = 0x02
+	tunFTSO6 = 0x04
+
+	ipProtoTCP = 6
+
+	tcpFlagFIN = 0x01
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+)
+
+var errBadOffload = errors.New("bad offloaded packet")
+
+type vnetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+// the header is in host byte order, little endian on the amd64 and arm64 vms
+func decodeVnetHdr(b []byte) vnetHdr {
+	return vnetHdr{
+		flags:      b[0],
+		gsoType:    b[1],
+		hdrLen:     binary.LittleEndian.Uint16(b[2:]),
+		gsoSize:    binary.LittleEndian.Uint16(b[4:]),
+		csumStart:  binary.LittleEndian.Uint16(b[6:]),
+		csumOffset: binary.LittleEndian.Uint16(b[8:]),
+	}
+}
+
+// splitOffload turns one read of an offload device into ip packets no larger
+// than the mtu the sender used: the checksum left to the device is filled in
+// and tcp segments are split, emit gets each as a pooled packet
+func splitOffload(b []byte, emit func(*RawIPPacket)) error {
+	if len(b) < vnetHdrLen {
+		return errBadOffload
+	}
+	hdr := decodeVnetHdr(b)
+	pkt := b[vnetHdrLen:]
+
+	gsoType := hdr.gsoType &^ vnetHdrGSOECN
+	if gsoType == vnetHdrGSONone {
+		if hdr.flags&vnetHdrFNeedsCsum != 0 {
+			at := int(hdr.csumStart) + int(hdr.csumOffset)
+			if at+2 > len(pkt) {
+				return errBadOffload
+			}
+			// the field holds the pseudo header sum to start from
+			initial := binary.BigEndian.Uint16(pkt[at:])
+			pkt[at], pkt[at+1] = 0, 0
+			binary.BigEndian.PutUint16(pkt[at:], ^checksum(pkt[hdr.csumStart:], uint64(initial)))
+		}
+		if len(pkt) > tunPacketBuffSize {
+			return errBadOffload
+		}
+		out := getPacket()
+		out.Raw = out.Raw[:copy(out.Raw, pkt)]
+		emit(out)
+		return nil
+	}
+	if gsoType != vnetHdrGSOTCPv4 && gsoType != vnetHdrGSOTCPv6 {
+		return fmt.Errorf("unsupported gso type %d", gsoType)
+	}
+
+	// csumStart is where the tcp header starts
+	ipHdrLen := int(hdr.csumStart)
+	if ipHdrLen+20 > len(pkt) {
+		return errBadOffload
+	}
+	tcpHdrLen := int(pkt[ipHdrLen+12]>>4) * 4
+	hdrsLen := ipHdrLen + tcpHdrLen
+	mss := int(hdr.gsoSize)
+	if tcpHdrLen < 20 || hdrsLen > len(pkt) || mss == 0 || hdrsLen+mss > tunPacketBuffSize {
+		return errBadOffload
+	}
+	ipv4 := gsoType == vnetHdrGSOTCPv4
+	payload := pkt[hdrsLen:]
+	seq := binary.BigEndian.Uint32(pkt[ipHdrLen+4:])
+	flags := pkt[ipHdrLen+13]
+	id := binary.BigEndian.Uint16(pkt[4:])
+
+	for i, off := 0, 0; off < len(payload); i, off = i+1, off+mss {
+		end := off + mss
+		if end > len(payload) {
+			end = len(payload)
+		}
+		out := getPacket()
+		seg := out.Raw[:hdrsLen+end-off]
+		copy(seg, pkt[:hdrsLen])
+		copy(seg[hdrsLen:], payload[off:end])
+
+		tcp := seg[ipHdrLen:]
+		binary.BigEndian.PutUint32(tcp[4:], seq+uint32(off))
+		// fin and psh belong to the last segment, cwr to the first
+		segFlags := flags
+		if end != len(payload) {
+			segFlags &^= tcpFlagFIN | tcpFlagPSH
+		}
+		if i > 0 {
+			segFlags &^= tcpFlagCWR
+		}
+		tcp[13] = segFlags
+
+		var src, dst []byte
+		if ipv4 {
+			binary.BigEndian.PutUint16(seg[2:], uint16(len(seg)))
+			binary.BigEndian.PutUint16(seg[4:], id+uint16(i))
+			seg[10], seg[11] = 0, 0
+			binary.BigEndian.PutUint16(seg[10:], ^checksum(seg[:ipHdrLen], 0))
+			src, dst = seg[12:16], seg[16:20]
+		} else {
+			binary.BigEndian.PutUint16(seg[4:], uint16(len(seg)-40))
+			src, dst = seg[8:24], seg[24:40]
+		}
+		tcp[16], tcp[17] = 0, 0
+		sum := pseudoHeaderSum(src, dst, ipProtoTCP, len(tcp))
+		binary.BigEndian.PutUint16(tcp[16:], ^checksum(tcp, sum))
+
+		out.Raw = seg
+		emit(out)
+	}
+	return nil
+}
+
+// checksum adds b to initial the internet checksum way, without the final complement
+func checksum(b []byte, initial uint64) uint16 {
+	sum := initial
+	for len(b) >= 2 {
+		sum += uint64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+func pseudoHeaderSum(src, dst []byte, proto uint8, length int) uint64 {
+	return uint64(checksum(src, 0)) + uint64(checksum(dst, 0)) + uint64(proto) + uint64(length)
+}
+
+// coalescer merges consecutive segments of a tcp flow on their way to an
+// offload device into one packet behind a gso virtio net header, the kernel
+// splits it again where it has to. A stream then costs a write per 64k
+// instead of one per segment, like the reads of splitOffload.
+type coalescer struct {
+	// the packet being built behind room for its virtio net header
+	buf []byte
+	n   int
+
+	ipHdrLen int
+	hdrsLen  int
+	mss      int
+	segs     int
+	nextSeq  uint32
+	// a short segment or psh ended the stream, nothing goes after it
+	ended bool
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{buf: make([]byte, tunOffloadBuffSize)}
+}
+
+// start begins a packet with raw, it tells if raw is a tcp segment others
+// may be added to
+func (c *coalescer) start(raw []byte) bool {
+	var ipHdrLen int
+	switch {
+	case len(raw) >= 20 && raw[0] == 0x45:
+		// no options and not a fragment
+		ipHdrLen = 20
+		if raw[9] != ipProtoTCP || int(binary.BigEndian.Uint16(raw[2:])) != len(raw) ||
+			binary.BigEndian.Uint16(raw[6:])&0x3fff != 0 {
+			return false
+		}
+	case len(raw) >= 40 && raw[0]>>4 == 6:
+		// no extension headers
+		ipHdrLen = 40
+		if raw[6] != ipProtoTCP || int(binary.BigEndian.Uint16(raw[4:])) != len(raw)-40 {
+			return false
+		}
+	default:
+		return false
+	}
+	if len(raw) < ipHdrLen+20 {
+		return false
+	}
+	tcp := raw[ipHdrLen:]
+	hdrsLen := ipHdrLen + int(tcp[12]>>4)*4
+	if hdrsLen < ipHdrLen+20 || hdrsLen >= len(raw) || tcp[13] != tcpFlagACK {
+		return false
+	}
+	c.n = copy(c.buf[vnetHdrLen:], raw)
+	c.ipHdrLen, c.hdrsLen = ipHdrLen, hdrsLen
+	c.mss = len(raw) - hdrsLen
+	c.segs = 1
+	c.nextSeq = binary.BigEndian.Uint32(tcp[4:]) + uint32(c.mss)
+	c.ended = false
+	return true
+}
+
+// add appends the payload of raw when it is the next segment of the stream
+// with the same headers, and tells if it did
+func (c *coalescer) add(raw []byte) bool {
+	pkt := c.buf[vnetHdrLen : vnetHdrLen+c.n]
+	hdrsLen := c.hdrsLen
+	if c.ended || len(raw) <= hdrsLen || len(raw)-hdrsLen > c.mss || c.n+len(raw)-hdrsLen > len(c.buf)-vnetHdrLen {
+		return false
+	}
+	if c.ipHdrLen == 20 {
+		// version, tos, flags, ttl, protocol and addresses
+		if raw[0] != pkt[0] || raw[1] != pkt[1] || raw[6] != pkt[6] || raw[7] != pkt[7] ||
+			raw[8] != pkt[8] || raw[9] != pkt[9] || string(raw[12:20]) != string(pkt[12:20]) ||
+			int(binary.BigEndian.Uint16(raw[2:])) != len(raw) {
+			return false
+		}
+	} else {
+		// version, traffic class, flow label, next header, hop limit and addresses
+		if string(raw[:4]) != string(pkt[:4]) || string(raw[6:40]) != string(pkt[6:40]) ||
+			int(binary.BigEndian.Uint16(raw[4:])) != len(raw)-40 {
+			return false
+		}
+	}
+	tcp, first := raw[c.ipHdrLen:], pkt[c.ipHdrLen:]
+	// ports, ack, header length and options all match, the flags may add psh
+	if string(tcp[:4]) != string(first[:4]) || binary.BigEndian.Uint32(tcp[4:]) != c.nextSeq ||
+		string(tcp[8:13]) != string(first[8:13]) || tcp[13]&^tcpFlagPSH != tcpFlagACK ||
+		string(tcp[20:hdrsLen-c.ipHdrLen]) != string(first[20:hdrsLen-c.ipHdrLen]) {
+		return false
+	}
+	payload := raw[hdrsLen:]
+	c.n += copy(c.buf[vnetHdrLen+c.n:], payload)
+	c.segs++
+	c.nextSeq += uint32(len(payload))
+	// the latest window is the one that counts
+	copy(first[14:16], tcp[14:16])
+	if tcp[13]&tcpFlagPSH != 0 {
+		first[13] |= tcpFlagPSH
+		c.ended = true
+	}
+	if len(payload) < c.mss {
+		c.ended = true
+	}
+	return true
+}
+
+// frame returns the packet behind its virtio net header, a single segment
+// goes as it came
+func (c *coalescer) frame() []byte {
+	frame := c.buf[:vnetHdrLen+c.n]
+	for i := range frame[:vnetHdrLen] {
+		frame[i] = 0
+	}
+	if c.segs == 1 {
+		return frame
+	}
+	pkt := frame[vnetHdrLen:]
+	gsoType := uint8(vnetHdrGSOTCPv6)
+	var src, dst []byte
+	if c.ipHdrLen == 20 {
+		gsoType = vnetHdrGSOTCPv4
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		pkt[10], pkt[11] = 0, 0
+		binary.BigEndian.PutUint16(pkt[10:], ^checksum(pkt[:20], 0))
+		src, dst = pkt[12:16], pkt[16:20]
+	} else {
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+		src, dst = pkt[8:24], pkt[24:40]
+	}
+	// the device sums the segments starting from the pseudo header sum
+	sum := pseudoHeaderSum(src, dst, ipProtoTCP, len(pkt)-c.ipHdrLen)
+	binary.BigEndian.PutUint16(pkt[c.ipHdrLen+16:], checksum(nil, sum))
+
+	frame[0] = vnetHdrFNeedsCsum
+	frame[1] = gsoType
+	binary.LittleEndian.PutUint16(frame[2:], uint16(c.hdrsLen))
+	binary.LittleEndian.PutUint16(frame[4:], uint16(c.mss))
+	binary.LittleEndian.PutUint16(frame[6:], uint16(c.ipHdrLen))
+	binary.LittleEndian.PutUint16(frame[8:], 16)
+	return frame
+}
@@ -0,0 +1,435 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+)
+
+// tcpPacket returns a tcp packet from 10.0.0.2 to 192.168.45.2, or between
+// fd00::2 and fd00::1, with valid checksums
+func tcpPacket(ipv6 bool, flags byte, opts, payload []byte) []byte {
+	ipHdrLen := 20
+	if ipv6 {
+		ipHdrLen = 40
+	}
+	tcpHdrLen := 20 + len(opts)
+	raw := make([]byte, ipHdrLen+tcpHdrLen+len(payload))
+	if ipv6 {
+		raw[0] = 0x60
+		binary.BigEndian.PutUint16(raw[4:], uint16(len(raw)-40))
+		raw[6] = ipProtoTCP
+		raw[7] = 64
+		copy(raw[8:24], net.ParseIP("fd00::2"))
+		copy(raw[24:40], net.ParseIP("fd00::1"))
+	} else {
+		raw[0] = 0x45
+		binary.BigEndian.PutUint16(raw[2:], uint16(len(raw)))
+		binary.BigEndian.PutUint16(raw[4:], 0x1234)
+		binary.BigEndian.PutUint16(raw[6:], 0x4000)
+		raw[8] = 64
+		raw[9] = ipProtoTCP
+		copy(raw[12:16], net.IPv4(10, 0, 0, 2).To4())
+		copy(raw[16:20], net.IPv4(192, 168, 45, 2).To4())
+		binary.BigEndian.PutUint16(raw[10:], ^checksum(raw[:20], 0))
+	}
+	tcp := raw[ipHdrLen:]
+	binary.BigEndian.PutUint16(tcp[0:], 40000)
+	binary.BigEndian.PutUint16(tcp[2:], 443)
+	binary.BigEndian.PutUint32(tcp[4:], 0xfffff000)
+	tcp[12] = byte(tcpHdrLen/4) << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], opts)
+	copy(tcp[tcpHdrLen:], payload)
+	binary.BigEndian.PutUint16(tcp[16:], ^checksum(tcp, tcpPseudoHeaderSum(raw)))
+	return raw
+}
+
+func tcpPseudoHeaderSum(raw []byte) uint64 {
+	if raw[0]>>4 == 6 {
+		return pseudoHeaderSum(raw[8:24], raw[24:40], ipProtoTCP, len(raw)-40)
+	}
+	ihl := int(raw[0]&0xf) * 4
+	return pseudoHeaderSum(raw[12:16], raw[16:20], ipProtoTCP, len(raw)-ihl)
+}
+
+// checkTCPChecksums fails t unless the ip header and tcp checksums of raw
+// add up
+func checkTCPChecksums(t *testing.T, raw []byte) {
+	t.Helper()
+	ipHdrLen := 40
+	if raw[0]>>4 == 4 {
+		ipHdrLen = int(raw[0]&0xf) * 4
+		if sum := checksum(raw[:ipHdrLen], 0); sum != 0xffff {
+			t.Errorf("ip header checksum adds up to %#04x", sum)
+		}
+	}
+	if sum := checksum(raw[ipHdrLen:], tcpPseudoHeaderSum(raw)); sum != 0xffff {
+		t.Errorf("tcp checksum adds up to %#04x", sum)
+	}
+}
+
+func vnetFrame(hdr vnetHdr, pkt []byte) []byte {
+	b := make([]byte, vnetHdrLen, vnetHdrLen+len(pkt))
+	b[0] = hdr.flags
+	b[1] = hdr.gsoType
+	binary.LittleEndian.PutUint16(b[2:], hdr.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], hdr.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], hdr.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], hdr.csumOffset)
+	return append(b, pkt...)
+}
+
+func splitAll(t *testing.T, frame []byte) [][]byte {
+	t.Helper()
+	var segs [][]byte
+	err := splitOffload(frame, func(pkt *RawIPPacket) {
+		segs = append(segs, append([]byte(nil), pkt.Raw...))
+		putPacket(pkt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segs
+}
+
+func testPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestSplitOffloadGSO(t *testing.T) {
+	const ack = 0x10
+	tests := []struct {
+		name    string
+		ipv6    bool
+		ecn     bool
+		flags   byte
+		opts    []byte
+		payload int
+		mss     int
+		want    []int
+	}{
+		{"ipv4 even split", false, false, ack | tcpFlagPSH, nil, 3000, 1000, []int{1000, 1000, 1000}},
+		{"ipv4 remainder", false, false, ack | tcpFlagPSH | tcpFlagFIN | tcpFlagCWR, nil, 2500, 1000, []int{1000, 1000, 500}},
+		{"ipv4 timestamps", false, false, ack, []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2}, 4000, 1448, []int{1448, 1448, 1104}},
+		{"ipv4 one segment", false, false, ack | tcpFlagPSH, nil, 600, 1000, []int{600}},
+		{"ipv6 remainder", true, false, ack | tcpFlagPSH | tcpFlagFIN | tcpFlagCWR, nil, 5000, 1220, []int{1220, 1220, 1220, 1220, 120}},
+		{"ipv6 ecn", true, true, ack | tcpFlagCWR, nil, 2440, 1220, []int{1220, 1220}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := testPayload(tt.payload)
+			super := tcpPacket(tt.ipv6, tt.flags, tt.opts, payload)
+			ipHdrLen, gsoType := 20, uint8(vnetHdrGSOTCPv4)
+			if tt.ipv6 {
+				ipHdrLen, gsoType = 40, vnetHdrGSOTCPv6
+			}
+			if tt.ecn {
+				gsoType |= vnetHdrGSOECN
+			}
+			hdrsLen := ipHdrLen + 20 + len(tt.opts)
+			segs := splitAll(t, vnetFrame(vnetHdr{
+				flags:      vnetHdrFNeedsCsum,
+				gsoType:    gsoType,
+				hdrLen:     uint16(hdrsLen),
+				gsoSize:    uint16(tt.mss),
+				csumStart:  uint16(ipHdrLen),
+				csumOffset: 16,
+			}, super))
+
+			if len(segs) != len(tt.want) {
+				t.Fatalf("got %d segments, want %d", len(segs), len(tt.want))
+			}
+			off := 0
+			for i, seg := range segs {
+				last := i == len(segs)-1
+				if len(seg) != hdrsLen+tt.want[i] {
+					t.Errorf("segment %d is %d bytes, want %d", i, len(seg), hdrsLen+tt.want[i])
+				}
+				if !bytes.Equal(seg[hdrsLen:], payload[off:off+tt.want[i]]) {
+					t.Errorf("segment %d carries the wrong payload", i)
+				}
+				tcp := seg[ipHdrLen:]
+				if seq := binary.BigEndian.Uint32(tcp[4:]); seq != 0xfffff000+uint32(off) {
+					t.Errorf("segment %d seq %#x, want %#x", i, seq, 0xfffff000+uint32(off))
+				}
+				wantFlags := tt.flags
+				if !last {
+					wantFlags &^= tcpFlagFIN | tcpFlagPSH
+				}
+				if i > 0 {
+					wantFlags &^= tcpFlagCWR
+				}
+				if tcp[13] != wantFlags {
+					t.Errorf("segment %d flags %#02x, want %#02x", i, tcp[13], wantFlags)
+				}
+				if tt.ipv6 {
+					if n := binary.BigEndian.Uint16(seg[4:]); int(n) != len(seg)-40 {
+						t.Errorf("segment %d payload length %d, want %d", i, n, len(seg)-40)
+					}
+				} else {
+					if n := binary.BigEndian.Uint16(seg[2:]); int(n) != len(seg) {
+						t.Errorf("segment %d total length %d, want %d", i, n, len(seg))
+					}
+					if id := binary.BigEndian.Uint16(seg[4:]); id != 0x1234+uint16(i) {
+						t.Errorf("segment %d id %#x, want %#x", i, id, 0x1234+i)
+					}
+				}
+				checkTCPChecksums(t, seg)
+				off += tt.want[i]
+			}
+		})
+	}
+}
+
+func TestSplitOffloadNeedsCsum(t *testing.T) {
+	for _, ipv6 := range []bool{false, true} {
+		want := tcpPacket(ipv6, 0x18, nil, testPayload(777))
+		ipHdrLen := 20
+		if ipv6 {
+			ipHdrLen = 40
+		}
+		// the kernel leaves the pseudo header sum in the checksum field
+		pkt := append([]byte(nil), want...)
+		binary.BigEndian.PutUint16(pkt[ipHdrLen+16:], checksum(nil, tcpPseudoHeaderSum(pkt)))
+
+		segs := splitAll(t, vnetFrame(vnetHdr{
+			flags:      vnetHdrFNeedsCsum,
+			csumStart:  uint16(ipHdrLen),
+			csumOffset: 16,
+		}, pkt))
+		if len(segs) != 1 {
+			t.Fatalf("ipv6 %v: got %d packets, want 1", ipv6, len(segs))
+		}
+		if !bytes.Equal(segs[0], want) {
+			t.Errorf("ipv6 %v: checksum %#04x, want %#04x", ipv6,
+				binary.BigEndian.Uint16(segs[0][ipHdrLen+16:]), binary.BigEndian.Uint16(want[ipHdrLen+16:]))
+		}
+	}
+}
+
+func TestSplitOffloadPassesThrough(t *testing.T) {
+	pkt := tcpPacket(false, 0x10, nil, testPayload(100))
+	segs := splitAll(t, vnetFrame(vnetHdr{}, pkt))
+	if len(segs) != 1 || !bytes.Equal(segs[0], pkt) {
+		t.Errorf("packet without offload changed: %x", segs)
+	}
+}
+
+func TestSplitOffloadRejects(t *testing.T) {
+	pkt := tcpPacket(false, 0x10, nil, testPayload(100))
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"short vnet header", pkt[:vnetHdrLen-1]},
+		{"checksum past the end", vnetFrame(vnetHdr{flags: vnetHdrFNeedsCsum, csumStart: uint16(len(pkt) - 1), csumOffset: 16}, pkt)},
+		{"udp segmentation", vnetFrame(vnetHdr{gsoType: 3, gsoSize: 1000, csumStart: 20, csumOffset: 6}, pkt)},
+		{"no segment size", vnetFrame(vnetHdr{gsoType: vnetHdrGSOTCPv4, csumStart: 20, csumOffset: 16}, pkt)},
+		{"tcp header cut off", vnetFrame(vnetHdr{gsoType: vnetHdrGSOTCPv4, gsoSize: 1000, csumStart: 20, csumOffset: 16}, pkt[:30])},
+		{"segment larger than a packet", vnetFrame(vnetHdr{gsoType: vnetHdrGSOTCPv4, gsoSize: tunPacketBuffSize, csumStart: 20, csumOffset: 16}, pkt)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := splitOffload(tt.frame, func(pkt *RawIPPacket) {
+				t.Error("packet emitted")
+				putPacket(pkt)
+			})
+			if err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestCoalescerRoundTrip(t *testing.T) {
+	timestamps := []byte{1, 1, 8, 10, 0, 0, 0, 1, 0, 0, 0, 2}
+	tests := []struct {
+		name    string
+		ipv6    bool
+		opts    []byte
+		payload int
+		mss     int
+	}{
+		{"ipv4", false, nil, 5000, 1400},
+		{"ipv4 timestamps", false, timestamps, 4000, 1448},
+		{"ipv4 even", false, nil, 2800, 1400},
+		{"ipv6", true, timestamps, 6000, 1220},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			super := tcpPacket(tt.ipv6, tcpFlagACK|tcpFlagPSH, tt.opts, testPayload(tt.payload))
+			ipHdrLen, gsoType := 20, uint8(vnetHdrGSOTCPv4)
+			if tt.ipv6 {
+				ipHdrLen, gsoType = 40, vnetHdrGSOTCPv6
+			}
+			hdrsLen := ipHdrLen + 20 + len(tt.opts)
+			segs := splitAll(t, vnetFrame(vnetHdr{
+				gsoType:   gsoType,
+				hdrLen:    uint16(hdrsLen),
+				gsoSize:   uint16(tt.mss),
+				csumStart: uint16(ipHdrLen),
+			}, super))
+
+			co := newCoalescer()
+			if !co.start(segs[0]) {
+				t.Fatal("first segment refused")
+			}
+			for i, seg := range segs[1:] {
+				if !co.add(seg) {
+					t.Fatalf("segment %d refused", i+1)
+				}
+			}
+			frame := co.frame()
+			hdr := decodeVnetHdr(frame)
+			want := vnetHdr{vnetHdrFNeedsCsum, gsoType, uint16(hdrsLen), uint16(tt.mss), uint16(ipHdrLen), 16}
+			if hdr != want {
+				t.Errorf("got header %+v, want %+v", hdr, want)
+			}
+			pkt := frame[vnetHdrLen:]
+			if sum := binary.BigEndian.Uint16(pkt[ipHdrLen+16:]); sum != checksum(nil, tcpPseudoHeaderSum(pkt)) {
+				t.Errorf("tcp checksum field %#04x is not the pseudo header sum", sum)
+			}
+			// split by the kernel the segments come out as they went in
+			again := splitAll(t, append([]byte(nil), frame...))
+			if len(again) != len(segs) {
+				t.Fatalf("got %d segments back, want %d", len(again), len(segs))
+			}
+			for i := range segs {
+				if !bytes.Equal(again[i], segs[i]) {
+					t.Errorf("segment %d changed", i)
+				}
+			}
+		})
+	}
+}
+
+func TestCoalescerSingle(t *testing.T) {
+	pkt := tcpPacket(false, tcpFlagACK, nil, testPayload(100))
+	co := newCoalescer()
+	if !co.start(pkt) {
+		t.Fatal("segment refused")
+	}
+	frame := co.frame()
+	if !bytes.Equal(frame, vnetFrame(vnetHdr{}, pkt)) {
+		t.Errorf("single segment changed: %x", frame)
+	}
+}
+
+// withSeq returns a copy of the tcp packet raw with the sequence number seq
+func withSeq(raw []byte, seq uint32) []byte {
+	raw = append([]byte(nil), raw...)
+	ipHdrLen := 40
+	if raw[0]>>4 == 4 {
+		ipHdrLen = 20
+	}
+	binary.BigEndian.PutUint32(raw[ipHdrLen+4:], seq)
+	return raw
+}
+
+func TestCoalescerRefuses(t *testing.T) {
+	const seq = 0xfffff000
+	first := tcpPacket(false, tcpFlagACK, nil, testPayload(1000))
+	next := withSeq(first, seq+1000)
+	modified := func(raw []byte, at int, b byte) []byte {
+		raw = append([]byte(nil), raw...)
+		raw[at] = b
+		return raw
+	}
+	fragment := append([]byte(nil), first...)
+	binary.BigEndian.PutUint16(fragment[6:], 0x2000)
+
+	starts := []struct {
+		name string
+		raw  []byte
+	}{
+		{"syn", tcpPacket(false, tcpFlagSYN|tcpFlagACK, nil, testPayload(100))},
+		{"psh", tcpPacket(false, tcpFlagACK|tcpFlagPSH, nil, testPayload(100))},
+		{"no payload", tcpPacket(false, tcpFlagACK, nil, nil)},
+		{"fragment", fragment},
+		{"not tcp", modified(first, 9, 17)},
+	}
+	for _, tt := range starts {
+		if newCoalescer().start(tt.raw) {
+			t.Errorf("%s: started", tt.name)
+		}
+	}
+
+	adds := []struct {
+		name string
+		raw  []byte
+	}{
+		{"gap", withSeq(first, seq+1001)},
+		{"other port", modified(next, 21, 1)},
+		{"other ack", modified(next, 28, 1)},
+		{"other address", modified(next, 19, 3)},
+		{"other ttl", modified(next, 8, 1)},
+		{"fin", modified(next, 33, tcpFlagACK|tcpFlagFIN)},
+		{"larger", withSeq(tcpPacket(false, tcpFlagACK, nil, testPayload(1001)), seq+1000)},
+		{"ipv6", withSeq(tcpPacket(true, tcpFlagACK, nil, testPayload(1000)), seq+1000)},
+	}
+	for _, tt := range adds {
+		co := newCoalescer()
+		co.start(first)
+		if co.add(tt.raw) {
+			t.Errorf("%s: added", tt.name)
+		}
+	}
+
+	// nothing goes after a short segment or psh
+	for _, last := range [][]byte{
+		withSeq(tcpPacket(false, tcpFlagACK, nil, testPayload(500)), seq+1000),
+		withSeq(tcpPacket(false, tcpFlagACK|tcpFlagPSH, nil, testPayload(1000)), seq+1000),
+	} {
+		co := newCoalescer()
+		co.start(first)
+		if !co.add(last) {
+			t.Fatal("last segment refused")
+		}
+		if co.add(withSeq(first, seq+uint32(len(last)-40)+1000)) {
+			t.Error("added after the end of the stream")
+		}
+	}
+}
+
+// frameWriter keeps the frames written to it
+type frameWriter struct {
+	frames chan []byte
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	w.frames <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestTunWriteCoalesces(t *testing.T) {
+	super := tcpPacket(false, tcpFlagACK|tcpFlagPSH, nil, testPayload(3000))
+	segs := splitAll(t, vnetFrame(vnetHdr{gsoType: vnetHdrGSOTCPv4, hdrLen: 40, gsoSize: 1000, csumStart: 20}, super))
+	other := tcpPacket(true, tcpFlagACK, nil, testPayload(100))
+
+	// the segments queued together go in one write, the packet after them
+	// in its own
+	packetsOut := make(chan *RawIPPacket, 8)
+	for _, raw := range append(segs, other) {
+		packetsOut <- &RawIPPacket{Raw: raw}
+	}
+	w := &frameWriter{frames: make(chan []byte, 8)}
+	var wg sync.WaitGroup
+	shuttingDown := false
+	go tunWriteRoutine(&tunDevice{name: "tun", vnetHdr: true}, w, packetsOut, &wg, &shuttingDown)
+
+	frame := <-w.frames
+	if hdr := decodeVnetHdr(frame); hdr.gsoType != vnetHdrGSOTCPv4 || len(frame) != vnetHdrLen+len(super) {
+		t.Errorf("first write is %d bytes with gso type %d, want the %d segments in one", len(frame), hdr.gsoType, len(segs))
+	}
+	if frame = <-w.frames; !bytes.Equal(frame, vnetFrame(vnetHdr{}, other)) {
+		t.Errorf("second write is %x, want the other packet", frame)
+	}
+}
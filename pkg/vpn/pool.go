@@ -0,0 +1,106 @@
+package vpn
+
+import (
+	"net"
+	"sync"
+)
+
+// packets are recycled through packetPool instead of allocated per packet.
+// Whoever holds a packet owns it: it is handed on over a channel, or given
+// back with putPacket once it was written out or dropped.
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &RawIPPacket{buf: make([]byte, vnetHdrLen+tunPacketBuffSize)}
+	},
+}
+
+// getPacket returns an empty packet whose Raw can take a whole tun read, with
+// room in front of it for the virtio net header of an offload device
+func getPacket() *RawIPPacket {
+	pkt := packetPool.Get().(*RawIPPacket)
+	pkt.Raw = pkt.buf[vnetHdrLen:]
+	pkt.Dest = pkt.dest[:0]
+	pkt.Protocol = 0
+	return pkt
+}
+
+// getDecodePacket returns a packet to gob decode into, gob fills the empty
+// slices in place as long as they have the capacity
+func getDecodePacket() *RawIPPacket {
+	pkt := getPacket()
+	pkt.Raw = pkt.Raw[:0]
+	return pkt
+}
+
+// putPacket recycles a packet, the ones not made by the pool are left to the gc
+func putPacket(pkt *RawIPPacket) {
+	if pkt.buf == nil {
+		return
+	}
+	pkt.in.packet = nil
+	packetPool.Put(pkt)
+}
+
+// addrKey returns the bytes the routing maps are keyed by, the 4 byte form of
+// ipv4 addresses. Converted to string inside the map index it does not allocate.
+func addrKey(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// withVnetHdr returns the packet behind an empty virtio net header, in place
+// when the packet still sits in its pooled buffer, or else copied to scratch
+func (pkt *RawIPPacket) withVnetHdr(scratch []byte) (frame []byte, inPlace bool) {
+	n := len(pkt.Raw)
+	if pkt.buf != nil && n > 0 && &pkt.buf[vnetHdrLen] == &pkt.Raw[0] {
+		frame = pkt.buf[:vnetHdrLen+n]
+		for i := 0; i < vnetHdrLen; i++ {
+			frame[i] = 0
+		}
+		return frame, true
+	}
+	var hdr [vnetHdrLen]byte
+	frame = append(scratch[:0], hdr[:]...)
+	return append(frame, pkt.Raw...), false
+}
+
+// destOf returns the destination address of an ip packet, in place
+func destOf(raw []byte) net.IP {
+	switch {
+	case len(raw) >= 20 && raw[0]>>4 == 4:
+		return raw[16:20]
+	case len(raw) >= 40 && raw[0]>>4 == 6:
+		return raw[24:40]
+	}
+	return nil
+}
+
+// flowHash hashes the addresses, protocol and ports of an ip packet, the
+// packets of a flow always hash the same
+func flowHash(raw []byte) uint32 {
+	var key []byte
+	var proto byte
+	var l4 int
+	switch {
+	case len(raw) >= 20 && raw[0]>>4 == 4:
+		key, proto, l4 = raw[12:20], raw[9], int(raw[0]&0xf)*4
+	case len(raw) >= 40 && raw[0]>>4 == 6:
+		key, proto, l4 = raw[8:40], raw[6], 40
+	default:
+		return 0
+	}
+	// fnv-1a
+	h := uint32(2166136261)
+	for _, b := range key {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	h = (h ^ uint32(proto)) * 16777619
+	if (proto == 6 || proto == 17) && len(raw) >= l4+4 {
+		for _, b := range raw[l4 : l4+4] {
+			h = (h ^ uint32(b)) * 16777619
+		}
+	}
+	return h
+}
@@ -0,0 +1,167 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"net"
+	"testing"
+)
+
+// benchPacket returns a 1400 byte tcp packet from 10.0.0.2:40000 to
+// 192.168.45.2:443
+func benchPacket() []byte {
+	raw := make([]byte, 1400)
+	raw[0] = 0x45
+	raw[2], raw[3] = byte(len(raw)>>8), byte(len(raw))
+	raw[8] = 64
+	raw[9] = 6
+	copy(raw[12:16], net.IPv4(10, 0, 0, 2).To4())
+	copy(raw[16:20], net.IPv4(192, 168, 45, 2).To4())
+	raw[20], raw[21] = 40000>>8, 40000&0xff
+	raw[22], raw[23] = 443>>8, 443&0xff
+	raw[32] = 5 << 4
+	return raw
+}
+
+// BenchmarkPacket compares taking a packet from the pool to allocating one
+// for every tun read, as the server did before the pool
+func BenchmarkPacket(b *testing.B) {
+	raw := benchPacket()
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(raw)))
+		for i := 0; i < b.N; i++ {
+			pkt := getPacket()
+			n := copy(pkt.Raw, raw)
+			pkt.Raw = pkt.Raw[:n]
+			pkt.Dest = append(pkt.dest[:0], destOf(pkt.Raw)...)
+			putPacket(pkt)
+		}
+	})
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(raw)))
+		for i := 0; i < b.N; i++ {
+			buf := make([]byte, tunPacketBuffSize)
+			n := copy(buf, raw)
+			pkt := &RawIPPacket{Raw: buf[:n], Dest: append(net.IP(nil), destOf(buf[:n])...)}
+			sinkPacket = pkt
+		}
+	})
+}
+
+var sinkPacket *RawIPPacket
+
+// loopReader returns head once and then body over and over, so a gob
+// decoder reads the same value forever after its type
+type loopReader struct {
+	head, body []byte
+	r          bytes.Reader
+	started    bool
+}
+
+func (l *loopReader) Read(p []byte) (int, error) {
+	if !l.started {
+		l.r.Reset(l.head)
+		l.started = true
+	}
+	if l.r.Len() == 0 {
+		l.r.Reset(l.body)
+	}
+	return l.r.Read(p)
+}
+
+func newGobLoop(b *testing.B, pkt *RawIPPacket) io.Reader {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(pkt); err != nil {
+		b.Fatal(err)
+	}
+	head := len(buf.Bytes())
+	if err := enc.Encode(pkt); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	return &loopReader{head: data[:head], body: data[head:]}
+}
+
+// BenchmarkGobDecode compares decoding the packets of a client into pooled
+// packets to decoding each into a new one
+func BenchmarkGobDecode(b *testing.B) {
+	raw := benchPacket()
+	sent := &RawIPPacket{Raw: raw, Dest: destOf(raw), Protocol: 6}
+	b.Run("pool", func(b *testing.B) {
+		dec := gob.NewDecoder(newGobLoop(b, sent))
+		b.ReportAllocs()
+		b.SetBytes(int64(len(raw)))
+		for i := 0; i < b.N; i++ {
+			pkt := getDecodePacket()
+			if err := dec.Decode(pkt); err != nil {
+				b.Fatal(err)
+			}
+			if len(pkt.Raw) != len(raw) {
+				b.Fatalf("decoded %d bytes, want %d", len(pkt.Raw), len(raw))
+			}
+			putPacket(pkt)
+		}
+	})
+	b.Run("alloc", func(b *testing.B) {
+		dec := gob.NewDecoder(newGobLoop(b, sent))
+		b.ReportAllocs()
+		b.SetBytes(int64(len(raw)))
+		for i := 0; i < b.N; i++ {
+			var pkt RawIPPacket
+			if err := dec.Decode(&pkt); err != nil {
+				b.Fatal(err)
+			}
+			sinkPacket = &pkt
+		}
+	})
+}
+
+func BenchmarkFlowHash(b *testing.B) {
+	raw := benchPacket()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(raw)))
+	var h uint32
+	for i := 0; i < b.N; i++ {
+		h += flowHash(raw)
+	}
+	sinkHash = h
+}
+
+var sinkHash uint32
+
+// BenchmarkDispatch queues pooled packets on the shards, drained by as many
+// goroutines giving the packets back
+func BenchmarkDispatch(b *testing.B) {
+	raw := benchPacket()
+	s := &Server{shards: newShards()}
+	done := make(chan struct{})
+	for _, shard := range s.shards {
+		go func(shard chan *ClientInBoundIPPacket) {
+			for in := range shard {
+				putPacket(in.packet)
+			}
+			done <- struct{}{}
+		}(shard)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(raw)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pkt := getPacket()
+		pkt.Raw = pkt.Raw[:copy(pkt.Raw, raw)]
+		// vary the source port so the packets spread over the shards
+		pkt.Raw[21] = byte(i)
+		s.dispatch(pkt, 1)
+	}
+	b.StopTimer()
+	for _, shard := range s.shards {
+		close(shard)
+	}
+	for range s.shards {
+		<-done
+	}
+}
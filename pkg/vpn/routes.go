@@ -0,0 +1,217 @@
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// metrics of the routes, the lowest metric wins among routes of the same
+// prefix and the longest prefix wins over all
+const (
+	hostRouteMetric = 0
+	// DefaultSubnetMetric is the metric of a subnet announced without one and
+	// the lowest a client gets, so a subnet never ties with a host route
+	DefaultSubnetMetric = 10
+	tunRouteMetric      = 100
+)
+
+// Route sends the packets to Prefix to a client, or to the tun device when
+// ClientID is 0
+type Route struct {
+	Prefix   netip.Prefix
+	ClientID int
+	Metric   int
+	// Active is set on the route of its prefix the packets take
+	Active bool
+}
+
+func (r Route) String() string {
+	via := "tun"
+	if r.ClientID != 0 {
+		via = fmt.Sprintf("client %d", r.ClientID)
+	}
+	s := fmt.Sprintf("%s via %s metric %d", r.Prefix, via, r.Metric)
+	if !r.Active {
+		s += " standby"
+	}
+	return s
+}
+
+// RouteAnnouncement follows PacketRoute, a subnet behind the client and how
+// much the client prefers to carry it, a lower metric is preferred
+type RouteAnnouncement struct {
+	Subnet net.IPNet
+	Metric int
+}
+
+// clientPrefix is a prefix announced by a client
+type clientPrefix struct {
+	prefix   netip.Prefix
+	clientID int
+}
+
+// routeTable is a binary trie per address family, a node per prefix bit,
+// holding the routes of the clients and the default routes to the tun
+// device. A published table is never changed: lookups read it without a lock
+// and updates publish a new one.
+type routeTable struct {
+	v4, v6   *routeNode
+	sessions map[int]*clientSession
+}
+
+type routeNode struct {
+	child [2]*routeNode
+	// the routes of the prefix ending here, the active one first
+	routes []Route
+}
+
+func newRouteTable(sessions map[int]*clientSession) *routeTable {
+	t := &routeTable{v4: &routeNode{}, v6: &routeNode{}, sessions: sessions}
+	t.insert(Route{Prefix: netip.PrefixFrom(netip.IPv4Unspecified(), 0), Metric: tunRouteMetric})
+	t.insert(Route{Prefix: netip.PrefixFrom(netip.IPv6Unspecified(), 0), Metric: tunRouteMetric})
+	return t
+}
+
+func (t *routeTable) root(addr netip.Addr) *routeNode {
+	if addr.Is4() {
+		return t.v4
+	}
+	return t.v6
+}
+
+func addrBit(b []byte, i int) int {
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
+
+func (t *routeTable) insert(r Route) {
+	addr := r.Prefix.Addr()
+	b := addr.AsSlice()
+	node := t.root(addr)
+	for i := 0; i < r.Prefix.Bits(); i++ {
+		bit := addrBit(b, i)
+		if node.child[bit] == nil {
+			node.child[bit] = &routeNode{}
+		}
+		node = node.child[bit]
+	}
+	node.routes = append(node.routes, r)
+	sort.SliceStable(node.routes, func(i, j int) bool {
+		a, b := node.routes[i], node.routes[j]
+		if a.Metric != b.Metric {
+			return a.Metric < b.Metric
+		}
+		return a.ClientID < b.ClientID
+	})
+	for i := range node.routes {
+		node.routes[i].Active = i == 0
+	}
+}
+
+// lookup returns the active route of the longest prefix holding addr
+func (t *routeTable) lookup(addr netip.Addr) (Route, bool) {
+	addr = addr.Unmap()
+	var b [16]byte
+	var bits int
+	if addr.Is4() {
+		a4 := addr.As4()
+		copy(b[:], a4[:])
+		bits = 32
+	} else {
+		b = addr.As16()
+		bits = 128
+	}
+	node := t.root(addr)
+	var best *routeNode
+	for i := 0; node != nil; i++ {
+		if len(node.routes) > 0 {
+			best = node
+		}
+		if i == bits {
+			break
+		}
+		node = node.child[addrBit(b[:], i)]
+	}
+	if best == nil {
+		return Route{}, false
+	}
+	return best.routes[0], true
+}
+
+// walk calls fn with the routes in the order of their prefixes
+func (t *routeTable) walk(fn func(Route)) {
+	var visit func(n *routeNode)
+	visit = func(n *routeNode) {
+		if n == nil {
+			return
+		}
+		for _, r := range n.routes {
+			fn(r)
+		}
+		visit(n.child[0])
+		visit(n.child[1])
+	}
+	visit(t.v4)
+	visit(t.v6)
+}
+
+// lookup returns the session of the client routing ip, a nil session when
+// the packet goes to the tun device, and false when there is no route
+func (cm *ClientConnsManager) lookup(ip net.IP) (*clientSession, bool) {
+	routes, _ := cm.routes.Load().(*routeTable)
+	addr, ok := netip.AddrFromSlice(ip)
+	if routes == nil || !ok {
+		return nil, false
+	}
+	r, ok := routes.lookup(addr)
+	if !ok || r.ClientID == 0 {
+		return nil, ok
+	}
+	sess, ok := routes.sessions[r.ClientID]
+	return sess, ok
+}
+
+// publishRoutes replaces the route table after a change of the clients,
+// clientsLock must be held
+func (cm *ClientConnsManager) publishRoutes() {
+	sessions := make(map[int]*clientSession, len(cm.clients))
+	for id, sess := range cm.clients {
+		sessions[id] = sess
+	}
+	routes := newRouteTable(sessions)
+	for key, id := range cm.clientIDByAddress {
+		addr, ok := netip.AddrFromSlice([]byte(key))
+		if _, live := cm.clients[id]; ok && live {
+			routes.insert(Route{Prefix: netip.PrefixFrom(addr, addr.BitLen()), ClientID: id, Metric: hostRouteMetric})
+		}
+	}
+	for p, metric := range cm.clientSubnets {
+		if _, live := cm.clients[p.clientID]; live {
+			routes.insert(Route{Prefix: p.prefix, ClientID: p.clientID, Metric: metric})
+		}
+	}
+	cm.routes.Store(routes)
+}
+
+// Routes returns the routing table of the server, by prefix
+func (s *Server) Routes() []Route {
+	routes, _ := s.cm.routes.Load().(*routeTable)
+	var all []Route
+	if routes != nil {
+		routes.walk(func(r Route) {
+			all = append(all, r)
+		})
+	}
+	return all
+}
+
+// Lookup returns the route the packets to ip take
+func (s *Server) Lookup(ip net.IP) (Route, bool) {
+	routes, _ := s.cm.routes.Load().(*routeTable)
+	addr, ok := netip.AddrFromSlice(ip)
+	if routes == nil || !ok {
+		return Route{}, false
+	}
+	return routes.lookup(addr)
+}
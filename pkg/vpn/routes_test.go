@@ -0,0 +1,109 @@
+package vpn
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestRouteTableLookup(t *testing.T) {
+	table := newRouteTable(nil)
+	for _, r := range []Route{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ClientID: 2, Metric: DefaultSubnetMetric},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), ClientID: 1, Metric: DefaultSubnetMetric},
+		{Prefix: netip.MustParsePrefix("10.1.9.9/32"), ClientID: 3, Metric: hostRouteMetric},
+		// the lowest metric wins, then the lowest client id
+		{Prefix: netip.MustParsePrefix("172.16.0.0/12"), ClientID: 4, Metric: 20},
+		{Prefix: netip.MustParsePrefix("172.16.0.0/12"), ClientID: 5, Metric: 10},
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ClientID: 7, Metric: 10},
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ClientID: 6, Metric: 10},
+		{Prefix: netip.MustParsePrefix("fd00:1::/32"), ClientID: 1, Metric: DefaultSubnetMetric},
+		{Prefix: netip.MustParsePrefix("fd00:1:2::/48"), ClientID: 2, Metric: DefaultSubnetMetric},
+	} {
+		table.insert(r)
+	}
+
+	tests := []struct {
+		addr   string
+		prefix string
+		client int
+	}{
+		{"10.1.2.3", "10.1.0.0/16", 1},
+		{"10.1.0.0", "10.1.0.0/16", 1},
+		{"10.1.255.255", "10.1.0.0/16", 1},
+		{"10.2.0.1", "10.0.0.0/8", 2},
+		{"10.1.9.9", "10.1.9.9/32", 3},
+		{"10.1.9.8", "10.1.0.0/16", 1},
+		{"172.20.1.1", "172.16.0.0/12", 5},
+		{"192.0.2.77", "192.0.2.0/24", 6},
+		{"8.8.8.8", "0.0.0.0/0", 0},
+		{"11.0.0.1", "0.0.0.0/0", 0},
+		// ipv4 in ipv6 form takes the ipv4 routes
+		{"::ffff:10.1.2.3", "10.1.0.0/16", 1},
+		{"::ffff:8.8.8.8", "0.0.0.0/0", 0},
+		{"fd00:1:2::5", "fd00:1:2::/48", 2},
+		{"fd00:1:3::1", "fd00:1::/32", 1},
+		{"2001:db8::1", "::/0", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			r, ok := table.lookup(netip.MustParseAddr(tt.addr))
+			if !ok {
+				t.Fatal("no route")
+			}
+			if r.Prefix.String() != tt.prefix || r.ClientID != tt.client || !r.Active {
+				t.Errorf("got %s, want %s via client %d", r, tt.prefix, tt.client)
+			}
+		})
+	}
+}
+
+func TestRoutesFailover(t *testing.T) {
+	s := newTestServer()
+	first, second := s.newTestConn(), s.newTestConn()
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/16")
+	if err := s.setSubnetForClient(second.id, subnet, 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setSubnetForClient(first.id, subnet, DefaultSubnetMetric); err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := netip.MustParsePrefix("10.1.0.0/16")
+	want := []Route{
+		{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Metric: tunRouteMetric, Active: true},
+		{Prefix: prefix, ClientID: first.id, Metric: DefaultSubnetMetric, Active: true},
+		{Prefix: prefix, ClientID: second.id, Metric: 20},
+		{Prefix: netip.MustParsePrefix("::/0"), Metric: tunRouteMetric, Active: true},
+	}
+	if got := s.Routes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// the gateway standing by takes over when the active one goes away
+	s.removeClientConn(first)
+	r, ok := s.Lookup(net.IPv4(10, 1, 2, 3))
+	if !ok || r.ClientID != second.id || !r.Active {
+		t.Errorf("after failover got %s, want client %d", r, second.id)
+	}
+	s.removeClientConn(second)
+	if r, _ = s.Lookup(net.IPv4(10, 1, 2, 3)); r.ClientID != 0 {
+		t.Errorf("with no gateway left got %s, want the tun", r)
+	}
+}
+
+func TestRouteString(t *testing.T) {
+	tests := []struct {
+		r    Route
+		want string
+	}{
+		{Route{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Metric: tunRouteMetric, Active: true}, "0.0.0.0/0 via tun metric 100"},
+		{Route{Prefix: netip.MustParsePrefix("10.1.0.0/16"), ClientID: 2, Metric: 20}, "10.1.0.0/16 via client 2 metric 20 standby"},
+	}
+	for _, tt := range tests {
+		if got := tt.r.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
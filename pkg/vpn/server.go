@@ -2,8 +2,12 @@ package vpn
 
 import (
 	"encoding/gob"
+	"fmt"
+	"io"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	zapLog "github.com/Jamlee/fastvpn/pkg/log"
@@ -17,27 +21,66 @@ const (
 	PacketInMaxBuff  = 150
 	PacketOutMaxBuff = 150
 
-	// tun device config
+	// tun device config, tunMtuSize is the outer path mtu assumed when the
+	// routes tell none
 	tunMtuSize        = 1500
 	tunPacketBuffSize = 4096
 	tunTxQueLen       = 300
 
+	// per dispatch shard
 	servMaxInboundPacketQueue = 400
 	servPerClientPacketQueue  = 200
 
+	// auto shutdown checks and the warning sent to clients ahead of it
+	autoShutdownCheckInterval = 10 * time.Second
+	autoShutdownGrace         = time.Minute
+
 	// for client to sent localAddr
 	PacketUnknown PacketType = iota
 	PacketIP
 	PacketLocalAddr
+	// server to client, followed by a ShutdownWarning
+	PacketShutdownWarning
+	// both ways, followed by a Hello
+	PacketHello
+	// a RawIPPacket whose Raw is compressed as negotiated in the Hello
+	PacketIPCompressed
+	// client to server, followed by a net.IPNet behind the client, read as a
+	// PacketRoute with DefaultSubnetMetric
+	PacketSubnet
+	// client to server, followed by a RouteAnnouncement
+	PacketRoute
 )
 
 type PacketType byte
 
+// ShutdownWarning tells the clients the server goes away
+type ShutdownWarning struct {
+	Reason string
+	In     time.Duration
+}
+
+// Hello is sent by the client before any packet, offering the compressions
+// it supports, the server answers with the one it picked or none. The server
+// answers the first conn of a client with the Session token, the other conns
+// of the client present it in their Hello to be bonded into one.
+type Hello struct {
+	Compression []string
+	Session     string
+}
+
 // packet represention
 type RawIPPacket struct {
 	Raw      []byte
 	Dest     net.IP
 	Protocol waterutil.IPProtocol
+
+	// backing arrays of pooled packets, and the wrapper it is dispatched
+	// in, so neither allocates per packet
+	buf  []byte
+	dest [net.IPv6len]byte
+	in   ClientInBoundIPPacket
+	flow uint32
 }
 
 type RouterManager struct {
@@ -55,35 +98,71 @@ type routeEntries struct {
 	dev  string
 }
 
-// packet read from internet in vpn server outside
+// packet on its way through a dispatch shard, clientID is 0 for the packets
+// read from the tun device
 type ClientInBoundIPPacket struct {
 	packet   *RawIPPacket
 	clientID int
 }
 
+// ClientConnsManager tracks the clients by id, each with one or more conns
+// bonded into its session
 type ClientConnsManager struct {
 	clientIDByAddress map[string]int
-	clients           map[int]*ServerConn
+	clients           map[int]*clientSession
 	clientsLock       sync.Mutex
+	// the subnets the clients route, with their metrics
+	clientSubnets map[clientPrefix]int
+
+	// routeTable published on every change, read by the shards without the lock
+	routes atomic.Value
 }
 
 type Server struct {
+	// unix nano of the last packet from or to a client and the bytes of the
+	// packets from and to the clients, first for atomic alignment
+	lastActivity int64
+	bytesIn      uint64
+	bytesOut     uint64
+	// bytes compression kept off the wire from and to the clients
+	savedIn  uint64
+	savedOut uint64
+	// bytes of the packets from a client routed to another client
+	bytesBetween uint64
+
 	listener        net.Listener
+	transport       Transport
 	addrWithNetmask string
+	addr            net.IP
 
-	// packet read from device like eth0
-	clientInBoundIPPackets chan *ClientInBoundIPPacket
+	// mtu of the tun device, the packets to it are no larger
+	mtu int
 
-	// tun device inbound and outbound
-	tunInboundIPPackets  chan *RawIPPacket
-	tunOutboundIPPackets chan *RawIPPacket
-	tunInterface         *water.Interface
+	// packets from the clients and the tun device, queued by flow
+	shards []chan *ClientInBoundIPPacket
+
+	// tun device outbound, a writer per queue
+	tunOutboundIPPackets []chan *RawIPPacket
+	tun                  *tunDevice
 
 	rm             *RouterManager
 	cm             *ClientConnsManager
 	lastClientID   int
 	isShuttingDown bool
 
+	// stop the server after idleTimeout without traffic or after maxLifetime
+	startTime   time.Time
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	onShutdown  func()
+
+	// offer compression to the clients
+	compression bool
+
+	// the counters are kept in statsFile, when set
+	statsStart time.Time
+	statsFile  string
+
 	wg sync.WaitGroup
 }
 
@@ -91,10 +170,15 @@ type ServerConn struct {
 	id               int
 	conn             net.Conn
 	outBoundIPPacket chan *RawIPPacket
+	outBoundWarning  chan *ShutdownWarning
+	outBoundHello    chan *Hello
 	canSendIP        bool
 	remoteAddrs      []net.IP
 	connectionOk     bool
 	server           *Server
+
+	// the packets to the client are no larger
+	mtu int
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////
@@ -103,42 +187,83 @@ type ServerConn struct {
 //
 /////////////////////////////////////////////////////////////////////////////////////////
 
-// network is a format string like`192.168.33.1`
-func NewServer(listenHost, listenPort, addrWithNetmask, iName string) (*Server, error) {
-	config := water.Config{
-		DeviceType: water.TUN,
+// network is a format string like`192.168.33.1`, the clients connect over
+// transport, plain tcp when nil
+func NewServer(listenHost, listenPort, addrWithNetmask, iName string, tunOpts TunOptions, transport Transport) (*Server, error) {
+	if transport == nil {
+		transport = tcpTransport{}
+	}
+	tun, err := openTun(iName, tunOpts)
+	if err != nil {
+		log.Fatalf("can not created  vpn iface %s: %s", iName, err)
 	}
-	config.Name = iName
-	tunInterface, err := water.New(config)
+	log.Infof("created  vpn iface %s, %d queues, offload %t", tun.Name(), len(tun.queues), tun.vnetHdr)
+	addr, _, err := net.ParseCIDR(addrWithNetmask)
 	if err != nil {
-		log.Fatalf("can not created  vpn iface %s", iName)
+		return nil, err
+	}
+	mtu := tunOpts.MTU
+	if mtu == 0 {
+		// the clients come over the default route of the family listened on
+		outerIPv6 := listensOnIPv6(listenHost)
+		dst := internetIPv4
+		if outerIPv6 {
+			dst = internetIPv6
+		}
+		mtu = EffectiveMTU(outerPathMTU(dst)-transport.Overhead(), outerIPv6, addr.To4() == nil)
+	}
+	tunOutbound := make([]chan *RawIPPacket, len(tun.queues))
+	for i := range tunOutbound {
+		tunOutbound[i] = make(chan *RawIPPacket, PacketOutMaxBuff)
 	}
-	log.Infof("created  vpn iface %s", tunInterface.Name())
 	s := &Server{
-		tunInterface:           tunInterface,
-		addrWithNetmask:        addrWithNetmask,
-		clientInBoundIPPackets: make(chan *ClientInBoundIPPacket, servMaxInboundPacketQueue),
-		tunInboundIPPackets:    make(chan *RawIPPacket, PacketInMaxBuff),
-		tunOutboundIPPackets:   make(chan *RawIPPacket, PacketOutMaxBuff),
+		tun:                  tun,
+		transport:            transport,
+		addrWithNetmask:      addrWithNetmask,
+		addr:                 addr,
+		mtu:                  mtu,
+		shards:               newShards(),
+		tunOutboundIPPackets: tunOutbound,
 		cm: &ClientConnsManager{
 			clientIDByAddress: map[string]int{},
-			clients:           map[int]*ServerConn{},
+			clientSubnets:     map[clientPrefix]int{},
+			clients:           map[int]*clientSession{},
 		},
 		lastClientID:   1,
 		isShuttingDown: false,
+		startTime:      time.Now(),
+		statsStart:     time.Now(),
 	}
+	s.cm.publishRoutes()
+	s.touch()
 	return s, s.Init(listenHost + ":" + listenPort)
 }
 
+// SetAutoShutdown makes the server call shutdown once no packet went through
+// for idle or it ran for lifetime, zero disables either limit. The clients are
+// warned autoShutdownGrace ahead.
+func (s *Server) SetAutoShutdown(idle, lifetime time.Duration, shutdown func()) {
+	s.idleTimeout = idle
+	s.maxLifetime = lifetime
+	s.onShutdown = shutdown
+}
+
+// SetCompression makes the server agree to compress the packets of the
+// clients offering a compression it supports
+func (s *Server) SetCompression(enabled bool) {
+	s.compression = enabled
+}
+
 func (s *Server) Init(addr string) (err error) {
-	s.listener, err = net.Listen("tcp", addr)
+	s.listener, err = s.transport.Listen(addr)
 	log.Infof("server serve on: %s ", addr)
 	if err != nil {
 		return err
 	}
-	if err = SetDevIP(s.tunInterface.Name(), s.addrWithNetmask, false); err != nil {
+	if err = SetupTun(s.tun.Name(), s.addrWithNetmask, s.mtu, tunTxQueLen); err != nil {
 		return err
 	}
+	log.Infof("%s up, mtu %d, txqueuelen %d", s.tun.Name(), s.mtu, tunTxQueLen)
 	return nil
 }
 
@@ -147,26 +272,105 @@ func (s *Server) Run() {
 	defer s.wg.Done()
 	s.wg.Add(1)
 	go s.acceptRoutine()
-	go s.dispatchRoutine()
-	go tunWriteRoutine(s.tunInterface, s.tunOutboundIPPackets, &s.wg, &s.isShuttingDown)
-	go tunReadRoutine(s.tunInterface, s.tunInboundIPPackets, &s.wg, &s.isShuttingDown)
+	for _, shard := range s.shards {
+		go s.dispatchRoutine(shard)
+	}
+	for i, q := range s.tun.queues {
+		go tunWriteRoutine(s.tun, q, s.tunOutboundIPPackets[i], &s.wg, &s.isShuttingDown)
+		go tunReadRoutine(s.tun, q, s.dispatch, &s.wg, &s.isShuttingDown)
+	}
+	if s.onShutdown != nil && (s.idleTimeout > 0 || s.maxLifetime > 0) {
+		go s.autoShutdownRoutine()
+	}
+	if s.statsFile != "" {
+		go s.statsRoutine()
+	}
 	s.wg.Wait()
 }
 
+// touch records traffic for the idle timeout
+func (s *Server) touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+func (s *Server) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActivity)))
+}
+
+// shutdownReason says why the server should stop, or "" if it should not
+func (s *Server) shutdownReason() (reason string, idle bool) {
+	if s.maxLifetime > 0 && time.Since(s.startTime) >= s.maxLifetime-autoShutdownGrace {
+		return "max lifetime " + s.maxLifetime.String() + " reached", false
+	}
+	if s.idleTimeout > 0 && s.idleFor() >= s.idleTimeout-autoShutdownGrace {
+		return "idle for " + s.idleTimeout.String(), true
+	}
+	return "", false
+}
+
+func (s *Server) autoShutdownRoutine() {
+	ticker := time.NewTicker(autoShutdownCheckInterval)
+	defer ticker.Stop()
+
+	for !s.isShuttingDown {
+		<-ticker.C
+		reason, idle := s.shutdownReason()
+		if reason == "" {
+			continue
+		}
+		log.Infof("shutting down in %s: %s", autoShutdownGrace, reason)
+		s.broadcastWarning(&ShutdownWarning{Reason: reason, In: autoShutdownGrace})
+		time.Sleep(autoShutdownGrace)
+
+		// traffic during the grace period keeps an idle server alive
+		if idle && s.idleFor() < s.idleTimeout {
+			log.Infof("traffic resumed, shutdown cancelled")
+			continue
+		}
+		log.Infof("shutting down: %s", reason)
+		if s.statsFile != "" {
+			if err := s.writeStats(); err != nil {
+				log.Infof("write stats: %s", err)
+			}
+		}
+		s.onShutdown()
+		return
+	}
+}
+
+// WarnShutdown tells every client the server goes away in the given time,
+// like when the vm hosting it is reclaimed
+func (s *Server) WarnShutdown(reason string, in time.Duration) {
+	log.Infof("shutting down in %s: %s", in, reason)
+	s.broadcastWarning(&ShutdownWarning{Reason: reason, In: in})
+}
+
+func (s *Server) broadcastWarning(w *ShutdownWarning) {
+	s.cm.clientsLock.Lock()
+	defer s.cm.clientsLock.Unlock()
+	for _, sess := range s.cm.clients {
+		for _, c := range sess.snapshot().conns {
+			select {
+			case c.outBoundWarning <- w:
+			default:
+			}
+		}
+	}
+}
+
 func (s *Server) acceptRoutine() {
-	var tcpListener *net.TCPListener
-	tcpListener, _ = s.listener.(*net.TCPListener)
+	listener, _ := s.listener.(deadliner)
 	s.wg.Add(1)
 	defer s.wg.Done()
 
 	for !s.isShuttingDown {
-		if tcpListener != nil {
-			tcpListener.SetDeadline(time.Now().Add(time.Millisecond * 300))
+		if listener != nil {
+			listener.SetDeadline(time.Now().Add(time.Millisecond * 300))
 		}
 		conn, err := s.listener.Accept()
 		if err != nil {
 			if !s.isShuttingDown {
-				if !err.(net.Error).Timeout() {
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
 					log.Infof("Listener err: %s", err.Error())
 				}
 			}
@@ -176,45 +380,16 @@ func (s *Server) acceptRoutine() {
 	}
 }
 
-func (s *Server) dispatchRoutine() {
-	for !s.isShuttingDown {
-		select {
-		case pkt := <-s.clientInBoundIPPackets:
-			s.routeToClient(pkt.packet)
-		case pkt := <-s.tunInboundIPPackets:
-			s.routeToVpnNetWork(pkt)
-		}
-	}
-}
-
-func (s *Server) routeToClient(pkt *RawIPPacket) {
-	if pkt.Dest.IsMulticast() {
-		return
-	}
-	s.cm.clientsLock.Lock()
-	destClientID, canRouteDirectly := s.cm.clientIDByAddress[pkt.Dest.String()]
-	if canRouteDirectly {
-		destClient, clientExists := s.cm.clients[destClientID]
-		if clientExists {
-			destClient.writeToClient(pkt)
-		} else {
-			log.Infof("WARN: Attempted to route packet to clientID %d, which does not exist. Dropping.", destClientID)
-		}
-	}
-	s.cm.clientsLock.Unlock()
-}
-
 func (s *Server) routeToVpnNetWork(pkt *RawIPPacket) {
-	if pkt.Dest.IsMulticast() {
-		return
-	}
-	s.tunOutboundIPPackets <- pkt
+	// a flow always goes through the same queue, so it stays in order
+	s.tunOutboundIPPackets[pkt.flow%uint32(len(s.tunOutboundIPPackets))] <- pkt
 }
 
 func (s *Server) handleClient(conn net.Conn) {
 	c := ServerConn{
 		conn:      conn,
 		canSendIP: true,
+		mtu:       connMTU(conn, s.transport.Overhead(), s.mtu, s.addr.To4() == nil),
 	}
 	s.enrollClientConn(&c)
 	c.initClient(s)
@@ -225,20 +400,75 @@ func (s *Server) enrollClientConn(c *ServerConn) {
 	defer s.cm.clientsLock.Unlock()
 	c.id = s.lastClientID
 	s.lastClientID++
-	s.cm.clients[c.id] = c
+	sess := newClientSession(c.id)
+	sess.add(c)
+	s.cm.clients[c.id] = sess
 }
 
 func (s *Server) setAddrForClient(id int, addr net.IP) {
 	s.cm.clientsLock.Lock()
 	defer s.cm.clientsLock.Unlock()
 
-	s.cm.clientIDByAddress[addr.String()] = id
+	s.cm.clientIDByAddress[string(addrKey(addr))] = id
+	s.cm.publishRoutes()
 }
 
-func (s *Server) removeClientConn(id int) {
+// setSubnetForClient routes subnet to the client. When several clients route
+// it the one with the lowest metric carries it, the others stand by. The
+// default route, subnets overlapping the vpn network and subnets holding the
+// address of another client are refused, they would take the packets of the
+// other clients.
+func (s *Server) setSubnetForClient(id int, subnet *net.IPNet, metric int) error {
+	ip := subnet.IP.Mask(subnet.Mask)
+	ones, bits := subnet.Mask.Size()
+	if ip == nil || bits == 0 {
+		return fmt.Errorf("bad subnet %s", subnet)
+	}
+	if ones == 0 {
+		return fmt.Errorf("refusing default route %s", subnet)
+	}
+	subnet = &net.IPNet{IP: ip, Mask: subnet.Mask}
+	if _, vpnNet, err := net.ParseCIDR(s.addrWithNetmask); err == nil && (vpnNet.Contains(subnet.IP) || subnet.Contains(vpnNet.IP)) {
+		return fmt.Errorf("%s overlaps the vpn network %s", subnet, vpnNet)
+	}
+	addr, _ := netip.AddrFromSlice(addrKey(subnet.IP))
+	prefix := netip.PrefixFrom(addr, ones)
+	if !prefix.IsValid() {
+		return fmt.Errorf("bad subnet %s", subnet)
+	}
+	if metric < 0 {
+		return fmt.Errorf("bad metric %d for %s", metric, prefix)
+	}
+
+	s.cm.clientsLock.Lock()
+	defer s.cm.clientsLock.Unlock()
+	for key, other := range s.cm.clientIDByAddress {
+		if addr, ok := netip.AddrFromSlice([]byte(key)); ok && other != id && prefix.Contains(addr) {
+			return fmt.Errorf("%s holds the address %s of client %d", prefix, addr, other)
+		}
+	}
+	s.cm.clientSubnets[clientPrefix{prefix: prefix, clientID: id}] = metric
+	s.cm.publishRoutes()
+	return nil
+}
+
+// removeClientConn drops conn c from its session, the client goes away with
+// its last conn
+func (s *Server) removeClientConn(c *ServerConn) {
 	s.cm.clientsLock.Lock()
 	defer s.cm.clientsLock.Unlock()
 
+	id := c.id
+	sess := s.cm.clients[id]
+	if sess == nil || !sess.remove(c) {
+		return
+	}
+	if len(sess.snapshot().conns) > 0 {
+		log.Infof("client %d lost a conn, %d left", id, len(sess.snapshot().conns))
+		s.cm.publishRoutes()
+		return
+	}
+
 	//delete from the clientIDByAddress map if it exists
 	var toDeleteAddrs []string
 	for dest, itemID := range s.cm.clientIDByAddress {
@@ -249,7 +479,13 @@ func (s *Server) removeClientConn(id int) {
 	for _, addr := range toDeleteAddrs {
 		delete(s.cm.clientIDByAddress, addr)
 	}
+	for p := range s.cm.clientSubnets {
+		if p.clientID == id {
+			delete(s.cm.clientSubnets, p)
+		}
+	}
 	delete(s.cm.clients, id)
+	s.cm.publishRoutes()
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////
@@ -260,20 +496,62 @@ func (s *Server) removeClientConn(id int) {
 
 func (c *ServerConn) initClient(s *Server) {
 	c.outBoundIPPacket = make(chan *RawIPPacket, servPerClientPacketQueue)
+	c.outBoundWarning = make(chan *ShutdownWarning, 1)
+	c.outBoundHello = make(chan *Hello, 1)
 	c.connectionOk = true
 	c.server = s
-	log.Infof("New connection from %s, conn id: %d", c.conn.RemoteAddr().String(), c.id)
-	go c.readRoutine(&s.isShuttingDown, s.clientInBoundIPPackets)
+	log.Infof("New connection from %s, conn id: %d, mtu %d", c.conn.RemoteAddr().String(), c.id, c.mtu)
+	go c.readRoutine(&s.isShuttingDown)
 	go c.writeRoutine(&s.isShuttingDown)
 }
 
 func (c *ServerConn) writeRoutine(isShuttingDown *bool) {
 	encoder := gob.NewEncoder(c.conn)
+	// set once the hello agreeing on compression went out
+	var comp *compressor
+	var compressed RawIPPacket
 	for !*isShuttingDown && c.connectionOk {
 		select {
 		case pkt := <-c.outBoundIPPacket:
-			encoder.Encode(PacketIP)
-			err := encoder.Encode(pkt)
+			var err error
+			n := len(pkt.Raw)
+			saved := 0
+			var z []byte
+			if comp != nil {
+				z = comp.compress(pkt.Raw)
+			}
+			if z != nil {
+				compressed.Raw, compressed.Dest, compressed.Protocol = z, pkt.Dest, pkt.Protocol
+				encoder.Encode(PacketIPCompressed)
+				err = encoder.Encode(&compressed)
+				saved = n - len(z)
+			} else {
+				encoder.Encode(PacketIP)
+				err = encoder.Encode(pkt)
+			}
+			putPacket(pkt)
+			if err != nil {
+				log.Infof("Write error for %s: %s", c.conn.RemoteAddr().String(), err.Error())
+				c.hadError(false)
+				return
+			}
+			atomic.AddUint64(&c.server.bytesOut, uint64(n))
+			atomic.AddUint64(&c.server.savedOut, uint64(saved))
+			c.server.touch()
+		case h := <-c.outBoundHello:
+			encoder.Encode(PacketHello)
+			err := encoder.Encode(h)
+			if err != nil {
+				log.Infof("Write error for %s: %s", c.conn.RemoteAddr().String(), err.Error())
+				c.hadError(false)
+				return
+			}
+			if len(h.Compression) > 0 {
+				comp = newCompressor()
+			}
+		case w := <-c.outBoundWarning:
+			encoder.Encode(PacketShutdownWarning)
+			err := encoder.Encode(w)
 			if err != nil {
 				log.Infof("Write error for %s: %s", c.conn.RemoteAddr().String(), err.Error())
 				c.hadError(false)
@@ -283,8 +561,10 @@ func (c *ServerConn) writeRoutine(isShuttingDown *bool) {
 	}
 }
 
-func (c *ServerConn) readRoutine(isShuttingDown *bool, ipPacketSink chan *ClientInBoundIPPacket) {
+func (c *ServerConn) readRoutine(isShuttingDown *bool) {
 	decoder := gob.NewDecoder(c.conn)
+	// set once the client said hello with a compression the server agreed to
+	var dec *decompressor
 
 	for !*isShuttingDown && c.connectionOk {
 		var PacketType PacketType
@@ -309,33 +589,87 @@ func (c *ServerConn) readRoutine(isShuttingDown *bool, ipPacketSink chan *Client
 			c.remoteAddrs = append(c.remoteAddrs, localAddr)
 			c.server.setAddrForClient(c.id, localAddr)
 
-		case PacketIP:
-			var ipPkt RawIPPacket
-			err := decoder.Decode(&ipPkt)
+		case PacketSubnet, PacketRoute:
+			route := RouteAnnouncement{Metric: DefaultSubnetMetric}
+			var err error
+			if PacketType == PacketSubnet {
+				err = decoder.Decode(&route.Subnet)
+			} else {
+				err = decoder.Decode(&route)
+			}
+			if err != nil {
+				log.Infof("Could not decode RouteAnnouncement: %s", err.Error())
+				c.hadError(false)
+				return
+			}
+			c.announceRoute(&route.Subnet, route.Metric)
+
+		case PacketHello:
+			var hello Hello
+			if err := decoder.Decode(&hello); err != nil {
+				log.Infof("Could not decode Hello: %s", err.Error())
+				c.hadError(false)
+				return
+			}
+			reply := &Hello{Session: c.server.joinSession(c, hello.Session)}
+			if name := negotiateCompression(hello.Compression, c.server.compression); name != "" {
+				reply.Compression = []string{name}
+				dec = newDecompressor()
+			}
+			log.Infof("Hello from client %d, compression %v", c.id, reply.Compression)
+			select {
+			case c.outBoundHello <- reply:
+			default:
+			}
+
+		case PacketIP, PacketIPCompressed:
+			ipPkt := getDecodePacket()
+			err := decoder.Decode(ipPkt)
 			if err != nil {
+				putPacket(ipPkt)
 				log.Infof("Could not decode IPPacket: %s", err.Error())
 				c.hadError(false)
 				return
 			}
+			if PacketType == PacketIPCompressed {
+				if dec == nil {
+					putPacket(ipPkt)
+					log.Infof("Compressed packet from conn %d without compression agreed", c.id)
+					c.hadError(false)
+					return
+				}
+				z := ipPkt
+				zLen := len(z.Raw)
+				ipPkt, err = dec.decompress(z)
+				putPacket(z)
+				if err != nil {
+					log.Infof("Could not decompress IPPacket: %s", err.Error())
+					c.hadError(false)
+					return
+				}
+				if saved := len(ipPkt.Raw) - zLen; saved > 0 {
+					atomic.AddUint64(&c.server.savedIn, uint64(saved))
+				}
+			}
 			//log.Infof("Packet Received from %d: dest %s, len %d", c.id, ipPkt.Dest.String(), len(ipPkt.Raw))
-			ipPacketSink <- &ClientInBoundIPPacket{packet: &ipPkt, clientID: c.id}
+			atomic.AddUint64(&c.server.bytesIn, uint64(len(ipPkt.Raw)))
+			c.server.touch()
+			c.server.dispatch(ipPkt, c.id)
 		}
 	}
 }
 
-func (c *ServerConn) writeToClient(pkt *RawIPPacket) {
-	select {
-	case c.outBoundIPPacket <- pkt:
-	default:
-		log.Infof("Warning: Dropping packets for %s as outbound msg queue is full.", c.remoteAddressStr())
+// announceRoute routes a subnet behind the client, a metric below
+// DefaultSubnetMetric is raised to it
+func (c *ServerConn) announceRoute(subnet *net.IPNet, metric int) {
+	if metric < DefaultSubnetMetric {
+		metric = DefaultSubnetMetric
 	}
-}
-
-func (c *ServerConn) remoteAddressStr() string {
-	if len(c.remoteAddrs) == 0 {
-		return ""
+	if err := c.server.setSubnetForClient(c.id, subnet, metric); err != nil {
+		log.Infof("Not routing subnet of client %d: %s", c.id, err)
+		return
 	}
-	return c.remoteAddrs[0].String()
+	log.Infof("Routing %s to client %d, metric %d", subnet.String(), c.id, metric)
 }
 
 func (c *ServerConn) hadError(errInRead bool) {
@@ -343,7 +677,7 @@ func (c *ServerConn) hadError(errInRead bool) {
 		c.conn.Close()
 	}
 	c.connectionOk = false
-	c.server.removeClientConn(c.id)
+	c.server.removeClientConn(c)
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////
@@ -352,43 +686,112 @@ func (c *ServerConn) hadError(errInRead bool) {
 //
 /////////////////////////////////////////////////////////////////////////////////////////
 
-func tunReadRoutine(dev *water.Interface, packetsIn chan *RawIPPacket, wg *sync.WaitGroup, isShuttingDown *bool) {
+func tunReadRoutine(dev *tunDevice, queue io.Reader, dispatch func(*RawIPPacket, int), wg *sync.WaitGroup, isShuttingDown *bool) {
 	wg.Add(1)
 	defer wg.Done()
 
+	emit := func(p *RawIPPacket) {
+		// the destination is read in place instead of copied out
+		p.Dest = destOf(p.Raw)
+		if p.Dest == nil {
+			putPacket(p)
+			return
+		}
+		p.Protocol = waterutil.IPv4Protocol(p.Raw)
+		dispatch(p, 0)
+		//log.Infof("Packet Received: dest %s, len %d", p.Dest.String(), len(p.Raw))
+	}
+	// an offload device hands over up to 64k at once, split afterwards
+	var offloadBuf []byte
+	if dev.vnetHdr {
+		offloadBuf = make([]byte, tunOffloadBuffSize)
+	}
+
 	for !*isShuttingDown {
-		packet := make([]byte, tunPacketBuffSize)
-		n, err := dev.Read(packet)
+		if offloadBuf != nil {
+			n, err := queue.Read(offloadBuf)
+			if err != nil {
+				if !*isShuttingDown {
+					log.Infof("%s read err: %s", dev.Name(), err.Error())
+				}
+				return
+			}
+			if err = splitOffload(offloadBuf[:n], emit); err != nil {
+				log.Infof("%s: dropping offloaded packet: %s", dev.Name(), err)
+			}
+			continue
+		}
+
+		p := getPacket()
+		n, err := queue.Read(p.Raw)
 		if err != nil {
+			putPacket(p)
 			if !*isShuttingDown {
 				log.Infof("%s read err: %s", dev.Name(), err.Error())
 			}
-			close(packetsIn)
 			return
 		}
-		p := &RawIPPacket{
-			Raw:      packet[:n],
-			Dest:     waterutil.IPv4Destination(packet[:n]),
-			Protocol: waterutil.IPv4Protocol(packet[:n]),
+		p.Raw = p.Raw[:n]
+		emit(p)
+	}
+}
+
+// coalesceQueued adds the packets already queued to co without waiting for
+// more, it returns the first one that did not fit or nil
+func coalesceQueued(co *coalescer, packetsOut chan *RawIPPacket) *RawIPPacket {
+	for {
+		select {
+		case pkt := <-packetsOut:
+			if !co.add(pkt.Raw) {
+				return pkt
+			}
+			putPacket(pkt)
+		default:
+			return nil
 		}
-		packetsIn <- p
-		//log.Infof("Packet Received: dest %s, len %d", p.Dest.String(), len(p.Raw))
 	}
 }
 
-func tunWriteRoutine(dev *water.Interface, packetsOut chan *RawIPPacket, wg *sync.WaitGroup, isShuttingDown *bool) {
+func tunWriteRoutine(dev *tunDevice, queue io.Writer, packetsOut chan *RawIPPacket, wg *sync.WaitGroup, isShuttingDown *bool) {
 	wg.Add(1)
 	defer wg.Done()
 
+	var scratch []byte
+	// an offload device takes the queued segments of a flow in one write
+	var co *coalescer
+	if dev.vnetHdr {
+		co = newCoalescer()
+	}
+	var next *RawIPPacket
 	for !*isShuttingDown {
-		pkt := <-packetsOut
-		w, err := dev.Write(pkt.Raw)
+		pkt := next
+		next = nil
+		if pkt == nil {
+			pkt = <-packetsOut
+		}
+		frame := pkt.Raw
+		if co != nil && co.start(pkt.Raw) {
+			putPacket(pkt)
+			pkt = nil
+			next = coalesceQueued(co, packetsOut)
+			frame = co.frame()
+		} else if dev.vnetHdr {
+			var inPlace bool
+			if frame, inPlace = pkt.withVnetHdr(scratch); !inPlace {
+				scratch = frame
+			}
+		}
+		w, err := queue.Write(frame)
+		n := len(frame)
+		if pkt != nil {
+			putPacket(pkt)
+		}
 		if err != nil {
 			log.Infof("Write to %s failed: %s", dev.Name(), err.Error())
 			return
 		}
-		if w != len(pkt.Raw) {
-			log.Infof("WARN: Write to %s has mismatched len: %d != %d", dev.Name(), w, len(pkt.Raw))
+		if w != n {
+			log.Infof("WARN: Write to %s has mismatched len: %d != %d", dev.Name(), w, n)
 		}
 	}
 }
@@ -0,0 +1,96 @@
+package vpn
+
+import (
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSetSubnetForClient(t *testing.T) {
+	s := newTestServer()
+	own, other := s.newTestConn(), s.newTestConn()
+	s.setAddrForClient(own.id, net.IPv4(10, 8, 0, 2))
+	s.setAddrForClient(other.id, net.IPv4(10, 9, 0, 2))
+	s.setAddrForClient(other.id, net.ParseIP("fd00:9::2"))
+
+	tests := []struct {
+		subnet string
+		ok     bool
+	}{
+		{"10.1.0.0/16", true},
+		{"10.1.2.3/16", true},
+		// the subnet behind a client may hold its own address
+		{"10.8.0.0/16", true},
+		{"10.9.0.0/16", false},
+		{"10.0.0.0/8", false},
+		{"fd00:9::/64", false},
+		{"fd00:8::/64", true},
+		{"0.0.0.0/0", false},
+		{"192.168.45.128/25", false},
+		{"192.168.0.0/16", false},
+	}
+	for _, tt := range tests {
+		_, subnet, err := net.ParseCIDR(tt.subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.setSubnetForClient(own.id, subnet, DefaultSubnetMetric)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok %v", tt.subnet, err, tt.ok)
+		}
+	}
+	if r, _ := s.Lookup(net.IPv4(10, 9, 0, 2)); r.ClientID != other.id {
+		t.Errorf("address of client %d routes via %v", other.id, r)
+	}
+}
+
+func TestAnnounceRoute(t *testing.T) {
+	s := newTestServer()
+	c := s.newTestConn()
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	c.conn, c.server, c.connectionOk = serverSide, s, true
+	shuttingDown := false
+	go c.readRoutine(&shuttingDown)
+
+	subnet := func(cidr string) net.IPNet {
+		_, n, _ := net.ParseCIDR(cidr)
+		return *n
+	}
+	enc := gob.NewEncoder(clientSide)
+	for _, msg := range []interface{}{
+		// the older form without a metric
+		PacketSubnet, subnet("10.1.0.0/16"),
+		PacketRoute, RouteAnnouncement{Subnet: subnet("10.2.0.0/16"), Metric: 50},
+		// below the lowest metric a client gets
+		PacketRoute, RouteAnnouncement{Subnet: subnet("10.3.0.0/16"), Metric: 1},
+		PacketRoute, RouteAnnouncement{Subnet: subnet("10.4.0.0/16")},
+	} {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]int{
+		"10.1.0.0/16": DefaultSubnetMetric,
+		"10.2.0.0/16": 50,
+		"10.3.0.0/16": DefaultSubnetMetric,
+		"10.4.0.0/16": DefaultSubnetMetric,
+	}
+	got := map[string]int{}
+	for deadline := time.Now().Add(time.Second); len(got) < len(want) && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		got = map[string]int{}
+		for _, r := range s.Routes() {
+			if r.ClientID == c.id {
+				got[r.Prefix.String()] = r.Metric
+			}
+		}
+	}
+	for prefix, metric := range want {
+		if m, ok := got[prefix]; !ok || m != metric {
+			t.Errorf("%s: got metric %d, routed %v, want %d", prefix, m, ok, metric)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package vpn
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"sync/atomic"
+)
+
+// sessionTokenLen is the random bytes of a session token
+const sessionTokenLen = 16
+
+// clientSession is a client with the connections it bonded into it, like two
+// tcp streams or one over wifi and one over lte. The server answers the first
+// Hello of a client with a token naming its session, every connection
+// presenting the token joins it. The session lives as long as one of its
+// connections does.
+type clientSession struct {
+	id    int
+	token string
+
+	// sessionConns published on every change, read by the shards without the lock
+	conns atomic.Value
+}
+
+type sessionConns struct {
+	conns []*ServerConn
+	// the smallest of the conns, any of them may carry a packet
+	mtu int
+}
+
+func newClientSession(id int) *clientSession {
+	sess := &clientSession{id: id}
+	sess.conns.Store(&sessionConns{})
+	return sess
+}
+
+func (sess *clientSession) snapshot() *sessionConns {
+	return sess.conns.Load().(*sessionConns)
+}
+
+// mtu returns the largest packet all conns of the session carry
+func (sess *clientSession) mtu() int {
+	return sess.snapshot().mtu
+}
+
+// write queues a packet on a conn of the session. The flow picks the conn so
+// its packets stay in order, a full conn spills over to the next one and the
+// packet is dropped when all are full.
+func (sess *clientSession) write(pkt *RawIPPacket) {
+	conns := sess.snapshot().conns
+	if len(conns) == 0 {
+		putPacket(pkt)
+		return
+	}
+	first := int(pkt.flow % uint32(len(conns)))
+	for i := range conns {
+		c := conns[(first+i)%len(conns)]
+		select {
+		case c.outBoundIPPacket <- pkt:
+			return
+		default:
+		}
+	}
+	putPacket(pkt)
+	log.Infof("Warning: Dropping packets for client %d as outbound msg queues are full.", sess.id)
+}
+
+// add and remove publish the conns of the session, clientsLock must be held
+func (sess *clientSession) add(c *ServerConn) {
+	old := sess.snapshot().conns
+	conns := make([]*ServerConn, 0, len(old)+1)
+	sess.publish(append(append(conns, old...), c))
+}
+
+func (sess *clientSession) remove(c *ServerConn) bool {
+	old := sess.snapshot().conns
+	conns := make([]*ServerConn, 0, len(old))
+	for _, other := range old {
+		if other != c {
+			conns = append(conns, other)
+		}
+	}
+	if len(conns) == len(old) {
+		return false
+	}
+	sess.publish(conns)
+	return true
+}
+
+func (sess *clientSession) publish(conns []*ServerConn) {
+	mtu := 0
+	for _, c := range conns {
+		if mtu == 0 || c.mtu < mtu {
+			mtu = c.mtu
+		}
+	}
+	sess.conns.Store(&sessionConns{conns: conns, mtu: mtu})
+}
+
+// newSessionToken returns a token naming a session, 128 random bits so it
+// can not be guessed
+func newSessionToken() (string, error) {
+	var b [sessionTokenLen]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// joinSession settles the session of conn c by its first Hello and returns
+// the token naming it for the reply. Without a token the conn starts a
+// session and the server makes up its token. With the token of another
+// client the conn is bonded into it: the session it was enrolled in alone
+// goes away and the addresses and subnets it announced move along. Any other
+// token, like one from before a restart of the server, starts a session too.
+func (s *Server) joinSession(c *ServerConn, token string) string {
+	s.cm.clientsLock.Lock()
+	defer s.cm.clientsLock.Unlock()
+
+	own := s.cm.clients[c.id]
+	if own == nil {
+		return ""
+	}
+	if own.token != "" {
+		return own.token
+	}
+	var sess *clientSession
+	if token != "" {
+		for _, other := range s.cm.clients {
+			if other != own && other.token != "" && subtle.ConstantTimeCompare([]byte(other.token), []byte(token)) == 1 {
+				sess = other
+			}
+		}
+		if sess == nil {
+			log.Infof("conn of client %d presented an unknown session token, starting a new session", c.id)
+		}
+	}
+	if sess == nil {
+		var err error
+		if own.token, err = newSessionToken(); err != nil {
+			log.Infof("Could not make a session token for client %d: %s", c.id, err)
+		}
+		return own.token
+	}
+
+	id := sess.id
+	own.remove(c)
+	delete(s.cm.clients, own.id)
+	for addr, itemID := range s.cm.clientIDByAddress {
+		if itemID == c.id {
+			s.cm.clientIDByAddress[addr] = id
+		}
+	}
+	for p, metric := range s.cm.clientSubnets {
+		if p.clientID == c.id {
+			delete(s.cm.clientSubnets, p)
+			s.cm.clientSubnets[clientPrefix{prefix: p.prefix, clientID: id}] = metric
+		}
+	}
+	log.Infof("conn of client %d joined client %d", c.id, id)
+	c.id = id
+	sess.add(c)
+	s.cm.publishRoutes()
+	return sess.token
+}
@@ -0,0 +1,92 @@
+package vpn
+
+import (
+	"net"
+	"testing"
+)
+
+func newTestServer() *Server {
+	s := &Server{
+		addrWithNetmask: "192.168.45.1/24",
+		cm: &ClientConnsManager{
+			clientIDByAddress: map[string]int{},
+			clientSubnets:     map[clientPrefix]int{},
+			clients:           map[int]*clientSession{},
+		},
+		lastClientID: 1,
+	}
+	s.cm.publishRoutes()
+	return s
+}
+
+func (s *Server) newTestConn() *ServerConn {
+	c := &ServerConn{mtu: 1400}
+	s.enrollClientConn(c)
+	return c
+}
+
+func TestJoinSession(t *testing.T) {
+	s := newTestServer()
+	first, second, stranger := s.newTestConn(), s.newTestConn(), s.newTestConn()
+	s.setAddrForClient(second.id, net.IPv4(192, 168, 45, 7))
+
+	token := s.joinSession(first, "")
+	if len(token) != 2*sessionTokenLen {
+		t.Fatalf("got token %q, want %d hex digits", token, 2*sessionTokenLen)
+	}
+	if again := s.joinSession(first, "other"); again != token {
+		t.Errorf("the second hello changed the session to %q", again)
+	}
+
+	// a guessed or stale token starts a session of its own
+	forged := token[:len(token)-1] + "x"
+	if got := s.joinSession(stranger, forged); got == token || got == "" {
+		t.Errorf("forged token got %q", got)
+	}
+	if stranger.id == first.id {
+		t.Error("forged token joined the session")
+	}
+	if sess := s.cm.clients[stranger.id]; len(sess.snapshot().conns) != 1 {
+		t.Errorf("stranger has %d conns", len(sess.snapshot().conns))
+	}
+
+	// the token of the server bonds the conn into the client
+	secondID := second.id
+	if got := s.joinSession(second, token); got != token {
+		t.Errorf("join answered %q, want %q", got, token)
+	}
+	if second.id != first.id {
+		t.Fatalf("conn is client %d, want %d", second.id, first.id)
+	}
+	if _, ok := s.cm.clients[secondID]; ok {
+		t.Error("the session the conn was enrolled in is left")
+	}
+	if n := len(s.cm.clients[first.id].snapshot().conns); n != 2 {
+		t.Errorf("client has %d conns, want 2", n)
+	}
+	if r, ok := s.Lookup(net.IPv4(192, 168, 45, 7)); !ok || r.ClientID != first.id {
+		t.Errorf("address of the joined conn routes via %v", r)
+	}
+
+	// the token goes away with the last conn of its client
+	s.removeClientConn(first)
+	s.removeClientConn(second)
+	late := s.newTestConn()
+	if got := s.joinSession(late, token); got == token {
+		t.Error("token of a gone client was accepted")
+	}
+}
+
+func TestSessionTokensDiffer(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		token, err := newSessionToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[token] {
+			t.Fatalf("token %s made twice", token)
+		}
+		seen[token] = true
+	}
+}
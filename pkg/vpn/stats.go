@@ -0,0 +1,96 @@
+package vpn
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// the stats file is rewritten this often
+const statsWriteInterval = time.Minute
+
+// Stats are the traffic counters of the server, BytesIn came from the
+// clients and BytesOut went to them. SavedIn and SavedOut of those bytes
+// did not go over the wire thanks to compression. BytesBetween of BytesIn
+// went from a client to another client and never left the server.
+type Stats struct {
+	Start        time.Time
+	Updated      time.Time
+	Clients      int
+	BytesIn      uint64
+	BytesOut     uint64
+	SavedIn      uint64
+	SavedOut     uint64
+	BytesBetween uint64
+}
+
+// SetStatsFile makes the server keep its counters in path, counting on from
+// what an earlier run left there
+func (s *Server) SetStatsFile(path string) {
+	s.statsFile = path
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var previous Stats
+	if err = json.Unmarshal(data, &previous); err != nil {
+		log.Infof("ignoring bad stats file %s: %s", path, err)
+		return
+	}
+	atomic.AddUint64(&s.bytesIn, previous.BytesIn)
+	atomic.AddUint64(&s.bytesOut, previous.BytesOut)
+	atomic.AddUint64(&s.savedIn, previous.SavedIn)
+	atomic.AddUint64(&s.savedOut, previous.SavedOut)
+	atomic.AddUint64(&s.bytesBetween, previous.BytesBetween)
+	if !previous.Start.IsZero() {
+		s.statsStart = previous.Start
+	}
+}
+
+// Stats returns the current counters
+func (s *Server) Stats() Stats {
+	s.cm.clientsLock.Lock()
+	clients := len(s.cm.clients)
+	s.cm.clientsLock.Unlock()
+	return Stats{
+		Start:        s.statsStart,
+		Updated:      time.Now(),
+		Clients:      clients,
+		BytesIn:      atomic.LoadUint64(&s.bytesIn),
+		BytesOut:     atomic.LoadUint64(&s.bytesOut),
+		SavedIn:      atomic.LoadUint64(&s.savedIn),
+		SavedOut:     atomic.LoadUint64(&s.savedOut),
+		BytesBetween: atomic.LoadUint64(&s.bytesBetween),
+	}
+}
+
+func (s *Server) statsRoutine() {
+	ticker := time.NewTicker(statsWriteInterval)
+	defer ticker.Stop()
+
+	for !s.isShuttingDown {
+		<-ticker.C
+		if err := s.writeStats(); err != nil {
+			log.Infof("write stats: %s", err)
+		}
+	}
+}
+
+// writeStats replaces the stats file at once, readers never see half of it
+func (s *Server) writeStats() error {
+	data, err := json.Marshal(s.Stats())
+	if err != nil {
+		return err
+	}
+	tmp := s.statsFile + ".tmp"
+	if err = os.MkdirAll(filepath.Dir(s.statsFile), 0755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.statsFile)
+}
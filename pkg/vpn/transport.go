@@ -0,0 +1,135 @@
+package vpn
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTransport is plain tcp
+const DefaultTransport = "tcp"
+
+// Transport carries the connections between the clients and the server, the
+// server reads and writes its packets the same over any of them
+type Transport interface {
+	// Listen returns the listener the server accepts its clients on
+	Listen(addr string) (net.Listener, error)
+	// Dial connects a client to the server listening on addr
+	Dial(addr string) (net.Conn, error)
+	// Overhead is what the transport adds on the wire to a packet, which goes
+	// out in two writes, the mtu is lowered by it
+	Overhead() int
+}
+
+// TransportConfig selects a transport and holds the settings of all of them
+type TransportConfig struct {
+	// Name is one of Transports(), tcp when empty
+	Name string
+
+	// certificate and key files of a tls server, a self-signed certificate is
+	// made when empty
+	CertFile string
+	KeyFile  string
+	// ServerName is the name a tls client asks for and checks the certificate
+	// against, unless Fingerprint pins the sha256 of the certificate or
+	// Insecure skips the check
+	ServerName  string
+	Fingerprint string
+	Insecure    bool
+
+	// Path is the url path of the websocket
+	Path string
+}
+
+// TransportFactory builds a transport from the config
+type TransportFactory func(cfg *TransportConfig) (Transport, error)
+
+var (
+	transports     = map[string]TransportFactory{}
+	transportsLock sync.Mutex
+)
+
+// RegisterTransport makes a transport available by name
+func RegisterTransport(name string, factory TransportFactory) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	if _, ok := transports[name]; ok {
+		panic("vpn: transport registered twice: " + name)
+	}
+	transports[name] = factory
+}
+
+// Transports returns the names of the registered transports
+func Transports() []string {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	var names []string
+	for name := range transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewTransport creates the transport selected in the config
+func NewTransport(cfg *TransportConfig) (Transport, error) {
+	name := cfg.Name
+	if name == "" {
+		name = DefaultTransport
+	}
+	transportsLock.Lock()
+	factory, ok := transports[name]
+	transportsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q, available: %v", name, Transports())
+	}
+	return factory(cfg)
+}
+
+func init() {
+	RegisterTransport("tcp", func(cfg *TransportConfig) (Transport, error) {
+		return tcpTransport{}, nil
+	})
+}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, transportDialTimeout)
+}
+
+func (tcpTransport) Overhead() int {
+	return 0
+}
+
+const transportDialTimeout = 30 * time.Second
+
+// deadliner is a listener whose Accept can be interrupted
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// netConner is a conn wrapping another, like tls.Conn
+type netConner interface {
+	NetConn() net.Conn
+}
+
+// tcpConnOf returns the tcp connection under conn, or nil
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case netConner:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package vpn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// a tls 1.3 record adds a 5 byte header, the content type and a 16 byte tag
+	tlsRecordOverhead = 22
+	// the made up certificate is valid this long
+	selfSignedValidity = 365 * 24 * time.Hour
+	defaultServerName  = "fastvpn"
+)
+
+func init() {
+	RegisterTransport("tls", func(cfg *TransportConfig) (Transport, error) {
+		return newTLSTransport(cfg)
+	})
+}
+
+// tlsTransport wraps tcp in tls, to a firewall it looks like https when on 443
+type tlsTransport struct {
+	cfg    *TransportConfig
+	server *tls.Config
+}
+
+func newTLSTransport(cfg *TransportConfig) (*tlsTransport, error) {
+	if cfg.Fingerprint != "" {
+		fp, err := hex.DecodeString(strings.Replace(cfg.Fingerprint, ":", "", -1))
+		if err != nil || len(fp) != sha256.Size {
+			return nil, fmt.Errorf("bad certificate fingerprint %q", cfg.Fingerprint)
+		}
+	}
+	return &tlsTransport{cfg: cfg}, nil
+}
+
+func (t *tlsTransport) Listen(addr string) (net.Listener, error) {
+	var cert tls.Certificate
+	var err error
+	if t.cfg.CertFile != "" || t.cfg.KeyFile != "" {
+		cert, err = tls.LoadX509KeyPair(t.cfg.CertFile, t.cfg.KeyFile)
+	} else {
+		cert, err = selfSignedCert(t.serverName())
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	log.Infof("tls certificate fingerprint %s", hex.EncodeToString(sum[:]))
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"http/1.1"},
+	}
+	return &tlsListener{Listener: ln, config: t.server}, nil
+}
+
+func (t *tlsTransport) Dial(addr string) (net.Conn, error) {
+	config := &tls.Config{
+		ServerName: t.serverName(),
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+	}
+	if t.cfg.Insecure || t.cfg.Fingerprint != "" {
+		config.InsecureSkipVerify = true
+	}
+	if t.cfg.Fingerprint != "" {
+		want, _ := hex.DecodeString(strings.Replace(t.cfg.Fingerprint, ":", "", -1))
+		config.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(certs) == 0 {
+				return errors.New("no server certificate")
+			}
+			sum := sha256.Sum256(certs[0])
+			if string(sum[:]) != string(want) {
+				return fmt.Errorf("server certificate fingerprint %s is not the pinned one", hex.EncodeToString(sum[:]))
+			}
+			return nil
+		}
+	}
+	dialer := &net.Dialer{Timeout: transportDialTimeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, config)
+}
+
+func (t *tlsTransport) Overhead() int {
+	return 2 * tlsRecordOverhead
+}
+
+func (t *tlsTransport) serverName() string {
+	if t.cfg.ServerName != "" {
+		return t.cfg.ServerName
+	}
+	return defaultServerName
+}
+
+// tlsListener is tls.NewListener keeping SetDeadline, the handshake happens
+// on the first read or write of a conn
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.config), nil
+}
+
+func (l *tlsListener) SetDeadline(t time.Time) error {
+	if d, ok := l.Listener.(deadliner); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+// selfSignedCert makes a certificate for name, for servers without one
+func selfSignedCert(name string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
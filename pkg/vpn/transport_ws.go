@@ -0,0 +1,349 @@
+package vpn
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWebSocketPath = "/"
+	webSocketGUID        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	// the frame header of a packet: 2 bytes, 2 for the length and 4 for the
+	// mask of the client
+	wsFrameOverhead = 8
+	// control frames carry no more than this
+	wsMaxControlLen = 125
+	// the request the client upgrades with must come in this time
+	wsHandshakeTimeout = 30 * time.Second
+)
+
+func init() {
+	RegisterTransport("ws", func(cfg *TransportConfig) (Transport, error) {
+		return &wsTransport{cfg: cfg, inner: tcpTransport{}}, nil
+	})
+	RegisterTransport("wss", func(cfg *TransportConfig) (Transport, error) {
+		inner, err := newTLSTransport(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &wsTransport{cfg: cfg, inner: inner, secure: true}, nil
+	})
+}
+
+// wsTransport carries the packets as binary websocket messages, over tcp or
+// over tls for wss, so it passes web proxies and cdns
+type wsTransport struct {
+	cfg    *TransportConfig
+	inner  Transport
+	secure bool
+}
+
+func (t *wsTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := t.inner.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &wsListener{Listener: ln, path: t.path()}, nil
+}
+
+func (t *wsTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.inner.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := newWSConn(conn, false)
+	if err = c.clientHandshake(addr, t.path(), t.secure); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *wsTransport) Overhead() int {
+	return t.inner.Overhead() + 2*wsFrameOverhead
+}
+
+func (t *wsTransport) path() string {
+	if t.cfg.Path != "" {
+		return t.cfg.Path
+	}
+	return defaultWebSocketPath
+}
+
+// wsListener accepts websocket conns, the upgrade is read on the first read
+// or write of a conn so a slow client does not hold up the others
+type wsListener struct {
+	net.Listener
+	path string
+}
+
+func (l *wsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := newWSConn(conn, true)
+	c.path = l.path
+	return c, nil
+}
+
+func (l *wsListener) SetDeadline(t time.Time) error {
+	if d, ok := l.Listener.(deadliner); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+// wsConn is a net.Conn over websocket binary messages, a write is a message
+// and reads go across them as a stream
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	server bool
+	path   string
+
+	handshake    sync.Once
+	handshakeErr error
+
+	// the frame being read, its bytes left and mask
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+
+	writeLock sync.Mutex
+	wbuf      []byte
+}
+
+func newWSConn(conn net.Conn, server bool) *wsConn {
+	return &wsConn{Conn: conn, br: bufio.NewReader(conn), server: server}
+}
+
+// NetConn returns the conn the websocket runs over
+func (c *wsConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *wsConn) serverHandshake() error {
+	c.handshake.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(wsHandshakeTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		req, err := http.ReadRequest(c.br)
+		if err != nil {
+			c.handshakeErr = err
+			return
+		}
+		key := req.Header.Get("Sec-Websocket-Key")
+		if req.URL.Path != c.path || !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+			// anything else gets what a web server would answer
+			io.WriteString(c.Conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+			c.handshakeErr = fmt.Errorf("not a websocket request: %s %s", req.Method, req.URL.Path)
+			return
+		}
+		_, c.handshakeErr = io.WriteString(c.Conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: "+webSocketAccept(key)+"\r\n\r\n")
+	})
+	return c.handshakeErr
+}
+
+func (c *wsConn) clientHandshake(addr, path string, secure bool) error {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	scheme := "ws"
+	if secure {
+		scheme = "wss"
+	}
+	req, err := http.NewRequest("GET", scheme+"://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err = req.Write(c.Conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(c.br, req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("websocket upgrade refused: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-Websocket-Accept") != webSocketAccept(key) {
+		return errors.New("websocket upgrade with a bad accept key")
+	}
+	c.handshake.Do(func() {})
+	return nil
+}
+
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	if c.server {
+		if err := c.serverHandshake(); err != nil {
+			return 0, err
+		}
+	}
+	for c.remaining == 0 {
+		op, n, err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			c.remaining = n
+		case wsOpClose:
+			c.writeFrame(wsOpClose, nil)
+			return 0, io.EOF
+		case wsOpPing, wsOpPong:
+			if n > wsMaxControlLen {
+				return 0, errors.New("websocket control frame too long")
+			}
+			payload := make([]byte, n)
+			if err = c.readPayload(payload); err != nil {
+				return 0, err
+			}
+			if op == wsOpPing {
+				if err = c.writeFrame(wsOpPong, payload); err != nil {
+					return 0, err
+				}
+			}
+		default:
+			return 0, fmt.Errorf("websocket opcode %d", op)
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+func (c *wsConn) readHeader() (op byte, n uint64, err error) {
+	var hdr [8]byte
+	if _, err = io.ReadFull(c.br, hdr[:2]); err != nil {
+		return 0, 0, err
+	}
+	op = hdr[0] & 0xf
+	c.masked = hdr[1]&0x80 != 0
+	n = uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		if _, err = io.ReadFull(c.br, hdr[:2]); err != nil {
+			return 0, 0, err
+		}
+		n = uint64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.br, hdr[:8]); err != nil {
+			return 0, 0, err
+		}
+		n = binary.BigEndian.Uint64(hdr[:8])
+	}
+	if c.masked {
+		if _, err = io.ReadFull(c.br, c.mask[:]); err != nil {
+			return 0, 0, err
+		}
+		c.maskPos = 0
+	}
+	return op, n, nil
+}
+
+func (c *wsConn) readPayload(p []byte) error {
+	if _, err := io.ReadFull(c.br, p); err != nil {
+		return err
+	}
+	c.unmask(p)
+	return nil
+}
+
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if c.server {
+		if err := c.serverHandshake(); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes p as one frame, masked when sent by the client
+func (c *wsConn) writeFrame(op byte, p []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	b := append(c.wbuf[:0], 0x80|op)
+	var maskBit byte
+	if !c.server {
+		maskBit = 0x80
+	}
+	switch {
+	case len(p) < 126:
+		b = append(b, maskBit|byte(len(p)))
+	case len(p) <= 0xffff:
+		b = append(b, maskBit|126, byte(len(p)>>8), byte(len(p)))
+	default:
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(p)))
+		b = append(append(b, maskBit|127), n[:]...)
+	}
+	if c.server {
+		b = append(b, p...)
+	} else {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		b = append(b, mask[:]...)
+		start := len(b)
+		b = append(b, p...)
+		for i := range b[start:] {
+			b[start+i] ^= mask[i&3]
+		}
+	}
+	c.wbuf = b
+	_, err := c.Conn.Write(b)
+	return err
+}
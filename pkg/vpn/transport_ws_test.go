@@ -0,0 +1,256 @@
+package vpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// bufConn reads what the peer sent from in and keeps what is written to it
+type bufConn struct {
+	net.Conn
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *bufConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+// wsFrame builds a frame, masked with mask unless it is nil
+func wsFrame(op byte, fin bool, mask []byte, payload []byte) []byte {
+	b := []byte{op}
+	if fin {
+		b[0] |= 0x80
+	}
+	var maskBit byte
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b = append(b, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(b[2:], uint16(len(payload)))
+	default:
+		b = append(b, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(b[2:], uint64(len(payload)))
+	}
+	b = append(b, mask...)
+	start := len(b)
+	b = append(b, payload...)
+	for i := range b[start:] {
+		if mask != nil {
+			b[start+i] ^= mask[i&3]
+		}
+	}
+	return b
+}
+
+func concat(frames ...[]byte) []byte {
+	var b []byte
+	for _, f := range frames {
+		b = append(b, f...)
+	}
+	return b
+}
+
+// newTestWSConn returns a wsConn past its handshake reading in
+func newTestWSConn(server bool, in []byte) (*wsConn, *bufConn) {
+	conn := &bufConn{in: bytes.NewReader(in)}
+	c := newWSConn(conn, server)
+	c.handshake.Do(func() {})
+	return c, conn
+}
+
+func TestWSConnRead(t *testing.T) {
+	mask1 := []byte{0x12, 0x34, 0x56, 0x78}
+	mask2 := []byte{0x9a, 0xbc, 0xde, 0xf0}
+	small := testPayload(100)
+	medium := testPayload(300)
+	large := testPayload(70000)
+	tests := []struct {
+		name   string
+		server bool
+		in     []byte
+		want   []byte
+		// the control frame the conn answered with
+		reply []byte
+	}{
+		{"unmasked from the server", false, wsFrame(wsOpBinary, true, nil, small), small, nil},
+		{"masked from the client", true, wsFrame(wsOpBinary, true, mask1, small), small, nil},
+		{"16 bit length", true, wsFrame(wsOpBinary, true, mask1, medium), medium, nil},
+		{"64 bit length", false, wsFrame(wsOpBinary, true, nil, large), large, nil},
+		{
+			name:   "fragmented",
+			server: true,
+			in: concat(
+				wsFrame(wsOpBinary, false, mask1, medium[:7]),
+				wsFrame(wsOpContinuation, false, mask2, medium[7:130]),
+				wsFrame(wsOpContinuation, true, mask1, medium[130:]),
+			),
+			want: medium,
+		},
+		{
+			name:   "ping between fragments",
+			server: true,
+			in: concat(
+				wsFrame(wsOpBinary, false, mask1, small[:50]),
+				wsFrame(wsOpPing, true, mask2, []byte("ping")),
+				wsFrame(wsOpContinuation, true, mask2, small[50:]),
+			),
+			want:  small,
+			reply: wsFrame(wsOpPong, true, nil, []byte("ping")),
+		},
+		{
+			name:   "pong ignored",
+			server: false,
+			in:     concat(wsFrame(wsOpPong, true, nil, []byte("late")), wsFrame(wsOpBinary, true, nil, small)),
+			want:   small,
+		},
+		{
+			name:   "empty frame",
+			server: false,
+			in:     concat(wsFrame(wsOpBinary, true, nil, nil), wsFrame(wsOpBinary, true, nil, small)),
+			want:   small,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, conn := newTestWSConn(tt.server, tt.in)
+			got := make([]byte, len(tt.want))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Error("read the wrong bytes")
+			}
+			if !bytes.Equal(conn.out.Bytes(), tt.reply) {
+				t.Errorf("replied %x, want %x", conn.out.Bytes(), tt.reply)
+			}
+		})
+	}
+}
+
+func TestWSConnReadClose(t *testing.T) {
+	c, conn := newTestWSConn(false, wsFrame(wsOpClose, true, nil, nil))
+	if n, err := c.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("got %d, %v, want io.EOF", n, err)
+	}
+	// a client masks even the empty close frame
+	if out := conn.out.Bytes(); len(out) != 6 || out[0] != 0x80|wsOpClose || out[1] != 0x80 {
+		t.Errorf("answered with %x, want a masked close frame", out)
+	}
+}
+
+func TestWSConnReadRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"long ping", wsFrame(wsOpPing, true, nil, testPayload(wsMaxControlLen+1))},
+		{"reserved opcode", wsFrame(0x3, true, nil, []byte("x"))},
+		{"cut off header", wsFrame(wsOpBinary, true, nil, testPayload(300))[:3]},
+		{"cut off mask", wsFrame(wsOpBinary, true, []byte{1, 2, 3, 4}, nil)[:4]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestWSConn(false, tt.in)
+			if n, err := c.Read(make([]byte, 10)); err == nil {
+				t.Errorf("read %d bytes without an error", n)
+			}
+		})
+	}
+}
+
+func TestWSConnWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		length byte
+	}{
+		{"7 bit length", 125, 125},
+		{"16 bit length", 126, 126},
+		{"largest 16 bit length", 0xffff, 126},
+		{"64 bit length", 0x10000, 127},
+	}
+	for _, tt := range tests {
+		for _, server := range []bool{false, true} {
+			payload := testPayload(tt.size)
+			c, conn := newTestWSConn(server, nil)
+			if n, err := c.Write(payload); err != nil || n != len(payload) {
+				t.Fatalf("%s: wrote %d, %v", tt.name, n, err)
+			}
+			out := conn.out.Bytes()
+			if out[0] != 0x80|wsOpBinary {
+				t.Errorf("%s: first byte %#x, want a final binary frame", tt.name, out[0])
+			}
+			// only the client masks its frames
+			if masked := out[1]&0x80 != 0; masked == server {
+				t.Errorf("%s: server %v sent masked %v", tt.name, server, masked)
+			}
+			if out[1]&0x7f != tt.length {
+				t.Errorf("%s: length %d, want %d", tt.name, out[1]&0x7f, tt.length)
+			}
+
+			// the other side reads back what was written
+			peer, _ := newTestWSConn(!server, out)
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(peer, got); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("%s: server %v: payload changed on the way", tt.name, server)
+			}
+		}
+	}
+}
+
+func TestWSConnHandshake(t *testing.T) {
+	for _, path := range []string{"/vpn", "/other"} {
+		clientSide, serverSide := net.Pipe()
+		server := newWSConn(serverSide, true)
+		server.path = "/vpn"
+		client := newWSConn(clientSide, false)
+
+		done := make(chan error, 1)
+		go func() {
+			err := client.clientHandshake("example.com", path, true)
+			if err == nil {
+				_, err = client.Write([]byte("hello"))
+			}
+			done <- err
+		}()
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		if path != server.path {
+			// the server answers like a web server and the client gives up
+			serverSide.Close()
+			if err == nil {
+				t.Errorf("%s: server accepted the upgrade", path)
+			}
+			if cerr := <-done; cerr == nil {
+				t.Errorf("%s: client upgraded", path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if string(buf) != "hello" {
+			t.Errorf("%s: got %q", path, buf)
+		}
+		if err = <-done; err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		go server.Write([]byte("world"))
+		if _, err = io.ReadFull(client, buf); err != nil || string(buf) != "world" {
+			t.Errorf("%s: client read %q, %v", path, buf, err)
+		}
+		clientSide.Close()
+		serverSide.Close()
+	}
+}
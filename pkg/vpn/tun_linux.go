@@ -0,0 +1,123 @@
+package vpn
+
+import (
+	"io"
+	"os"
+	"strings"
+	"unsafe"
+
+	"github.com/songgao/water"
+	"golang.org/x/sys/unix"
+)
+
+// TunOptions selects how the tun device is driven
+type TunOptions struct {
+	// Queues opens the device with IFF_MULTI_QUEUE, each queue gets its own
+	// reader and writer
+	Queues int
+	// Offload lets the kernel hand over tcp segments of up to 64k behind a
+	// virtio net header, they are split to the mtu before going to the clients
+	Offload bool
+	// MTU of the device, 0 fits it to the outer path
+	MTU int
+}
+
+// tunDevice is the tun interface of the server, opened with one or more queues
+type tunDevice struct {
+	name    string
+	queues  []io.ReadWriteCloser
+	vnetHdr bool
+}
+
+type ifReq struct {
+	Name  [unix.IFNAMSIZ]byte
+	Flags uint16
+	pad   [40 - unix.IFNAMSIZ - 2]byte
+}
+
+// openTun opens the device as asked, falling back to no offload and then to
+// a single queue when the kernel does not support them
+func openTun(name string, opts TunOptions) (*tunDevice, error) {
+	if opts.Queues <= 1 && !opts.Offload {
+		ifce, err := water.New(water.Config{
+			DeviceType:             water.TUN,
+			PlatformSpecificParams: water.PlatformSpecificParams{Name: name},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &tunDevice{name: ifce.Name(), queues: []io.ReadWriteCloser{ifce}}, nil
+	}
+
+	queues := opts.Queues
+	if queues < 1 {
+		queues = 1
+	}
+	dev, err := openTunQueues(name, queues, opts.Offload)
+	if err != nil && opts.Offload {
+		log.Infof("tun offload not supported, reading plain packets: %s", err)
+		opts.Offload = false
+		dev, err = openTunQueues(name, queues, false)
+	}
+	if err != nil && queues > 1 {
+		log.Infof("multi-queue tun not supported, using one queue: %s", err)
+		return openTun(name, TunOptions{Queues: 1, Offload: opts.Offload})
+	}
+	return dev, err
+}
+
+func openTunQueues(name string, queues int, offload bool) (dev *tunDevice, err error) {
+	dev = &tunDevice{name: name, vnetHdr: offload}
+	defer func() {
+		if err != nil {
+			dev.Close()
+		}
+	}()
+
+	flags := uint16(unix.IFF_TUN | unix.IFF_NO_PI)
+	if queues > 1 {
+		flags |= unix.IFF_MULTI_QUEUE
+	}
+	if offload {
+		flags |= unix.IFF_VNET_HDR
+	}
+	for i := 0; i < queues; i++ {
+		fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+		if err != nil {
+			return dev, os.NewSyscallError("open", err)
+		}
+		// the first queue creates the device, the others attach to it by name
+		req := ifReq{Flags: flags}
+		copy(req.Name[:], dev.name)
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&req)))
+		if errno != 0 {
+			unix.Close(fd)
+			return dev, os.NewSyscallError("ioctl TUNSETIFF", errno)
+		}
+		dev.name = strings.TrimRight(string(req.Name[:]), "\x00")
+		if offload {
+			if err = unix.IoctlSetInt(fd, unix.TUNSETOFFLOAD, tunFCsum|tunFTSO4|tunFTSO6); err != nil {
+				unix.Close(fd)
+				return dev, os.NewSyscallError("ioctl TUNSETOFFLOAD", err)
+			}
+		}
+		dev.queues = append(dev.queues, os.NewFile(uintptr(fd), "/dev/net/tun"))
+	}
+	return dev, nil
+}
+
+// Name returns the name the kernel gave the device
+func (d *tunDevice) Name() string {
+	return d.name
+}
+
+// Close closes every queue, the device goes away with the last one
+func (d *tunDevice) Close() error {
+	var first error
+	for _, q := range d.queues {
+		if err := q.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -1,269 +1,805 @@
 package vps
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net"
-	"os"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"golang.org/x/crypto/ssh"
 
-	"fmt"
 	"log"
 )
 
-const region = "us-east-2"
-const instanceName = "fastvpn"
-const command = `
-	sudo sed -i -e '$a deb [trusted=yes] http://shadowvpn.org/debian wheezy main' /etc/apt/sources.list
-	sudo apt-get update 
-	sudo apt-get install iproute2 shadowvpn -y
-	sudo service shadowvpn restart
-`
+const defaultRegion = "us-east-2"
+
+// tags put on everything this tool creates
+const (
+	// the console shows the capitalized Name tag
+	tagName      = "Name"
+	tagManagedBy = "managed-by"
+	tagBootstrap = "bootstrap"
+	tagRegion    = "region"
+	tagOwner     = "owner"
+	tagDeploy    = "deployment"
+	// the console of a restarted vm no longer shows its first boot, the
+	// fingerprint read from it is kept here
+	tagTLSFingerprint = "tls-fingerprint"
+
+	bootstrapPending = "pending"
+	bootstrapDone    = "done"
+)
 
-var svc *ec2.EC2
+type awsProvider struct {
+	svc    *ec2.EC2
+	region string
+	cfg    *Config
+}
 
 func init() {
+	Register("aws", newAWSProvider)
+}
+
+func newAWSProvider(cfg *Config) (Provider, error) {
+	region := cfg.Region
+	if region == "" {
+		region = defaultRegion
+	}
 	sess, err := session.NewSession(&aws.Config{
 		Region: aws.String(region)},
 	)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return nil, awsError("new session", err)
+	}
+	if _, err = sess.Config.Credentials.Get(); err != nil {
+		return nil, newError("new session", ErrCredentials, err)
 	}
-	svc = ec2.New(sess)
+	return &awsProvider{svc: ec2.New(sess), region: region, cfg: cfg}, nil
 }
 
-func findRunningVM() []*ec2.Instance {
-	runResult, _ := svc.DescribeInstances(&ec2.DescribeInstancesInput{
-		Filters: []*ec2.Filter{
-			&ec2.Filter{
-				Name:   aws.String("tag:name"),
-				Values: []*string{aws.String(instanceName)},
-			},
+// findRunningVM returns the live managed vms matching the tag filters
+func (p *awsProvider) findRunningVM(tags map[string]string) ([]*ec2.Instance, error) {
+	filters := []*ec2.Filter{
+		{
+			Name:   aws.String("tag:" + tagManagedBy),
+			Values: []*string{aws.String(instanceName)},
 		},
-	})
+		liveFilter(),
+	}
+	for key, value := range tags {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("tag:" + key),
+			Values: []*string{aws.String(value)},
+		})
+	}
+
 	var instances []*ec2.Instance
-	for _, reservations := range runResult.Reservations {
-		vm := reservations.Instances[0]
-		if *vm.State.Code == *aws.Int64(16) {
-			instances = append(instances, vm)
+	err := p.svc.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: filters,
+	}, func(page *ec2.DescribeInstancesOutput, last bool) bool {
+		for _, reservation := range page.Reservations {
+			instances = append(instances, reservation.Instances...)
 		}
+		return true
+	})
+	if err != nil {
+		return nil, awsError("describe instances", err)
 	}
-	return instances
+	return instances, nil
 }
 
-func createKey() []byte {
-	log.Print("begin create key pari for vm")
-	result, err := svc.CreateKeyPair(&ec2.CreateKeyPairInput{
-		KeyName: aws.String(instanceName),
-	})
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidKeyPair.Duplicate" {
-			deleteKey()
-			return createKey()
-		} else {
-			log.Printf("Unable to create key pair: %s, %v.", instanceName, err)
-			os.Exit(1)
-		}
+// liveFilter matches the vms which are not shutting down or gone
+func liveFilter() *ec2.Filter {
+	return &ec2.Filter{
+		Name: aws.String("instance-state-name"),
+		Values: aws.StringSlice([]string{
+			ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning,
+			ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped,
+		}),
 	}
-	return []byte(*result.KeyMaterial)
 }
 
-func deleteKey() {
-	svc.DeleteKeyPair(&ec2.DeleteKeyPairInput{
-		KeyName: aws.String(instanceName),
+func (p *awsProvider) deleteKey(name string) error {
+	_, err := p.svc.DeleteKeyPair(&ec2.DeleteKeyPairInput{
+		KeyName: aws.String(name),
 	})
+	return awsError("delete key pair", err)
 }
 
-func createSc() error {
-	deleteSc()
+// ensureSc creates the security group or brings the rules of an existing one
+// up to date, created tells which happened
+func (p *awsProvider) ensureSc(name string) (created bool, err error) {
+	rules, err := ingressRules(p.cfg)
+	if err != nil {
+		return false, err
+	}
 
-	log.Print("try begin create security for vm")
-	result, err := svc.DescribeVpcs(nil)
+	// the instance is launched without a subnet, so it lands in the default
+	// vpc and the group has to live there too
+	vpcID, err := p.defaultVPC()
 	if err != nil {
-		log.Fatalf("Unable to describe VPCs, %v", err)
+		return false, err
 	}
-	if len(result.Vpcs) == 0 {
-		log.Fatalf("No VPCs found to associate security group with.")
+
+	groups, err := p.svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("group-name"),
+				Values: []*string{aws.String(name)},
+			},
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []*string{aws.String(vpcID)},
+			},
+		},
+	})
+	if err != nil {
+		return false, awsError("describe security groups", err)
 	}
-	vpcID := aws.StringValue(result.Vpcs[0].VpcId)
-	_, err = svc.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
-		GroupName:   aws.String(instanceName),
-		Description: aws.String(instanceName),
+	if len(groups.SecurityGroups) > 0 {
+		group := groups.SecurityGroups[0]
+		log.Printf("update sc %s", aws.StringValue(group.GroupId))
+		return false, p.syncIngress(group.GroupId, fromIPPermissions(group.IpPermissions), rules)
+	}
+
+	log.Print("try begin create security for vm")
+	group, err := p.svc.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(name),
+		Description: aws.String(name),
 		VpcId:       aws.String(vpcID),
 	})
 	log.Printf("create sc for vpc: %s", vpcID)
 	if err != nil {
+		return false, awsError("create security group", err)
+	}
+	_, err = p.svc.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{group.GroupId},
+		Tags:      managedTags(name),
+	})
+	if err == nil {
+		err = p.syncIngress(group.GroupId, nil, rules)
+	}
+	if err != nil {
+		p.deleteSc(name)
+		return false, awsError("create security group", err)
+	}
+	return true, nil
+}
+
+// defaultVPC returns the id of the default vpc of the region
+func (p *awsProvider) defaultVPC() (string, error) {
+	result, err := p.svc.DescribeVpcs(&ec2.DescribeVpcsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("isDefault"),
+				Values: []*string{aws.String("true")},
+			},
+		},
+	})
+	if err != nil {
+		return "", awsError("describe vpcs", err)
+	}
+	if len(result.Vpcs) == 0 {
+		return "", newError("describe vpcs", nil, fmt.Errorf("no default vpc in %s, create one with `aws ec2 create-default-vpc`", p.region))
+	}
+	return aws.StringValue(result.Vpcs[0].VpcId), nil
+}
+
+// syncIngress authorizes the missing rules and revokes the ones no longer wanted
+func (p *awsProvider) syncIngress(groupID *string, current, wanted []Rule) error {
+	missing, extra := diffRules(current, wanted)
+	if len(extra) > 0 {
+		_, err := p.svc.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       groupID,
+			IpPermissions: toIPPermissions(extra),
+		})
+		if err != nil {
+			return awsError("revoke security group ingress", err)
+		}
+	}
+	if len(missing) > 0 {
+		_, err := p.svc.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       groupID,
+			IpPermissions: toIPPermissions(missing),
+		})
+		if err != nil {
+			return awsError("authorize security group ingress", err)
+		}
+	}
+	for _, r := range missing {
+		log.Printf("allow %s", r)
+	}
+	for _, r := range extra {
+		log.Printf("revoke %s", r)
+	}
+	return nil
+}
+
+func (p *awsProvider) deleteSc(name string) error {
+	// the network interface of a terminated vm holds on to the group a while
+	err := poll(context.Background(), "delete security group", terminateTimeout, func() (bool, error) {
+		_, err := p.svc.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
+			GroupName: aws.String(name),
+		})
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
-			case "InvalidVpcID.NotFound":
-				log.Fatal(err)
-			case "InvalidGroup.Duplicate":
-				deleteSc()
-				return createSc()
+			case "InvalidGroup.NotFound":
+				return true, nil
+			case "DependencyViolation":
+				return false, err
 			}
 		}
-		log.Fatal(err)
-	}
-
-	_, err = svc.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
-		GroupName: aws.String(instanceName),
-		IpPermissions: []*ec2.IpPermission{
-			(&ec2.IpPermission{}).
-				SetIpProtocol("-1").
-				SetFromPort(0).
-				SetToPort(65535).
-				SetIpRanges([]*ec2.IpRange{
-					{CidrIp: aws.String("0.0.0.0/0")},
-				}),
+		return true, err
+	})
+	return awsError("delete security group", err)
+}
+
+// Create makes the security group and starts the vm with the key named name,
+// nothing is left behind when it fails
+func (p *awsProvider) Create(name string, userData []byte) (*Instance, error) {
+	tx := &transaction{}
+	var created bool
+	err := tx.run(step{
+		name: "create security group " + name,
+		do: func() (err error) {
+			created, err = p.ensureSc(name)
+			return err
+		},
+		undo: func() error {
+			if !created {
+				return nil
+			}
+			return p.deleteSc(name)
 		},
 	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return nil
+	imageID, err := p.imageID()
+	if err != nil {
+		tx.rollback()
+		return nil, err
+	}
+	zone, err := p.pickZone()
+	if err != nil {
+		tx.rollback()
+		return nil, err
+	}
+
+	// start vm, tagged at launch so that it can always be found by gc
+	deployment := p.cfg.Name
+	if deployment == "" {
+		deployment = DefaultName
+	}
+	tags := append(managedTags(name), &ec2.Tag{
+		Key:   aws.String(tagRegion),
+		Value: aws.String(p.region),
+	}, &ec2.Tag{
+		Key:   aws.String(tagOwner),
+		Value: aws.String(p.cfg.Owner),
+	}, &ec2.Tag{
+		Key:   aws.String(tagDeploy),
+		Value: aws.String(deployment),
+	}, &ec2.Tag{
+		Key:   aws.String(tagBootstrap),
+		Value: aws.String(bootstrapPending),
+	})
+	input := &ec2.RunInstancesInput{
+		ImageId:        aws.String(imageID),
+		InstanceType:   aws.String(instanceTypeOf(p.cfg)),
+		MinCount:       aws.Int64(1),
+		MaxCount:       aws.Int64(1),
+		KeyName:        aws.String(name),
+		SecurityGroups: []*string{aws.String(name)},
+		UserData:       aws.String(base64.StdEncoding.EncodeToString(userData)),
+		// the server powers the vm off when idle, only a kept vm may stay stopped
+		InstanceInitiatedShutdownBehavior: aws.String(shutdownBehavior(p.cfg)),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeInstance),
+				Tags:         tags,
+			},
+		},
+	}
+	if zone != "" {
+		input.Placement = &ec2.Placement{AvailabilityZone: aws.String(zone)}
+	}
+	if p.cfg.Spot {
+		input.InstanceMarketOptions = spotOptions(p.cfg.SpotMaxPrice)
+	}
+	runResult, err := p.svc.RunInstances(input)
+	if err != nil && p.cfg.Spot && spotUnavailable(err) {
+		log.Printf("no spot capacity, falling back to on-demand: %s", err)
+		input.InstanceMarketOptions = nil
+		runResult, err = p.svc.RunInstances(input)
+	}
+	if err != nil {
+		tx.rollback()
+		return nil, awsError("run instances", err)
+	}
+	vm := toInstance(runResult.Instances[0])
+	log.Printf("%s created\n", vm.ID)
+	return vm, nil
+}
+
+// shutdownBehavior is what a poweroff from inside the vm does, like the one of
+// the server at the idle timeout or max lifetime: a kept vm is stopped, any
+// other is terminated. Spot vms are one-time requests, so a terminated one is
+// not launched again.
+func shutdownBehavior(cfg *Config) string {
+	if cfg.KeepStopped && !cfg.Spot {
+		return ec2.ShutdownBehaviorStop
+	}
+	return ec2.ShutdownBehaviorTerminate
+}
+
+// Find returns the running and stopped vms tagged with name
+func (p *awsProvider) Find(name string) ([]*Instance, error) {
+	return p.list(map[string]string{tagName: name})
+}
+
+func (p *awsProvider) List(owner string) ([]*Instance, error) {
+	tags := map[string]string{}
+	if owner != "" {
+		tags[tagOwner] = owner
+	}
+	return p.list(tags)
+}
+
+func (p *awsProvider) list(tags map[string]string) ([]*Instance, error) {
+	vms, err := p.findRunningVM(tags)
+	if err != nil {
+		return nil, err
+	}
+	var instances []*Instance
+	for _, vm := range vms {
+		instances = append(instances, toInstance(vm))
+	}
+	return instances, nil
 }
 
-func deleteSc() {
-	_, err := svc.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
-		GroupName: aws.String(instanceName),
+// Destroy terminates the vm, the security group is kept for the next one
+func (p *awsProvider) Destroy(id string) error {
+	if _, err := p.Status(id); err != nil {
+		return err
+	}
+	return p.terminate(id)
+}
+
+// Start boots the stopped vm
+func (p *awsProvider) Start(id string) error {
+	_, err := p.svc.StartInstances(&ec2.StartInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	})
+	return awsError("start instances", err)
+}
+
+// Stop shuts the vm down and returns once it is stopped, the ebs volume is kept
+func (p *awsProvider) Stop(id string) error {
+	_, err := p.svc.StopInstances(&ec2.StopInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
 	})
 	if err != nil {
-		switch err.(awserr.Error).Code() {
-		case "InvalidGroup.NotFound":
-			return
-		case "DependencyViolation":
-			log.Println("wait for vm to be delete")
-			time.Sleep(5 * time.Second)
-		default:
-			log.Fatalln(err.(awserr.Error).Code())
+		return awsError("stop instances", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+	defer cancel()
+	return p.Wait(ctx, id, StateStopped)
+}
+
+// Cleanup removes the security group, key pair and elastic ip of the deployment
+func (p *awsProvider) Cleanup(name string) error {
+	if err := p.deleteSc(name); err != nil {
+		return err
+	}
+	return p.releaseAddress(name)
+}
+
+// terminate returns once the vm is gone so its security group can be deleted
+func (p *awsProvider) terminate(id string) error {
+	input := &ec2.TerminateInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	}
+	if _, err := p.svc.TerminateInstances(input); err != nil {
+		return awsError("terminate instances", err)
+	}
+	// rollbacks terminate after ctx was cancelled, this wait has its own
+	ctx, cancel := context.WithTimeout(context.Background(), terminateTimeout)
+	defer cancel()
+	return p.Wait(ctx, id, StateTerminated)
+}
+
+// Wait uses the waiters of the sdk, polling as often as the other waits
+func (p *awsProvider) Wait(ctx context.Context, id, state string) error {
+	waiters := map[string]func(aws.Context, *ec2.DescribeInstancesInput, ...request.WaiterOption) error{
+		StateRunning:    p.svc.WaitUntilInstanceRunningWithContext,
+		StateStopped:    p.svc.WaitUntilInstanceStoppedWithContext,
+		StateTerminated: p.svc.WaitUntilInstanceTerminatedWithContext,
+	}
+	wait, ok := waiters[state]
+	if !ok {
+		return newError("wait", nil, fmt.Errorf("can not wait for %s", state))
+	}
+	name := "wait for vm " + state
+	progress := progressOf(ctx)
+	start := time.Now()
+	err := wait(ctx, &ec2.DescribeInstancesInput{InstanceIds: []*string{aws.String(id)}},
+		request.WithWaiterDelay(request.ConstantWaiterDelay(pollInterval)),
+		// no attempt limit, ctx bounds the wait
+		request.WithWaiterMaxAttempts(0),
+		request.WithWaiterRequestOptions(func(*request.Request) {
+			progress.Waiting(name, time.Since(start))
+		}),
+	)
+	if err != nil && ctx.Err() != nil {
+		return newError(name, nil, ctx.Err())
+	}
+	return awsError(name, err)
+}
+
+// Status describes the vm
+func (p *awsProvider) Status(id string) (*Instance, error) {
+	result, err := p.svc.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(id)},
+	})
+	if err != nil {
+		return nil, awsError("describe instances", err)
+	}
+	for _, reservation := range result.Reservations {
+		for _, vm := range reservation.Instances {
+			return toInstance(vm), nil
 		}
 	}
+	return nil, newError("describe instances", ErrNotFound, errors.New(id))
 }
 
-// create and start the interface
-func StartInstance() error {
-	// clear
-	vms := findRunningVM()
-	for _, vm := range vms {
-		svc.TerminateInstances(&ec2.TerminateInstancesInput{
-			InstanceIds: []*string{vm.InstanceId},
-		})
+// PublicIP returns the public ipv4 address of the vm
+func (p *awsProvider) PublicIP(id string) (net.IP, error) {
+	vm, err := p.Status(id)
+	if err != nil {
+		return nil, err
+	}
+	return vm.PublicIP, nil
+}
+
+// InjectSSHKey imports publicKey as the key pair named name, an existing
+// key pair is kept when it already holds the same key
+func (p *awsProvider) InjectSSHKey(name string, publicKey []byte) (bool, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return false, newError("import key pair", nil, err)
+	}
+	fingerprint, err := p.KeyFingerprint(name)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return false, err
+	}
+	if err == nil {
+		if keyMatches(key, fingerprint) {
+			return false, nil
+		}
+		log.Printf("replace key pair %s", name)
+		if err := p.deleteKey(name); err != nil {
+			return false, err
+		}
+	}
+	_, err = p.svc.ImportKeyPair(&ec2.ImportKeyPairInput{
+		KeyName:           aws.String(name),
+		PublicKeyMaterial: publicKey,
+	})
+	if err != nil {
+		return false, awsError("import key pair", err)
+	}
+	return true, nil
+}
+
+// KeyFingerprint returns the fingerprint aws computed for the key pair
+func (p *awsProvider) KeyFingerprint(name string) (string, error) {
+	keys, err := p.svc.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("key-name"),
+				Values: []*string{aws.String(name)},
+			},
+		},
+	})
+	if err != nil {
+		return "", awsError("describe key pairs", err)
+	}
+	if len(keys.KeyPairs) == 0 {
+		return "", newError("describe key pairs", ErrNotFound, errors.New(name))
 	}
+	return aws.StringValue(keys.KeyPairs[0].KeyFingerprint), nil
+}
 
-	// create security group
-	createSc()
+// HostKeys reads the host keys cloud-init printed to the console of the vm
+func (p *awsProvider) HostKeys(id string) ([]ssh.PublicKey, error) {
+	console, err := p.consoleOutput(id)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseConsoleHostKeys(console)
+	if err != nil && err != ErrNoHostKeys {
+		return nil, newError("get console output", nil, err)
+	}
+	return keys, err
+}
 
-	// set ssh client
-	auth := make([]ssh.AuthMethod, 0)
-	key := createKey()
-	log.Println("\n========================\n" + string(key))
-	signer, err := ssh.ParsePrivateKey(key)
+// TLSFingerprint reads the fingerprint the user data printed to the console
+// of the vm and keeps it in a tag
+func (p *awsProvider) TLSFingerprint(id string) (string, error) {
+	vm, err := p.Status(id)
+	if err != nil {
+		return "", err
+	}
+	if vm.TLSFingerprint != "" {
+		return vm.TLSFingerprint, nil
+	}
+	console, err := p.consoleOutput(id)
 	if err != nil {
-		log.Fatal(err)
-	}
-	auth = append(auth, ssh.PublicKeys(signer))
-	config := &ssh.ClientConfig{
-		// Change to your username
-		User:    "ubuntu",
-		Timeout: 10 * time.Second,
-		Auth:    auth,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			return nil
+		return "", err
+	}
+	fingerprint, err := parseConsoleTLSFingerprint(console)
+	if err == ErrNoTLSFingerprint {
+		return "", err
+	}
+	if err != nil {
+		return "", newError("get console output", nil, err)
+	}
+	_, err = p.svc.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags: []*ec2.Tag{
+			{
+				Key:   aws.String(tagTLSFingerprint),
+				Value: aws.String(fingerprint),
+			},
 		},
+	})
+	if err != nil {
+		return "", awsError("create tags", err)
 	}
+	return fingerprint, nil
+}
 
-	// start vm
-	runResult, err := svc.RunInstances(&ec2.RunInstancesInput{
-		ImageId:        aws.String("ami-0653e888ec96eab9b"),
-		InstanceType:   aws.String("t2.nano"),
-		MinCount:       aws.Int64(1),
-		MaxCount:       aws.Int64(1),
-		KeyName:        aws.String(instanceName),
-		SecurityGroups: []*string{aws.String(instanceName)},
+func (p *awsProvider) consoleOutput(id string) ([]byte, error) {
+	out, err := p.svc.GetConsoleOutput(&ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(id),
 	})
 	if err != nil {
-		log.Fatal(err)
-		return err
+		return nil, awsError("get console output", err)
+	}
+	console, err := base64.StdEncoding.DecodeString(aws.StringValue(out.Output))
+	if err != nil {
+		return nil, newError("get console output", nil, err)
 	}
+	return console, nil
+}
 
-	// add tags to the created instance
-	_, errtag := svc.CreateTags(&ec2.CreateTagsInput{
-		Resources: []*string{runResult.Instances[0].InstanceId},
+// RemoveSSHKey deletes the key pair
+func (p *awsProvider) RemoveSSHKey(name string) error {
+	return p.deleteKey(name)
+}
+
+// MarkReady flips the bootstrap tag of the vm
+func (p *awsProvider) MarkReady(id string) error {
+	_, err := p.svc.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
 		Tags: []*ec2.Tag{
 			{
-				Key:   aws.String("name"),
-				Value: aws.String(instanceName),
+				Key:   aws.String(tagBootstrap),
+				Value: aws.String(bootstrapDone),
 			},
 		},
 	})
-	if errtag != nil {
-		log.Fatal(errtag)
-	}
-	log.Printf("%s created\n", *runResult.Instances[0].InstanceId)
-
-	// init the vm with init script
-	var vm *ec2.Instance
-	for {
-		log.Println("waiting for vm start")
-		vms := findRunningVM()
-		if len(vms) >= 1 {
-			vm = vms[0]
-			break
+	return awsError("create tags", err)
+}
+
+// Orphans finds vms stuck in bootstrap and the security groups, elastic ips
+// and key pairs no live vm uses
+func (p *awsProvider) Orphans() ([]Resource, error) {
+	var orphans []Resource
+	usedGroups := map[string]bool{}
+	usedKeys := map[string]bool{}
+
+	err := p.svc.DescribeInstancesPages(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + tagManagedBy),
+				Values: []*string{aws.String(instanceName)},
+			},
+			liveFilter(),
+		},
+	}, func(page *ec2.DescribeInstancesOutput, last bool) bool {
+		for _, reservation := range page.Reservations {
+			for _, vm := range reservation.Instances {
+				instance := toInstance(vm)
+				if !instance.Ready && time.Since(instance.LaunchTime) > orphanAge {
+					orphans = append(orphans, Resource{Kind: KindInstance, ID: instance.ID, Name: instance.Name})
+					continue
+				}
+				for _, group := range vm.SecurityGroups {
+					usedGroups[aws.StringValue(group.GroupId)] = true
+				}
+				usedKeys[aws.StringValue(vm.KeyName)] = true
+			}
 		}
-		time.Sleep(5 * time.Second)
-	}
-	addr := *vm.PublicIpAddress + ":22"
-	log.Printf("connect to %s", addr)
-	var sshClient *ssh.Client
-	for {
-		sshClient, err = ssh.Dial("tcp", addr, config)
-		if err == nil {
-			break
+		return true
+	})
+	if err != nil {
+		return nil, awsError("describe instances", err)
+	}
+
+	groups, err := p.svc.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + tagManagedBy),
+				Values: []*string{aws.String(instanceName)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, awsError("describe security groups", err)
+	}
+	for _, group := range groups.SecurityGroups {
+		if !usedGroups[aws.StringValue(group.GroupId)] {
+			orphans = append(orphans, Resource{
+				Kind: KindSecurityGroup,
+				ID:   aws.StringValue(group.GroupId),
+				Name: aws.StringValue(group.GroupName),
+			})
 		}
-		log.Println(err)
-		log.Println("wait for ssh server starting")
-		time.Sleep(5 * time.Second)
 	}
 
-	session, err := sshClient.NewSession()
-	defer session.Close()
+	addresses, err := p.svc.DescribeAddresses(&ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + tagManagedBy),
+				Values: []*string{aws.String(instanceName)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, awsError("describe addresses", err)
+	}
+	for _, address := range addresses.Addresses {
+		if address.AssociationId == nil {
+			orphans = append(orphans, Resource{
+				Kind: KindAddress,
+				ID:   aws.StringValue(address.AllocationId),
+				Name: aws.StringValue(address.PublicIp),
+			})
+		}
+	}
 
-	session.Stdout = os.Stdout
-	session.Stderr = os.Stderr
-	session.Stdin = os.Stdin
+	// key pairs can not be tagged, they are recognized by name
+	keys, err := p.svc.DescribeKeyPairs(&ec2.DescribeKeyPairsInput{})
+	if err != nil {
+		return nil, awsError("describe key pairs", err)
+	}
+	for _, key := range keys.KeyPairs {
+		name := aws.StringValue(key.KeyName)
+		if isManagedName(name) && !usedKeys[name] {
+			orphans = append(orphans, Resource{Kind: KindKeyPair, ID: name, Name: name})
+		}
+	}
+	return orphans, nil
+}
 
-	log.Println("run command")
-	err = session.Run(command)
+// RemoveOrphan deletes a resource found by Orphans
+func (p *awsProvider) RemoveOrphan(r Resource) error {
+	switch r.Kind {
+	case KindInstance:
+		return p.terminate(r.ID)
+	case KindSecurityGroup:
+		_, err := p.svc.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
+			GroupId: aws.String(r.ID),
+		})
+		return awsError("delete security group", err)
+	case KindKeyPair:
+		return p.deleteKey(r.ID)
+	case KindAddress:
+		_, err := p.svc.ReleaseAddress(&ec2.ReleaseAddressInput{
+			AllocationId: aws.String(r.ID),
+		})
+		return awsError("release address", err)
+	}
+	return newError("remove orphan", nil, errors.New("unknown resource kind "+r.Kind))
+}
 
-	if err != nil {
-		log.Panic(err)
+func managedTags(name string) []*ec2.Tag {
+	return []*ec2.Tag{
+		{
+			Key:   aws.String(tagName),
+			Value: aws.String(name),
+		},
+		{
+			Key:   aws.String(tagManagedBy),
+			Value: aws.String(instanceName),
+		},
 	}
-	return nil
 }
 
-// get vm running status
-func StatusInstance() {
-	vms := findRunningVM()
-	for _, vm := range vms {
-		log.Printf("%s %s %s \n", *vm.InstanceId, *vm.State.Name, *vm.PublicIpAddress)
+func toInstance(vm *ec2.Instance) *Instance {
+	instance := &Instance{
+		ID:         aws.StringValue(vm.InstanceId),
+		PublicIP:   net.ParseIP(aws.StringValue(vm.PublicIpAddress)),
+		LaunchTime: aws.TimeValue(vm.LaunchTime),
+		Type:       aws.StringValue(vm.InstanceType),
+		KeyName:    aws.StringValue(vm.KeyName),
+	}
+	if vm.State != nil {
+		instance.State = aws.StringValue(vm.State.Name)
+	}
+	if vm.Placement != nil {
+		instance.Zone = aws.StringValue(vm.Placement.AvailabilityZone)
 	}
+	instance.Spot = aws.StringValue(vm.InstanceLifecycle) == ec2.InstanceLifecycleTypeSpot
+	if vm.StateReason != nil {
+		switch aws.StringValue(vm.StateReason.Code) {
+		case "Server.SpotInstanceTermination", "Server.SpotInstanceShutdown":
+			instance.Interrupted = true
+		}
+	}
+	for _, tag := range vm.Tags {
+		switch aws.StringValue(tag.Key) {
+		case tagName:
+			instance.Name = aws.StringValue(tag.Value)
+		case tagBootstrap:
+			instance.Ready = aws.StringValue(tag.Value) == bootstrapDone
+		case tagRegion:
+			instance.Region = aws.StringValue(tag.Value)
+		case tagOwner:
+			instance.Owner = aws.StringValue(tag.Value)
+		case tagDeploy:
+			instance.Deployment = aws.StringValue(tag.Value)
+		case tagTLSFingerprint:
+			instance.TLSFingerprint = aws.StringValue(tag.Value)
+		}
+	}
+	// vms from before the region tag, the zone is the region and a letter
+	if instance.Region == "" && len(instance.Zone) > 1 {
+		instance.Region = instance.Zone[:len(instance.Zone)-1]
+	}
+	return instance
 }
 
-// stio and delete interface
-func StopInstance() {
-	deleteKey()
-	vms := findRunningVM()
-	for _, vm := range vms {
-		svc.TerminateInstances(&ec2.TerminateInstancesInput{
-			InstanceIds: []*string{vm.InstanceId},
-		})
-		log.Printf("%s stopped\n", *vm.InstanceId)
+// fromIPPermissions flattens the permissions into one rule per port and network
+func fromIPPermissions(perms []*ec2.IpPermission) []Rule {
+	var rules []Rule
+	for _, perm := range perms {
+		protocol := aws.StringValue(perm.IpProtocol)
+		port := int(aws.Int64Value(perm.FromPort))
+		for _, r := range perm.IpRanges {
+			rules = append(rules, Rule{Protocol: protocol, Port: port, CIDR: aws.StringValue(r.CidrIp)})
+		}
+		for _, r := range perm.Ipv6Ranges {
+			rules = append(rules, Rule{Protocol: protocol, Port: port, CIDR: aws.StringValue(r.CidrIpv6)})
+		}
+	}
+	return rules
+}
+
+func toIPPermissions(rules []Rule) []*ec2.IpPermission {
+	var perms []*ec2.IpPermission
+	for _, r := range rules {
+		perm := (&ec2.IpPermission{}).SetIpProtocol(r.Protocol)
+		// "-1" is every protocol and port
+		if r.Protocol != "-1" {
+			perm.SetFromPort(int64(r.Port)).SetToPort(int64(r.Port))
+		}
+		if r.IPv6() {
+			perm.SetIpv6Ranges([]*ec2.Ipv6Range{{CidrIpv6: aws.String(r.CIDR)}})
+		} else {
+			perm.SetIpRanges([]*ec2.IpRange{{CidrIp: aws.String(r.CIDR)}})
+		}
+		perms = append(perms, perm)
 	}
-	deleteSc()
+	return perms
 }
@@ -0,0 +1,93 @@
+package vps
+
+import (
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// findAddress returns the elastic ip allocated for the deployment name, or nil
+func (p *awsProvider) findAddress(name string) (*ec2.Address, error) {
+	result, err := p.svc.DescribeAddresses(&ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + tagName),
+				Values: []*string{aws.String(name)},
+			},
+			{
+				Name:   aws.String("tag:" + tagManagedBy),
+				Values: []*string{aws.String(instanceName)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, awsError("describe addresses", err)
+	}
+	if len(result.Addresses) == 0 {
+		return nil, nil
+	}
+	return result.Addresses[0], nil
+}
+
+// AttachStaticIP associates the elastic ip of the deployment with the vm,
+// allocating it on first use
+func (p *awsProvider) AttachStaticIP(id string) (net.IP, error) {
+	vm, err := p.Status(id)
+	if err != nil {
+		return nil, err
+	}
+	address, err := p.findAddress(vm.Name)
+	if err != nil {
+		return nil, err
+	}
+	if address == nil {
+		allocated, err := p.svc.AllocateAddress(&ec2.AllocateAddressInput{
+			Domain: aws.String(ec2.DomainTypeVpc),
+		})
+		if err != nil {
+			return nil, awsError("allocate address", err)
+		}
+		_, err = p.svc.CreateTags(&ec2.CreateTagsInput{
+			Resources: []*string{allocated.AllocationId},
+			Tags:      managedTags(vm.Name),
+		})
+		if err != nil {
+			p.svc.ReleaseAddress(&ec2.ReleaseAddressInput{AllocationId: allocated.AllocationId})
+			return nil, awsError("create tags", err)
+		}
+		address = &ec2.Address{AllocationId: allocated.AllocationId, PublicIp: allocated.PublicIp}
+	}
+	ip := net.ParseIP(aws.StringValue(address.PublicIp))
+	if aws.StringValue(address.InstanceId) == id {
+		return ip, nil
+	}
+	_, err = p.svc.AssociateAddress(&ec2.AssociateAddressInput{
+		AllocationId: address.AllocationId,
+		InstanceId:   aws.String(id),
+	})
+	if err != nil {
+		return nil, awsError("associate address", err)
+	}
+	return ip, nil
+}
+
+// releaseAddress gives the elastic ip of the deployment back
+func (p *awsProvider) releaseAddress(name string) error {
+	address, err := p.findAddress(name)
+	if err != nil || address == nil {
+		return err
+	}
+	if address.AssociationId != nil {
+		_, err = p.svc.DisassociateAddress(&ec2.DisassociateAddressInput{
+			AssociationId: address.AssociationId,
+		})
+		if err != nil {
+			return awsError("disassociate address", err)
+		}
+	}
+	_, err = p.svc.ReleaseAddress(&ec2.ReleaseAddressInput{
+		AllocationId: address.AllocationId,
+	})
+	return awsError("release address", err)
+}
@@ -0,0 +1,91 @@
+package vps
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// images are looked up again once a day to pick up security updates
+const imageCacheTTL = 24 * time.Hour
+
+type awsImage struct {
+	owner string
+	// name pattern, formatted with the architecture as named by the publisher
+	name  string
+	archs map[string]string
+}
+
+var awsImages = map[string]awsImage{
+	ImageUbuntu: {
+		owner: "099720109477",
+		name:  "ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-%s-server-*",
+		archs: map[string]string{ArchAMD64: "amd64", ArchARM64: "arm64"},
+	},
+	ImageDebian: {
+		owner: "136693071363",
+		name:  "debian-12-%s-*",
+		archs: map[string]string{ArchAMD64: "amd64", ArchARM64: "arm64"},
+	},
+	ImageAmazonLinux: {
+		owner: "137112412989",
+		name:  "al2023-ami-2023.*-kernel-*-%s",
+		archs: map[string]string{ArchAMD64: "x86_64", ArchARM64: "arm64"},
+	},
+}
+
+// ec2 names of the architectures
+var awsArchs = map[string]string{
+	ArchAMD64: ec2.ArchitectureValuesX8664,
+	ArchARM64: ec2.ArchitectureValuesArm64,
+}
+
+// imageID returns the newest image of the os and architecture in the region
+func (p *awsProvider) imageID() (string, error) {
+	distro, arch := imageOf(p.cfg), archOf(p.cfg)
+	key := fmt.Sprintf("aws/image/%s/%s/%s", p.region, distro, arch)
+	return cached(key, imageCacheTTL, func() (string, error) {
+		return p.lookupImage(distro, arch)
+	})
+}
+
+func (p *awsProvider) lookupImage(distro, arch string) (string, error) {
+	image, ok := awsImages[distro]
+	if !ok {
+		return "", newError("describe images", nil, fmt.Errorf("no aws image for %s", distro))
+	}
+	result, err := p.svc.DescribeImages(&ec2.DescribeImagesInput{
+		Owners: []*string{aws.String(image.owner)},
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("name"),
+				Values: []*string{aws.String(fmt.Sprintf(image.name, image.archs[arch]))},
+			},
+			{
+				Name:   aws.String("architecture"),
+				Values: []*string{aws.String(awsArchs[arch])},
+			},
+			{
+				Name:   aws.String("state"),
+				Values: []*string{aws.String(ec2.ImageStateAvailable)},
+			},
+		},
+	})
+	if err != nil {
+		return "", awsError("describe images", err)
+	}
+
+	// the creation dates are ISO 8601 and compare as strings
+	var newest *ec2.Image
+	for _, img := range result.Images {
+		if newest == nil || aws.StringValue(img.CreationDate) > aws.StringValue(newest.CreationDate) {
+			newest = img
+		}
+	}
+	if newest == nil {
+		return "", newError("describe images", nil, fmt.Errorf("no %s %s image in %s", distro, arch, p.region))
+	}
+	return aws.StringValue(newest.ImageId), nil
+}
@@ -0,0 +1,32 @@
+package vps
+
+// regions enabled on every aws account, opt-in regions have to be named
+var awsRegions = []Region{
+	{Name: "us-east-1", Country: "US"},
+	{Name: "us-east-2", Country: "US"},
+	{Name: "us-west-1", Country: "US"},
+	{Name: "us-west-2", Country: "US"},
+	{Name: "ca-central-1", Country: "CA"},
+	{Name: "sa-east-1", Country: "BR"},
+	{Name: "eu-west-1", Country: "IE"},
+	{Name: "eu-west-2", Country: "GB"},
+	{Name: "eu-west-3", Country: "FR"},
+	{Name: "eu-central-1", Country: "DE"},
+	{Name: "eu-north-1", Country: "SE"},
+	{Name: "ap-northeast-1", Country: "JP"},
+	{Name: "ap-northeast-2", Country: "KR"},
+	{Name: "ap-northeast-3", Country: "JP"},
+	{Name: "ap-southeast-1", Country: "SG"},
+	{Name: "ap-southeast-2", Country: "AU"},
+	{Name: "ap-south-1", Country: "IN"},
+}
+
+// Regions lists the regions with the ec2 api endpoint to probe
+func (p *awsProvider) Regions() []Region {
+	regions := make([]Region, len(awsRegions))
+	for i, r := range awsRegions {
+		r.Endpoint = "ec2." + r.Name + ".amazonaws.com:443"
+		regions[i] = r
+	}
+	return regions
+}
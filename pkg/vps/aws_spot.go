@@ -0,0 +1,162 @@
+package vps
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	// the instance metadata service as seen from inside the vm
+	metadataURL        = "http://169.254.169.254/latest"
+	spotPollInterval   = 5 * time.Second
+	metadataTokenTTL   = "21600"
+	metadataTokenRenew = time.Hour
+)
+
+// spotUnavailable tells if RunInstances failed for lack of spot capacity,
+// on-demand may still work then
+func spotUnavailable(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch aerr.Code() {
+	case "InsufficientInstanceCapacity", "SpotMaxPriceTooLow",
+		"MaxSpotInstanceCountExceeded", "UnfulfillableCapacity":
+		return true
+	}
+	return false
+}
+
+// spotOptions asks for a one-time spot vm capped at the max price, the
+// on-demand price when empty
+func spotOptions(maxPrice string) *ec2.InstanceMarketOptionsRequest {
+	options := &ec2.SpotMarketOptions{
+		SpotInstanceType:             aws.String(ec2.SpotInstanceTypeOneTime),
+		InstanceInterruptionBehavior: aws.String(ec2.InstanceInterruptionBehaviorTerminate),
+	}
+	if maxPrice != "" {
+		options.MaxPrice = aws.String(maxPrice)
+	}
+	return &ec2.InstanceMarketOptionsRequest{
+		MarketType:  aws.String(ec2.MarketTypeSpot),
+		SpotOptions: options,
+	}
+}
+
+// pickZone returns the availability zone to launch in, "" lets aws choose
+func (p *awsProvider) pickZone() (string, error) {
+	avoid := map[string]bool{}
+	for _, zone := range p.cfg.AvoidZones {
+		avoid[zone] = true
+	}
+	if p.cfg.Zone != "" && !avoid[p.cfg.Zone] {
+		return p.cfg.Zone, nil
+	}
+	if len(avoid) == 0 {
+		return "", nil
+	}
+
+	result, err := p.svc.DescribeAvailabilityZones(&ec2.DescribeAvailabilityZonesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("state"),
+				Values: []*string{aws.String(ec2.AvailabilityZoneStateAvailable)},
+			},
+		},
+	})
+	if err != nil {
+		return "", awsError("describe availability zones", err)
+	}
+	for _, zone := range result.AvailabilityZones {
+		if name := aws.StringValue(zone.ZoneName); !avoid[name] {
+			return name, nil
+		}
+	}
+	// every zone failed once, start over
+	return "", nil
+}
+
+// WatchSpotInterruption polls the metadata of the vm it runs on and calls
+// notice with the termination time once aws announced the interruption, it
+// returns when ctx is done or after notice
+func WatchSpotInterruption(ctx context.Context, notice func(at time.Time)) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	var token string
+	var tokenTime time.Time
+	ticker := time.NewTicker(spotPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if time.Since(tokenTime) > metadataTokenRenew {
+			t, err := metadataToken(client)
+			if err != nil {
+				log.Printf("instance metadata token: %s", err)
+				continue
+			}
+			token, tokenTime = t, time.Now()
+		}
+		req, err := http.NewRequest(http.MethodGet, metadataURL+"/meta-data/spot/instance-action", nil)
+		if err != nil {
+			continue
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		// 404 until an interruption is scheduled
+		if err != nil || resp.StatusCode != http.StatusOK {
+			continue
+		}
+		var action struct {
+			Action string    `json:"action"`
+			Time   time.Time `json:"time"`
+		}
+		if err = json.Unmarshal(body, &action); err != nil {
+			log.Printf("bad spot instance action %q: %s", body, err)
+			continue
+		}
+		notice(action.Time)
+		return
+	}
+}
+
+// metadataToken opens an IMDSv2 session
+func metadataToken(client *http.Client) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, metadataURL+"/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", metadataTokenTTL)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", newError("metadata token", nil, errors.New(resp.Status))
+	}
+	return string(body), nil
+}
@@ -0,0 +1,298 @@
+package vps
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestShutdownBehavior(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"on-demand", Config{}, ec2.ShutdownBehaviorTerminate},
+		{"spot", Config{Spot: true}, ec2.ShutdownBehaviorTerminate},
+		{"kept", Config{KeepStopped: true}, ec2.ShutdownBehaviorStop},
+		// rejected by Validate, a poweroff still must not leave it around
+		{"kept spot", Config{Spot: true, KeepStopped: true}, ec2.ShutdownBehaviorTerminate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shutdownBehavior(&tt.cfg); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// the server powers a spot vm off at its max lifetime, a persistent request
+// would launch it again
+func TestSpotOptionsOneTime(t *testing.T) {
+	for _, maxPrice := range []string{"", "0.003"} {
+		options := spotOptions(maxPrice)
+		if got := aws.StringValue(options.MarketType); got != ec2.MarketTypeSpot {
+			t.Errorf("market %s, want spot", got)
+		}
+		spot := options.SpotOptions
+		if got := aws.StringValue(spot.SpotInstanceType); got != ec2.SpotInstanceTypeOneTime {
+			t.Errorf("spot request is %s, want one-time", got)
+		}
+		if got := aws.StringValue(spot.InstanceInterruptionBehavior); got != ec2.InstanceInterruptionBehaviorTerminate {
+			t.Errorf("interruption %s, want terminate", got)
+		}
+		if got := aws.StringValue(spot.MaxPrice); got != maxPrice {
+			t.Errorf("max price %q, want %q", got, maxPrice)
+		}
+	}
+}
+
+// stubEC2 returns a provider talking to handler instead of aws
+func stubEC2(t *testing.T, handler http.HandlerFunc) *awsProvider {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String(defaultRegion),
+		Endpoint:    aws.String(srv.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &awsProvider{svc: ec2.New(sess), region: defaultRegion, cfg: &Config{}}
+}
+
+func TestDefaultVPC(t *testing.T) {
+	tests := []struct {
+		name    string
+		vpcs    []string
+		want    string
+		wantErr string
+	}{
+		{"default", []string{"vpc-1"}, "vpc-1", ""},
+		{"none", nil, "", "no default vpc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := stubEC2(t, func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				if got := r.Form.Get("Action"); got != "DescribeVpcs" {
+					t.Errorf("action %s", got)
+				}
+				if r.Form.Get("Filter.1.Name") != "isDefault" || r.Form.Get("Filter.1.Value.1") != "true" {
+					t.Errorf("vpcs not filtered on isDefault: %v", r.Form)
+				}
+				var items strings.Builder
+				for _, id := range tt.vpcs {
+					fmt.Fprintf(&items, "<item><vpcId>%s</vpcId><isDefault>true</isDefault></item>", id)
+				}
+				fmt.Fprintf(w, `<DescribeVpcsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><vpcSet>%s</vpcSet></DescribeVpcsResponse>`, items.String())
+			})
+			got, err := p.defaultVPC()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupImageNewest(t *testing.T) {
+	p := stubEC2(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if got := r.Form.Get("Owner.1"); got != awsImages[ImageDebian].owner {
+			t.Errorf("owner %s", got)
+		}
+		if got := r.Form.Get("Filter.1.Value.1"); got != "debian-12-arm64-*" {
+			t.Errorf("name filter %s", got)
+		}
+		fmt.Fprint(w, `<DescribeImagesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><imagesSet>
+<item><imageId>ami-old</imageId><creationDate>2023-06-01T00:00:00.000Z</creationDate></item>
+<item><imageId>ami-new</imageId><creationDate>2024-02-01T00:00:00.000Z</creationDate></item>
+<item><imageId>ami-mid</imageId><creationDate>2023-12-01T00:00:00.000Z</creationDate></item>
+</imagesSet></DescribeImagesResponse>`)
+	})
+	got, err := p.lookupImage(ImageDebian, ArchARM64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "ami-new" {
+		t.Errorf("got %s, want ami-new", got)
+	}
+}
+
+func TestSpotUnavailable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{awserr.New("InsufficientInstanceCapacity", "", nil), true},
+		{awserr.New("SpotMaxPriceTooLow", "", nil), true},
+		{awserr.New("UnfulfillableCapacity", "", nil), true},
+		{awserr.New("InstanceLimitExceeded", "", nil), false},
+		{awserr.New("AuthFailure", "", nil), false},
+		{errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		if got := spotUnavailable(tt.err); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+const ec2Response = `<%[1]sResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">%[2]s</%[1]sResponse>`
+
+// stubLaunch answers the calls Create makes, runInstances answers the launches
+func stubLaunch(t *testing.T, runInstances func(form url.Values) (int, string)) *awsProvider {
+	p := stubEC2(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		action := r.Form.Get("Action")
+		var body string
+		switch action {
+		case "DescribeVpcs":
+			body = "<vpcSet><item><vpcId>vpc-1</vpcId></item></vpcSet>"
+		case "DescribeSecurityGroups":
+			body = "<securityGroupInfo><item><groupId>sg-1</groupId><vpcId>vpc-1</vpcId></item></securityGroupInfo>"
+		case "DescribeImages":
+			body = "<imagesSet><item><imageId>ami-1</imageId><creationDate>2024-01-01T00:00:00.000Z</creationDate></item></imagesSet>"
+		case "RunInstances":
+			status, reply := runInstances(r.Form)
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				fmt.Fprint(w, reply)
+				return
+			}
+			body = reply
+		}
+		fmt.Fprintf(w, ec2Response, action, body)
+	})
+	p.cfg = &Config{Spot: true, SSHCIDR: "198.51.100.7/32"}
+	return p
+}
+
+func TestCreateSpotFallsBackToOnDemand(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	var markets []string
+	p := stubLaunch(t, func(form url.Values) (int, string) {
+		market := form.Get("InstanceMarketOptions.MarketType")
+		markets = append(markets, market)
+		if market == ec2.MarketTypeSpot {
+			return http.StatusBadRequest, `<Response><Errors><Error><Code>InsufficientInstanceCapacity</Code><Message>no spot capacity</Message></Error></Errors><RequestID>1</RequestID></Response>`
+		}
+		return http.StatusOK, "<instancesSet><item><instanceId>i-1</instanceId><instanceState><name>pending</name></instanceState></item></instancesSet>"
+	})
+	vm, err := p.Create("fastvpn-test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.ID != "i-1" || vm.Spot {
+		t.Errorf("got %s, spot %v", vm.ID, vm.Spot)
+	}
+	if len(markets) != 2 || markets[0] != ec2.MarketTypeSpot || markets[1] != "" {
+		t.Errorf("launched as %q, want spot then on-demand", markets)
+	}
+}
+
+func TestCreateSpotKeepsOtherErrors(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	launches := 0
+	p := stubLaunch(t, func(form url.Values) (int, string) {
+		launches++
+		return http.StatusBadRequest, `<Response><Errors><Error><Code>VcpuLimitExceeded</Code><Message>limit</Message></Error></Errors><RequestID>1</RequestID></Response>`
+	})
+	_, err := p.Create("fastvpn-test", nil)
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("got %v, want quota exceeded", err)
+	}
+	if launches != 1 {
+		t.Errorf("launched %d times, want no on-demand retry", launches)
+	}
+}
+
+func TestFindRunningVMPages(t *testing.T) {
+	pages := []string{
+		`<reservationSet><item><instancesSet><item><instanceId>i-1</instanceId></item><item><instanceId>i-2</instanceId></item></instancesSet></item></reservationSet><nextToken>page-2</nextToken>`,
+		`<reservationSet><item><instancesSet><item><instanceId>i-3</instanceId></item></instancesSet></item><item><instancesSet><item><instanceId>i-4</instanceId></item></instancesSet></item></reservationSet>`,
+	}
+	p := stubEC2(t, func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		filters := map[string][]string{}
+		for i := 1; r.Form.Get(fmt.Sprintf("Filter.%d.Name", i)) != ""; i++ {
+			name := r.Form.Get(fmt.Sprintf("Filter.%d.Name", i))
+			for j := 1; r.Form.Get(fmt.Sprintf("Filter.%d.Value.%d", i, j)) != ""; j++ {
+				filters[name] = append(filters[name], r.Form.Get(fmt.Sprintf("Filter.%d.Value.%d", i, j)))
+			}
+		}
+		if got := filters["tag:"+tagManagedBy]; len(got) != 1 || got[0] != instanceName {
+			t.Errorf("managed by filter %v", got)
+		}
+		if got := filters["tag:"+tagOwner]; len(got) != 1 || got[0] != "alice" {
+			t.Errorf("owner filter %v", got)
+		}
+		if got := filters["instance-state-name"]; len(got) != 4 {
+			t.Errorf("state filter %v", got)
+		}
+		page := pages[0]
+		if r.Form.Get("NextToken") == "page-2" {
+			page = pages[1]
+		}
+		fmt.Fprintf(w, ec2Response, "DescribeInstances", page)
+	})
+	vms, err := p.findRunningVM(map[string]string{tagOwner: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, vm := range vms {
+		got = append(got, aws.StringValue(vm.InstanceId))
+	}
+	if strings.Join(got, ",") != "i-1,i-2,i-3,i-4" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestToInstance(t *testing.T) {
+	vm := toInstance(&ec2.Instance{
+		InstanceId:        aws.String("i-1"),
+		State:             &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameStopping)},
+		Placement:         &ec2.Placement{AvailabilityZone: aws.String("eu-west-3b")},
+		InstanceLifecycle: aws.String(ec2.InstanceLifecycleTypeSpot),
+		StateReason:       &ec2.StateReason{Code: aws.String("Server.SpotInstanceTermination")},
+		Tags: []*ec2.Tag{
+			{Key: aws.String(tagName), Value: aws.String("fastvpn-alice-tokyo")},
+			{Key: aws.String(tagOwner), Value: aws.String("alice")},
+			{Key: aws.String(tagDeploy), Value: aws.String("tokyo")},
+			{Key: aws.String(tagBootstrap), Value: aws.String(bootstrapDone)},
+		},
+	})
+	want := Instance{
+		ID: "i-1", Name: "fastvpn-alice-tokyo", State: StateStopping, Zone: "eu-west-3b",
+		Region: "eu-west-3", Owner: "alice", Deployment: "tokyo",
+		Ready: true, Spot: true, Interrupted: true,
+	}
+	if vm.ID != want.ID || vm.Name != want.Name || vm.State != want.State || vm.Zone != want.Zone ||
+		vm.Region != want.Region || vm.Owner != want.Owner || vm.Deployment != want.Deployment ||
+		vm.Ready != want.Ready || vm.Spot != want.Spot || vm.Interrupted != want.Interrupted {
+		t.Errorf("got %+v\nwant %+v", *vm, want)
+	}
+}
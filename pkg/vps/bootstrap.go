@@ -0,0 +1,293 @@
+package vps
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// where the server runs inside the vm
+const (
+	serverBinary  = "/usr/local/bin/fastvpn"
+	serverNetwork = "192.168.45.1/24"
+	serverDev     = "tun1"
+	// kept on the disk, so a kept vm counts on after a restart
+	serverStatsFile = "/var/lib/fastvpn/stats.json"
+)
+
+// default limits after which the vm shuts itself down to cap the cost
+const (
+	DefaultIdleTimeout = 30 * time.Minute
+	DefaultMaxLifetime = 24 * time.Hour
+)
+
+// userDataTemplate is run by cloud-init on the first boot, it writes the
+// server config and systemd unit, makes the tls certificate and prints its
+// fingerprint to the console, and installs the server when it can be
+// downloaded. Forwarding and the nat of the vpn network are set up again on
+// every boot, a kept vm is restarted.
+var userDataTemplate = template.Must(template.New("user-data").Parse(`#!/bin/sh
+set -e
+cat > /etc/sysctl.d/99-fastvpn.conf <<'EOF'
+net.ipv4.ip_forward=1
+EOF
+sysctl -p /etc/sysctl.d/99-fastvpn.conf
+mkdir -p /etc/fastvpn
+cat > /etc/fastvpn/nat.sh <<'EOF'
+#!/bin/sh
+# masquerades the vpn network out of the default interface
+set -e
+dev=$(ip -4 route show default | awk '{print $5; exit}')
+if command -v iptables >/dev/null; then
+	iptables -t nat -C POSTROUTING -s {{.NATNetwork}} -o "$dev" -j MASQUERADE 2>/dev/null ||
+		iptables -t nat -A POSTROUTING -s {{.NATNetwork}} -o "$dev" -j MASQUERADE
+else
+	nft delete table ip fastvpn 2>/dev/null || true
+	nft add table ip fastvpn
+	nft add chain ip fastvpn postrouting '{ type nat hook postrouting priority 100 ; }'
+	nft add rule ip fastvpn postrouting ip saddr {{.NATNetwork}} oifname "$dev" masquerade
+fi
+EOF
+chmod 755 /etc/fastvpn/nat.sh
+{{- if .TLS}}
+if [ ! -f {{.TLSKey}} ]; then
+	(umask 077; openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:prime256v1 -nodes \
+		-days 3650 -subj /CN=fastvpn -keyout {{.TLSKey}} -out {{.TLSCert}})
+fi
+echo '{{.TLSBegin}}'
+openssl x509 -in {{.TLSCert}} -outform der | sha256sum | cut -d' ' -f1
+echo '{{.TLSEnd}}'
+{{- end}}
+cat > /etc/fastvpn/server.env <<'EOF'
+FASTVPN_LISTEN=0.0.0.0
+FASTVPN_PORT={{.Port}}
+FASTVPN_TRANSPORT={{.Transport}}
+FASTVPN_NETWORK={{.Network}}
+FASTVPN_DEV={{.Dev}}
+FASTVPN_IDLE_TIMEOUT={{.IdleTimeout}}
+FASTVPN_MAX_LIFETIME={{.MaxLifetime}}
+FASTVPN_SPOT={{.Spot}}
+FASTVPN_STATS_FILE={{.StatsFile}}
+FASTVPN_SHUTDOWN_COMMAND=systemctl poweroff
+{{- if .TLS}}
+FASTVPN_TLS_CERT={{.TLSCert}}
+FASTVPN_TLS_KEY={{.TLSKey}}
+{{- end}}
+EOF
+chmod 600 /etc/fastvpn/server.env
+cat > /etc/systemd/system/fastvpn.service <<'EOF'
+[Unit]
+Description=fastvpn server
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+EnvironmentFile=/etc/fastvpn/server.env
+ExecStartPre=/etc/fastvpn/nat.sh
+ExecStart={{.Binary}} server
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+EOF
+systemctl daemon-reload
+{{- if .URL}}
+curl -fsSL -o {{.Binary}}.download '{{.URL}}'
+echo '{{.SHA256}}  {{.Binary}}.download' | sha256sum -c -
+install -m 0755 {{.Binary}}.download {{.Binary}}
+rm {{.Binary}}.download
+systemctl enable --now fastvpn
+{{- end}}
+`))
+
+// userData renders the first boot script of the vm
+func userData(cfg *Config) ([]byte, error) {
+	if cfg.ServerURL != "" {
+		if strings.ContainsAny(cfg.ServerURL, "'\n") {
+			return nil, newError("user data", nil, fmt.Errorf("bad server url %q", cfg.ServerURL))
+		}
+		if _, err := hex.DecodeString(cfg.ServerSHA256); err != nil || len(cfg.ServerSHA256) != sha256.Size*2 {
+			return nil, newError("user data", nil, errors.New("the server url needs the sha256 of the binary"))
+		}
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	transport := cfg.Transport
+	if transport == "" {
+		transport = DefaultTransport
+	}
+
+	_, natNetwork, err := net.ParseCIDR(serverNetwork)
+	if err != nil {
+		return nil, newError("user data", nil, err)
+	}
+
+	var buf bytes.Buffer
+	err = userDataTemplate.Execute(&buf, map[string]interface{}{
+		"Port":    port,
+		"Network": serverNetwork,
+		"Dev":     serverDev,
+		"Binary":  serverBinary,
+		"URL":     cfg.ServerURL,
+		"SHA256":  strings.ToLower(cfg.ServerSHA256),
+
+		"IdleTimeout": cfg.IdleTimeout,
+		"MaxLifetime": cfg.MaxLifetime,
+		"Spot":        cfg.Spot,
+		"StatsFile":   serverStatsFile,
+		"Transport":   transport,
+
+		"NATNetwork": natNetwork.String(),
+
+		"TLS":      usesTLS(cfg),
+		"TLSCert":  serverTLSCert,
+		"TLSKey":   serverTLSKey,
+		"TLSBegin": tlsFingerprintBegin,
+		"TLSEnd":   tlsFingerprintEnd,
+	})
+	if err != nil {
+		return nil, newError("user data", nil, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// remote reaches the vms to finish their bootstrap and read their stats, over
+// ssh and tcp unless the provider implements it, like the fake one whose vms
+// are not on the network
+type remote interface {
+	// uploadServer copies the server binary at path to the vm and starts it
+	uploadServer(ctx context.Context, vm *Instance, user string, signer ssh.Signer, path string) error
+	// probeServer returns once the vpn server of the vm accepts connections
+	probeServer(ctx context.Context, vm *Instance, cfg *Config) error
+	// readStats returns the traffic counters the server keeps on the vm
+	readStats(ctx context.Context, vm *Instance, user string, signer ssh.Signer) (*serverStats, error)
+}
+
+func remoteOf(p Provider) remote {
+	if r, ok := p.(remote); ok {
+		return r
+	}
+	return netRemote{p: p}
+}
+
+// netRemote reaches the vms of p on their public address
+type netRemote struct {
+	p Provider
+}
+
+func (r netRemote) uploadServer(ctx context.Context, vm *Instance, user string, signer ssh.Signer, path string) error {
+	var client *ssh.Client
+	err := stage(ctx, "connect over ssh", func() (err error) {
+		client, err = dialSSH(ctx, r.p, vm, user, signer)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return stage(ctx, "upload server", func() error { return uploadServer(client, path) })
+}
+
+func (r netRemote) probeServer(ctx context.Context, vm *Instance, cfg *Config) error {
+	return probeServer(ctx, vm.PublicIP, cfg)
+}
+
+func (r netRemote) readStats(ctx context.Context, vm *Instance, user string, signer ssh.Signer) (*serverStats, error) {
+	return readServerStats(ctx, r.p, vm, user, signer)
+}
+
+// localServerBinary returns the binary to upload, by default the running one
+func localServerBinary(cfg *Config) (string, error) {
+	if cfg.ServerBinary != "" {
+		return cfg.ServerBinary, nil
+	}
+	arch := archOf(cfg)
+	if runtime.GOOS != "linux" || runtime.GOARCH != arch {
+		return "", newError("server binary", nil,
+			fmt.Errorf("this binary is for %s/%s, give a linux/%s server binary or url", runtime.GOOS, runtime.GOARCH, arch))
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return "", newError("server binary", nil, err)
+	}
+	return path, nil
+}
+
+// uploadServer copies the server binary to the vm and starts it once cloud-init is done
+func uploadServer(client *ssh.Client, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return newError("upload server", nil, err)
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return newError("upload server", nil, err)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return newError("upload server", nil, err)
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return newError("ssh session", ErrSSHUnreachable, err)
+	}
+	defer session.Close()
+	var stderr bytes.Buffer
+	session.Stdin = f
+	session.Stderr = &stderr
+
+	tmp := serverBinary + ".upload"
+	command := strings.Join([]string{
+		"cloud-init status --wait >/dev/null",
+		"cat > " + tmp,
+		"echo \"" + hex.EncodeToString(hash.Sum(nil)) + "  " + tmp + "\" | sha256sum -c -",
+		"install -m 0755 " + tmp + " " + serverBinary,
+		"rm " + tmp,
+		"systemctl enable --now fastvpn",
+	}, " && ")
+	log.Printf("upload %s", path)
+	if err = session.Run("sudo sh -c '" + command + "'"); err != nil {
+		return newError("upload server", nil, fmt.Errorf("%s: %s", err, bytes.TrimSpace(stderr.Bytes())))
+	}
+	return nil
+}
+
+// probeServer returns once the vpn port of the vm accepts connections
+func probeServer(ctx context.Context, ip net.IP, cfg *Config) error {
+	port := cfg.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	return stage(ctx, "wait for vpn server on "+addr, func() error {
+		err := poll(ctx, "wait for vpn server", serverTimeout, func() (bool, error) {
+			conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+			if err != nil {
+				return false, err
+			}
+			conn.Close()
+			return true, nil
+		})
+		if err != nil && ctx.Err() == nil {
+			return newError("probe server", nil, err)
+		}
+		return err
+	})
+}
@@ -0,0 +1,65 @@
+package vps
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestUserData(t *testing.T) {
+	script, err := userData(&Config{Transport: "tls", Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		// forwarding and nat survive a reboot of a kept vm
+		"/etc/sysctl.d/99-fastvpn.conf",
+		"net.ipv4.ip_forward=1",
+		"ExecStartPre=/etc/fastvpn/nat.sh",
+		`-s 192.168.45.0/24 -o "$dev" -j MASQUERADE`,
+		"FASTVPN_TRANSPORT=tls",
+		"FASTVPN_PORT=443",
+		// the certificate is made once and its fingerprint published
+		"if [ ! -f /etc/fastvpn/tls.key ]",
+		"FASTVPN_TLS_CERT=/etc/fastvpn/tls.crt",
+		"FASTVPN_TLS_KEY=/etc/fastvpn/tls.key",
+		tlsFingerprintBegin,
+		tlsFingerprintEnd,
+	} {
+		if !bytes.Contains(script, []byte(want)) {
+			t.Errorf("user data misses %q", want)
+		}
+	}
+	if sh, err := exec.LookPath("sh"); err == nil {
+		cmd := exec.Command(sh, "-n")
+		cmd.Stdin = bytes.NewReader(script)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("user data does not parse: %s: %s", err, out)
+		}
+	}
+}
+
+func TestUserDataWithoutTLS(t *testing.T) {
+	script, err := userData(&Config{Transport: "ws"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, unwanted := range []string{"openssl", "FASTVPN_TLS_CERT", tlsFingerprintBegin} {
+		if bytes.Contains(script, []byte(unwanted)) {
+			t.Errorf("user data of a plain transport has %q", unwanted)
+		}
+	}
+}
+
+func TestUserDataRejectsBadURL(t *testing.T) {
+	for _, cfg := range []Config{
+		{ServerURL: "https://example.com/x'; rm -rf /", ServerSHA256: strings.Repeat("a", 64)},
+		{ServerURL: "https://example.com/fastvpn"},
+		{ServerURL: "https://example.com/fastvpn", ServerSHA256: "abc"},
+	} {
+		if _, err := userData(&cfg); err == nil {
+			t.Errorf("%+v: got no error", cfg)
+		}
+	}
+}
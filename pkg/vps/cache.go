@@ -0,0 +1,54 @@
+package vps
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const cacheFile = "cache.json"
+
+type cacheEntry struct {
+	Value   string
+	Expires time.Time
+}
+
+var cacheLock sync.Mutex
+
+// cached returns the value stored for key in the state dir, calling lookup
+// and keeping its result for ttl when there is none
+func cached(key string, ttl time.Duration, lookup func() (string, error)) (string, error) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	path, err := statePath(cacheFile)
+	if err != nil {
+		return "", err
+	}
+	entries := map[string]cacheEntry{}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		// a broken cache is only a missed lookup
+		json.Unmarshal(data, &entries)
+	} else if !os.IsNotExist(err) {
+		return "", newError("read cache", nil, err)
+	}
+	if entry, ok := entries[key]; ok && time.Now().Before(entry.Expires) {
+		return entry.Value, nil
+	}
+
+	value, err := lookup()
+	if err != nil {
+		return "", err
+	}
+	entries[key] = cacheEntry{Value: value, Expires: time.Now().Add(ttl)}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return "", newError("write cache", nil, err)
+	}
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", newError("write cache", nil, err)
+	}
+	return value, nil
+}
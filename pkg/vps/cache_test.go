@@ -0,0 +1,82 @@
+package vps
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// counting returns a lookup giving value and how many times it ran
+func counting(value string) (func() (string, error), *int) {
+	n := 0
+	return func() (string, error) {
+		n++
+		return value, nil
+	}, &n
+}
+
+func TestCached(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	lookup, n := counting("ami-1")
+	for i := 0; i < 2; i++ {
+		got, err := cached("image", time.Hour, lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "ami-1" {
+			t.Errorf("got %s", got)
+		}
+	}
+	if *n != 1 {
+		t.Errorf("looked up %d times, want 1", *n)
+	}
+
+	// other keys are looked up on their own
+	other, m := counting("ami-2")
+	if got, _ := cached("other", time.Hour, other); got != "ami-2" || *m != 1 {
+		t.Errorf("got %s after %d lookups", got, *m)
+	}
+}
+
+func TestCachedExpires(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	lookup, n := counting("ami-1")
+	// a negative ttl is already expired when stored
+	for i := 0; i < 2; i++ {
+		if _, err := cached("image", -time.Second, lookup); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if *n != 2 {
+		t.Errorf("looked up %d times, want 2", *n)
+	}
+}
+
+func TestCachedSkipsErrors(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	fail := errors.New("throttled")
+	_, err := cached("image", time.Hour, func() (string, error) { return "", fail })
+	if !errors.Is(err, fail) {
+		t.Fatalf("got %v", err)
+	}
+	lookup, n := counting("ami-1")
+	if got, _ := cached("image", time.Hour, lookup); got != "ami-1" || *n != 1 {
+		t.Errorf("failed lookup was cached, got %s", got)
+	}
+}
+
+func TestCachedBrokenFile(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	path, err := statePath(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	lookup, n := counting("ami-1")
+	if got, err := cached("image", time.Hour, lookup); err != nil || got != "ami-1" || *n != 1 {
+		t.Errorf("got %s, %v after %d lookups", got, err, *n)
+	}
+}
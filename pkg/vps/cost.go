@@ -0,0 +1,297 @@
+package vps
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// pricesFile in the state dir overrides the bundled prices
+const pricesFile = "prices.json"
+
+// a vm not answering over ssh in time is reported without traffic
+const statsTimeout = 30 * time.Second
+
+// aws bills a running linux vm by the second, a minute at least per start
+const minBilled = time.Minute
+
+// priceTable holds the usd prices of the on-demand linux vms per hour by
+// instance type and region, and of the traffic out to the internet per GB by
+// region, "*" matches the regions not listed
+type priceTable struct {
+	Instances map[string]map[string]float64 `json:"instances"`
+	Transfer  map[string]float64            `json:"transfer"`
+}
+
+var bundledPrices = priceTable{
+	Instances: map[string]map[string]float64{
+		"t2.nano": {
+			"us-east-1": 0.0058, "us-east-2": 0.0058, "us-west-1": 0.0069, "us-west-2": 0.0058,
+			"eu-west-1": 0.0063, "eu-central-1": 0.0067, "ap-northeast-1": 0.0076, "ap-southeast-1": 0.0073,
+		},
+		"t3.nano": {
+			"us-east-1": 0.0052, "us-east-2": 0.0052, "us-west-1": 0.0062, "us-west-2": 0.0052,
+			"eu-west-1": 0.0057, "eu-central-1": 0.006, "ap-northeast-1": 0.0068, "ap-southeast-1": 0.0066,
+		},
+		"t4g.nano": {
+			"us-east-1": 0.0042, "us-east-2": 0.0042, "us-west-1": 0.005, "us-west-2": 0.0042,
+			"eu-west-1": 0.0046, "eu-central-1": 0.0048, "ap-northeast-1": 0.0054, "ap-southeast-1": 0.0053,
+		},
+		"t3.micro": {
+			"us-east-1": 0.0104, "us-east-2": 0.0104, "us-west-1": 0.0124, "us-west-2": 0.0104,
+			"eu-west-1": 0.0114, "eu-central-1": 0.012, "ap-northeast-1": 0.0136, "ap-southeast-1": 0.0132,
+		},
+	},
+	Transfer: map[string]float64{
+		"*":              0.09,
+		"ap-northeast-1": 0.114,
+		"ap-northeast-2": 0.126,
+		"ap-southeast-1": 0.12,
+		"ap-southeast-2": 0.114,
+		"ap-south-1":     0.1093,
+		"sa-east-1":      0.15,
+	},
+}
+
+// loadPrices returns the bundled prices with the entries of the prices file on top
+func loadPrices() (*priceTable, error) {
+	prices := &priceTable{
+		Instances: map[string]map[string]float64{},
+		Transfer:  map[string]float64{},
+	}
+	for instanceType, regions := range bundledPrices.Instances {
+		prices.Instances[instanceType] = map[string]float64{}
+		for region, price := range regions {
+			prices.Instances[instanceType][region] = price
+		}
+	}
+	for region, price := range bundledPrices.Transfer {
+		prices.Transfer[region] = price
+	}
+
+	path, err := statePath(pricesFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return prices, nil
+	}
+	if err != nil {
+		return nil, newError("read prices", nil, err)
+	}
+	var override priceTable
+	if err = json.Unmarshal(data, &override); err != nil {
+		return nil, newError("read prices", nil, fmt.Errorf("%s: %s", path, err))
+	}
+	for instanceType, regions := range override.Instances {
+		if prices.Instances[instanceType] == nil {
+			prices.Instances[instanceType] = map[string]float64{}
+		}
+		for region, price := range regions {
+			prices.Instances[instanceType][region] = price
+		}
+	}
+	for region, price := range override.Transfer {
+		prices.Transfer[region] = price
+	}
+	return prices, nil
+}
+
+func (t *priceTable) instance(instanceType, region string) (float64, bool) {
+	regions := t.Instances[instanceType]
+	if price, ok := regions[region]; ok {
+		return price, true
+	}
+	price, ok := regions["*"]
+	return price, ok
+}
+
+func (t *priceTable) transfer(region string) float64 {
+	if price, ok := t.Transfer[region]; ok {
+		return price
+	}
+	return t.Transfer["*"]
+}
+
+// serverStats is what the server keeps in its stats file
+type serverStats struct {
+	Start        time.Time
+	Updated      time.Time
+	Clients      int
+	BytesIn      uint64
+	BytesOut     uint64
+	SavedIn      uint64
+	SavedOut     uint64
+	BytesBetween uint64
+}
+
+// Cost prints how long the vms of owner, or of everybody when empty, have
+// been running, what that cost and the traffic of their servers
+func Cost(ctx context.Context, ps []Provider, cfg *Config, owner string) error {
+	prices, err := loadPrices()
+	if err != nil {
+		return err
+	}
+	signer, err := loadOrCreateSSHKey()
+	if err != nil {
+		return err
+	}
+
+	totals := map[string]float64{}
+	unpriced := false
+	for _, p := range ps {
+		vms, err := p.List(owner)
+		if err != nil {
+			return err
+		}
+		// only the vms taking the local key are read over ssh, the others
+		// would hang until the timeout
+		ownKeys := map[string]bool{}
+		for _, vm := range vms {
+			own, ok := ownKeys[vm.KeyName]
+			if !ok {
+				fingerprint, err := p.KeyFingerprint(vm.KeyName)
+				own = err == nil && keyMatches(signer.PublicKey(), fingerprint)
+				ownKeys[vm.KeyName] = own
+			}
+
+			billed := billedTime(vm, time.Now())
+			vmCost := "?"
+			price, ok := prices.instance(vm.Type, vm.Region)
+			if ok {
+				cost := price * billed.Hours()
+				totals[vm.Owner] += cost
+				vmCost = fmt.Sprintf("$%.2f", cost)
+				// spot vms never cost more than on-demand
+				if vm.Spot {
+					vmCost = "<=" + vmCost
+				}
+			} else {
+				unpriced = true
+			}
+
+			traffic := "traffic ?"
+			if !own {
+				traffic = "traffic n/a"
+			} else if vm.State == StateRunning {
+				stats, err := remoteOf(p).readStats(ctx, vm, sshUserOf(cfg), signer)
+				if err != nil {
+					log.Printf("%s: no traffic counters: %s", vm.ID, err)
+				} else {
+					var cost float64
+					traffic, cost = trafficCost(stats, prices.transfer(vm.Region))
+					totals[vm.Owner] += cost
+				}
+			}
+			log.Printf("%s %s/%s %s %s %s billed %s %s %s\n", vm.ID, vm.Owner, vm.Deployment, vm.Region,
+				vm.Type, vm.State, billed.Round(time.Minute), vmCost, traffic)
+		}
+	}
+
+	owners := make([]string, 0, len(totals))
+	for o := range totals {
+		owners = append(owners, o)
+	}
+	sort.Strings(owners)
+	for _, o := range owners {
+		log.Printf("total %s $%.2f\n", o, totals[o])
+	}
+	if unpriced {
+		log.Printf("some instance types have no price, add them to %s in the state dir\n", pricesFile)
+	}
+	return nil
+}
+
+// trafficCost returns the traffic of a server and the cost of it at price per
+// GB. Two streams leave aws and are billed: the bytes sent to the clients, as
+// sent after compression, and the uploads of the clients the vm nats out to
+// the internet, as forwarded after decompression. Packets between clients
+// only leave once, on their way to the other client. The bytes saved on the
+// way in are shown on their own, aws does not bill what comes in.
+func trafficCost(stats *serverStats, price float64) (string, float64) {
+	sent := sub(stats.BytesOut, stats.SavedOut)
+	forwarded := sub(stats.BytesIn, stats.BytesBetween)
+	cost := float64(sent+forwarded) / 1e9 * price
+	traffic := fmt.Sprintf("in %s out %s $%.2f", formatBytes(stats.BytesIn), formatBytes(stats.BytesOut), cost)
+	if stats.SavedOut > 0 {
+		traffic += fmt.Sprintf(" (%s sent, %s saved by compression)", formatBytes(sent), formatBytes(stats.SavedOut))
+	}
+	if stats.BytesBetween > 0 {
+		traffic += fmt.Sprintf(" (%s between clients)", formatBytes(stats.BytesBetween))
+	}
+	if stats.SavedIn > 0 {
+		traffic += fmt.Sprintf(" (%s saved on the way in)", formatBytes(stats.SavedIn))
+	}
+	return traffic, cost
+}
+
+// sub returns a-b, or 0 when the counters disagree and b is larger
+func sub(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
+
+// billedTime returns how long the vm is billed for since its launch time, the
+// last time it was started, a kept vm is billed again from there
+func billedTime(vm *Instance, now time.Time) time.Duration {
+	if vm.State != StateRunning && vm.State != StatePending {
+		return 0
+	}
+	billed := now.Sub(vm.LaunchTime)
+	if billed < minBilled {
+		billed = minBilled
+	}
+	return billed
+}
+
+// readServerStats reads the traffic counters the server keeps on the vm
+func readServerStats(ctx context.Context, p Provider, vm *Instance, user string, signer ssh.Signer) (*serverStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, statsTimeout)
+	defer cancel()
+	client, err := dialSSH(ctx, p, vm, user, signer)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, newError("ssh session", ErrSSHUnreachable, err)
+	}
+	defer session.Close()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if err = session.Run("cat " + serverStatsFile); err != nil {
+		return nil, newError("read stats", nil, fmt.Errorf("%s: %s", err, bytes.TrimSpace(stderr.Bytes())))
+	}
+	var stats serverStats
+	if err = json.Unmarshal(stdout.Bytes(), &stats); err != nil {
+		return nil, newError("read stats", nil, err)
+	}
+	return &stats, nil
+}
+
+// formatBytes prints a byte count in the largest fitting unit
+func formatBytes(n uint64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
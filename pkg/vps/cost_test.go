@@ -0,0 +1,126 @@
+package vps
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestBilledTime(t *testing.T) {
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		state  string
+		launch time.Time
+		want   time.Duration
+	}{
+		{"running", StateRunning, now.Add(-90 * time.Minute), 90 * time.Minute},
+		{"just started", StatePending, now.Add(-10 * time.Second), minBilled},
+		// the launch time of a kept vm is its last start
+		{"stopped", StateStopped, now.Add(-48 * time.Hour), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &Instance{State: tt.state, LaunchTime: tt.launch}
+			if got := billedTime(vm, now); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrafficCost(t *testing.T) {
+	tests := []struct {
+		name    string
+		stats   serverStats
+		traffic string
+		cost    float64
+	}{
+		{"uncompressed", serverStats{BytesIn: 2e9, BytesOut: 3e9}, "in 2.0GB out 3.0GB $0.45", 0.45},
+		{
+			name:    "compressed",
+			stats:   serverStats{BytesIn: 2e9, BytesOut: 3e9, SavedIn: 5e8, SavedOut: 1e9},
+			traffic: "in 2.0GB out 3.0GB $0.36 (2.0GB sent, 1.0GB saved by compression) (500.0MB saved on the way in)",
+			cost:    0.36,
+		},
+		{
+			// the uploads leave aws decompressed
+			name:    "only the uploads compressed",
+			stats:   serverStats{BytesIn: 4e9, BytesOut: 1e9, SavedIn: 2e9},
+			traffic: "in 4.0GB out 1.0GB $0.45 (2.0GB saved on the way in)",
+			cost:    0.45,
+		},
+		{
+			name:    "between clients",
+			stats:   serverStats{BytesIn: 3e9, BytesOut: 2e9, BytesBetween: 1e9},
+			traffic: "in 3.0GB out 2.0GB $0.36 (1.0GB between clients)",
+			cost:    0.36,
+		},
+		{
+			name:    "counters disagree",
+			stats:   serverStats{BytesIn: 1e9, BytesOut: 1e9, SavedOut: 2e9, BytesBetween: 3e9},
+			traffic: "in 1.0GB out 1.0GB $0.00 (0B sent, 2.0GB saved by compression) (3.0GB between clients)",
+			cost:    0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traffic, cost := trafficCost(&tt.stats, 0.09)
+			if traffic != tt.traffic {
+				t.Errorf("got %q, want %q", traffic, tt.traffic)
+			}
+			if math.Abs(cost-tt.cost) > 1e-9 {
+				t.Errorf("cost %f, want %f", cost, tt.cost)
+			}
+		})
+	}
+}
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestCostSkipsOtherKeys(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	own := liveInstances(t, p)[0]
+	p.Stats[own.ID] = &serverStats{BytesIn: 2e9, BytesOut: 3e9}
+
+	// a vm of a teammate, logged into with their key
+	other, err := p.Create("fastvpn-bob-default", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.InjectSSHKey(other.KeyName, ssh.MarshalAuthorizedKey(newHostKey(t)))
+
+	out := captureLog(t)
+	if err = Cost(context.Background(), []Provider{p}, cfg, ""); err != nil {
+		t.Fatal(err)
+	}
+	lines := map[string]string{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		for _, id := range []string{own.ID, other.ID} {
+			if strings.Contains(line, id+" ") || strings.Contains(line, id+":") {
+				lines[id] += line + "\n"
+			}
+		}
+	}
+	if !strings.Contains(lines[own.ID], "in 2.0GB out 3.0GB") {
+		t.Errorf("own vm without traffic: %q", lines[own.ID])
+	}
+	if !strings.Contains(lines[other.ID], "traffic n/a") || strings.Contains(lines[other.ID], "no traffic counters") {
+		t.Errorf("vm of another key was read: %q", lines[other.ID])
+	}
+}
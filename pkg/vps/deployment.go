@@ -0,0 +1,56 @@
+package vps
+
+import (
+	"fmt"
+	"os/user"
+	"regexp"
+	"strings"
+)
+
+// DefaultName is the deployment used when none is named
+const DefaultName = "default"
+
+// names end up in key pair and security group names, keep them plain
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// DefaultOwner returns the login of the user, so that every member of a team
+// sharing an account has their own deployments
+func DefaultOwner() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	owner := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, u.Username)
+	return strings.Trim(owner, "-")
+}
+
+// deploymentName is what the vm, its key pair and its security group are named
+func deploymentName(cfg *Config) string {
+	name := cfg.Name
+	if name == "" {
+		name = DefaultName
+	}
+	if cfg.Owner == "" {
+		return instanceName + "-" + name
+	}
+	return instanceName + "-" + cfg.Owner + "-" + name
+}
+
+// checkDeployment rejects names which can not be used for the resources
+func checkDeployment(cfg *Config) error {
+	if cfg.Name != "" && !validName.MatchString(cfg.Name) {
+		return newError("deployment", nil, fmt.Errorf("bad name %q, use lowercase letters, digits and dashes", cfg.Name))
+	}
+	if cfg.Owner != "" && !validName.MatchString(cfg.Owner) {
+		return newError("deployment", nil, fmt.Errorf("bad owner %q, use lowercase letters, digits and dashes", cfg.Owner))
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package vps
+
+import (
+	"context"
+	"testing"
+)
+
+func TestDeploymentName(t *testing.T) {
+	tests := []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{}, instanceName + "-default"},
+		{Config{Name: "tokyo"}, instanceName + "-tokyo"},
+		{Config{Owner: "alice"}, instanceName + "-alice-default"},
+		{Config{Owner: "alice", Name: "tokyo"}, instanceName + "-alice-tokyo"},
+	}
+	for _, tt := range tests {
+		if got := deploymentName(&tt.cfg); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.cfg, got, tt.want)
+		}
+	}
+}
+
+func TestCheckDeployment(t *testing.T) {
+	tests := []struct {
+		cfg     Config
+		wantErr bool
+	}{
+		{Config{}, false},
+		{Config{Name: "tokyo-2", Owner: "alice"}, false},
+		{Config{Name: "Tokyo"}, true},
+		{Config{Name: "-tokyo"}, true},
+		{Config{Name: "tokyo_2"}, true},
+		{Config{Owner: "a b"}, true},
+		{Config{Name: "a123456789012345678901234567890123"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkDeployment(&tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: got %v", tt.cfg, err)
+		}
+	}
+}
+
+// deployments of other names and owners are not touched by up and down
+func TestNamedDeployments(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	cfg.Owner = "alice"
+	tokyo := *cfg
+	tokyo.Name = "tokyo"
+	bob := *cfg
+	bob.Owner = "bob"
+	for _, c := range []*Config{cfg, &tokyo, &bob} {
+		if err := StartInstance(context.Background(), p, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if vms := liveInstances(t, p); len(vms) != 3 {
+		t.Fatalf("got %d vms, want 3", len(vms))
+	}
+
+	if err := StopInstance(p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, vm := range liveInstances(t, p) {
+		names[vm.Name] = true
+	}
+	if len(names) != 2 || !names[deploymentName(&tokyo)] || !names[deploymentName(&bob)] {
+		t.Errorf("left %v", names)
+	}
+	if _, ok := p.Keys[deploymentName(cfg)]; ok {
+		t.Error("key of the stopped deployment kept")
+	}
+	if _, ok := p.Keys[deploymentName(&tokyo)]; !ok {
+		t.Error("key of another deployment removed")
+	}
+}
@@ -0,0 +1,86 @@
+package vps
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// kinds of failures the callers can act on, match them with errors.Is
+var (
+	ErrCredentials     = errors.New("credentials missing or invalid")
+	ErrQuotaExceeded   = errors.New("quota exceeded")
+	ErrNotFound        = errors.New("instance not found")
+	ErrSSHUnreachable  = errors.New("ssh unreachable")
+	ErrHostKeyMismatch = errors.New("ssh host key does not match the pinned one")
+)
+
+// Error is returned by every vps operation
+type Error struct {
+	Op   string
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Kind != nil && e.Err != nil {
+		return fmt.Sprintf("vps %s: %s: %s", e.Op, e.Kind, e.Err)
+	}
+	if e.Kind != nil {
+		return fmt.Sprintf("vps %s: %s", e.Op, e.Kind)
+	}
+	return fmt.Sprintf("vps %s: %s", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error is of kind target
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+func newError(op string, kind error, err error) error {
+	return &Error{Op: op, Kind: kind, Err: err}
+}
+
+// Hint returns what the user can do about err, or "" if nothing is known
+func Hint(err error) string {
+	switch {
+	case errors.Is(err, ErrCredentials):
+		return "check the keys in ~/.aws/credentials or the AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY environment"
+	case errors.Is(err, ErrQuotaExceeded):
+		return "the account limit is reached, destroy unused resources or ask the provider for a higher quota"
+	case errors.Is(err, ErrNotFound):
+		return "the vm is gone, run `fastvpn vps status` to list the live ones"
+	case errors.Is(err, ErrSSHUnreachable):
+		return "the vm does not accept ssh, check the security group and try `fastvpn vps up` again"
+	case errors.Is(err, ErrHostKeyMismatch):
+		return "the connection to the vm may be intercepted, the vm was destroyed, retry from another network"
+	}
+	return ""
+}
+
+// awsError classifies the aws error codes into the error kinds
+func awsError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var kind error
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "NoCredentialProviders", "AuthFailure", "UnauthorizedOperation",
+			"InvalidClientTokenId", "SignatureDoesNotMatch", "ExpiredToken":
+			kind = ErrCredentials
+		case "InstanceLimitExceeded", "VcpuLimitExceeded", "SecurityGroupLimitExceeded",
+			"RulesPerSecurityGroupLimitExceeded", "KeyPairLimitExceeded", "AddressLimitExceeded",
+			"MaxSpotInstanceCountExceeded", "RequestLimitExceeded":
+			kind = ErrQuotaExceeded
+		case "InvalidInstanceID.NotFound", "InvalidInstanceID.Malformed":
+			kind = ErrNotFound
+		}
+	}
+	return newError(op, kind, err)
+}
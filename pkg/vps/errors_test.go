@@ -0,0 +1,68 @@
+package vps
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestAWSError(t *testing.T) {
+	tests := []struct {
+		code string
+		want error
+	}{
+		{"AuthFailure", ErrCredentials},
+		{"NoCredentialProviders", ErrCredentials},
+		{"InstanceLimitExceeded", ErrQuotaExceeded},
+		{"VcpuLimitExceeded", ErrQuotaExceeded},
+		{"InvalidInstanceID.NotFound", ErrNotFound},
+		{"InvalidParameterValue", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			cause := awserr.New(tt.code, "message", nil)
+			err := awsError("op", cause)
+			for _, kind := range []error{ErrCredentials, ErrQuotaExceeded, ErrNotFound, ErrSSHUnreachable} {
+				if got := errors.Is(err, kind); got != (kind == tt.want) {
+					t.Errorf("errors.Is(%s) = %v", kind, got)
+				}
+			}
+			if !errors.Is(err, cause) {
+				t.Error("aws error not wrapped")
+			}
+			if hint := Hint(err); (hint != "") != (tt.want != nil) {
+				t.Errorf("hint %q", hint)
+			}
+		})
+	}
+	if err := awsError("op", nil); err != nil {
+		t.Errorf("got %v for no error", err)
+	}
+}
+
+func TestErrorKindSurvivesWrapping(t *testing.T) {
+	err := fmt.Errorf("up: %w", newError("dial", ErrSSHUnreachable, errors.New("timeout")))
+	if !errors.Is(err, ErrSSHUnreachable) {
+		t.Errorf("kind lost in %v", err)
+	}
+	var e *Error
+	if !errors.As(err, &e) || e.Op != "dial" {
+		t.Errorf("op lost in %v", err)
+	}
+	if got, want := e.Error(), "vps dial: ssh unreachable: timeout"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDestroyNotFound(t *testing.T) {
+	p, _ := newTestProvider(t)
+	err := p.Destroy("fake-404")
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, want not found", err)
+	}
+	if Hint(err) == "" {
+		t.Error("no hint for a missing vm")
+	}
+}
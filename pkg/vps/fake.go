@@ -0,0 +1,372 @@
+package vps
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// FakeProvider keeps its vms in memory, it is used for tests and dry runs.
+// Its vms are never dialed, the server upload, probe and stats are faked too.
+type FakeProvider struct {
+	Instances map[string]*Instance
+	Keys      map[string][]byte
+	HostKey   map[string]ssh.PublicKey
+	UserData  map[string][]byte
+	// Uploaded is the server binary uploaded to each vm and Stats what its
+	// server counted
+	Uploaded map[string]string
+	Stats    map[string]*serverStats
+	// StaticIPs are the addresses kept by name
+	StaticIPs map[string]net.IP
+	// ProbeErr fails the probe of the vpn servers, to test rollbacks
+	ProbeErr error
+	// Region, Owner, Deployment and Type are put on the vms it creates
+	Region     string
+	Owner      string
+	Deployment string
+	Type       string
+
+	lastID int
+	lock   sync.Mutex
+}
+
+func init() {
+	Register("fake", func(cfg *Config) (Provider, error) {
+		p := NewFakeProvider()
+		p.Region, p.Owner, p.Deployment = cfg.Region, cfg.Owner, cfg.Name
+		p.Type = instanceTypeOf(cfg)
+		if p.Deployment == "" {
+			p.Deployment = DefaultName
+		}
+		return p, nil
+	})
+}
+
+// NewFakeProvider returns an empty in-memory provider
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		Instances: map[string]*Instance{},
+		Keys:      map[string][]byte{},
+		HostKey:   map[string]ssh.PublicKey{},
+		UserData:  map[string][]byte{},
+		Uploaded:  map[string]string{},
+		Stats:     map[string]*serverStats{},
+		StaticIPs: map[string]net.IP{},
+	}
+}
+
+// Create adds a running vm with an address from TEST-NET-3
+func (p *FakeProvider) Create(name string, userData []byte) (*Instance, error) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.lastID++
+	vm := &Instance{
+		ID:         fmt.Sprintf("fake-%d", p.lastID),
+		Name:       name,
+		State:      StateRunning,
+		PublicIP:   net.IPv4(203, 0, 113, byte(p.lastID)),
+		LaunchTime: time.Now(),
+		Region:     p.Region,
+		Owner:      p.Owner,
+		Deployment: p.Deployment,
+		Type:       p.Type,
+		KeyName:    name,
+	}
+	p.Instances[vm.ID] = vm
+	p.HostKey[vm.ID] = hostKey
+	p.UserData[vm.ID] = userData
+	return copyInstance(vm), nil
+}
+
+// Find returns the live vms named name
+func (p *FakeProvider) Find(name string) ([]*Instance, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var instances []*Instance
+	for _, vm := range p.Instances {
+		if vm.Name == name && vm.State != StateTerminated {
+			instances = append(instances, copyInstance(vm))
+		}
+	}
+	return instances, nil
+}
+
+// List returns the live vms of owner, or all of them
+func (p *FakeProvider) List(owner string) ([]*Instance, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var instances []*Instance
+	for _, vm := range p.Instances {
+		if (owner == "" || vm.Owner == owner) && vm.State != StateTerminated {
+			instances = append(instances, copyInstance(vm))
+		}
+	}
+	return instances, nil
+}
+
+// Destroy marks the vm terminated
+func (p *FakeProvider) Destroy(id string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	vm, ok := p.Instances[id]
+	if !ok {
+		return newError("destroy", ErrNotFound, errors.New(id))
+	}
+	vm.State = StateTerminated
+	vm.PublicIP = nil
+	return nil
+}
+
+// Start marks the vm running again
+func (p *FakeProvider) Start(id string) error {
+	return p.setState(id, StateRunning)
+}
+
+// Stop marks the vm stopped
+func (p *FakeProvider) Stop(id string) error {
+	return p.setState(id, StateStopped)
+}
+
+// AttachStaticIP moves the vm to an address from TEST-NET-2, one per name
+func (p *FakeProvider) AttachStaticIP(id string) (net.IP, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	vm, ok := p.Instances[id]
+	if !ok || vm.State == StateTerminated {
+		return nil, newError("attach static ip", ErrNotFound, errors.New(id))
+	}
+	ip, ok := p.StaticIPs[vm.Name]
+	if !ok {
+		ip = net.IPv4(198, 51, 100, byte(len(p.StaticIPs)+1))
+		p.StaticIPs[vm.Name] = ip
+	}
+	vm.PublicIP = ip
+	return ip, nil
+}
+
+func (p *FakeProvider) setState(id, state string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	vm, ok := p.Instances[id]
+	if !ok || vm.State == StateTerminated {
+		return newError(state, ErrNotFound, errors.New(id))
+	}
+	vm.State = state
+	return nil
+}
+
+// Cleanup forgets the static ip
+func (p *FakeProvider) Cleanup(name string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.StaticIPs, name)
+	return nil
+}
+
+// Status returns a copy of the vm
+func (p *FakeProvider) Status(id string) (*Instance, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	vm, ok := p.Instances[id]
+	if !ok {
+		return nil, newError("status", ErrNotFound, errors.New(id))
+	}
+	return copyInstance(vm), nil
+}
+
+// PublicIP returns the address of the vm
+func (p *FakeProvider) PublicIP(id string) (net.IP, error) {
+	vm, err := p.Status(id)
+	if err != nil {
+		return nil, err
+	}
+	return vm.PublicIP, nil
+}
+
+// InjectSSHKey stores the key
+func (p *FakeProvider) InjectSSHKey(name string, publicKey []byte) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if bytes.Equal(p.Keys[name], publicKey) {
+		return false, nil
+	}
+	p.Keys[name] = publicKey
+	return true, nil
+}
+
+func copyInstance(vm *Instance) *Instance {
+	c := *vm
+	return &c
+}
+
+// HostKeys returns the key made up for the vm in Create
+func (p *FakeProvider) HostKeys(id string) ([]ssh.PublicKey, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	key, ok := p.HostKey[id]
+	if !ok {
+		return nil, newError("host keys", ErrNotFound, errors.New(id))
+	}
+	return []ssh.PublicKey{key}, nil
+}
+
+// TLSFingerprint makes up a fingerprint from the id and keeps it on the vm
+func (p *FakeProvider) TLSFingerprint(id string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	vm, ok := p.Instances[id]
+	if !ok {
+		return "", newError("tls fingerprint", ErrNotFound, errors.New(id))
+	}
+	sum := sha256.Sum256([]byte(id))
+	vm.TLSFingerprint = hex.EncodeToString(sum[:])
+	return vm.TLSFingerprint, nil
+}
+
+// KeyFingerprint returns the sha256 fingerprint of the stored key
+func (p *FakeProvider) KeyFingerprint(name string) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	data, ok := p.Keys[name]
+	if !ok {
+		return "", newError("key fingerprint", ErrNotFound, errors.New(name))
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return "", newError("key fingerprint", nil, err)
+	}
+	return ssh.FingerprintSHA256(key), nil
+}
+
+// RemoveSSHKey forgets the key
+func (p *FakeProvider) RemoveSSHKey(name string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.Keys, name)
+	return nil
+}
+
+// MarkReady flags the vm as bootstrapped
+func (p *FakeProvider) MarkReady(id string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	vm, ok := p.Instances[id]
+	if !ok {
+		return newError("mark ready", ErrNotFound, errors.New(id))
+	}
+	vm.Ready = true
+	return nil
+}
+
+// Orphans returns the vms stuck in bootstrap and the keys no live vm uses
+func (p *FakeProvider) Orphans() ([]Resource, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var orphans []Resource
+	usedKeys := map[string]bool{}
+	for _, vm := range p.Instances {
+		if vm.State == StateTerminated {
+			continue
+		}
+		if !vm.Ready && time.Since(vm.LaunchTime) > orphanAge {
+			orphans = append(orphans, Resource{Kind: KindInstance, ID: vm.ID, Name: vm.Name})
+			continue
+		}
+		usedKeys[vm.Name] = true
+	}
+	for name := range p.Keys {
+		if !usedKeys[name] {
+			orphans = append(orphans, Resource{Kind: KindKeyPair, ID: name, Name: name})
+		}
+	}
+	return orphans, nil
+}
+
+// RemoveOrphan deletes the vm or key
+func (p *FakeProvider) RemoveOrphan(r Resource) error {
+	switch r.Kind {
+	case KindInstance:
+		return p.Destroy(r.ID)
+	case KindKeyPair:
+		return p.RemoveSSHKey(r.ID)
+	}
+	return newError("remove orphan", nil, errors.New("unknown resource kind "+r.Kind))
+}
+
+// Regions returns two regions without an endpoint, they probe as unreachable
+func (p *FakeProvider) Regions() []Region {
+	return []Region{
+		{Name: "fake-1", Country: "ZZ"},
+		{Name: "fake-2", Country: "ZZ"},
+	}
+}
+
+// Wait returns at once, the fake vms change state immediately
+func (p *FakeProvider) Wait(ctx context.Context, id, state string) error {
+	vm, err := p.Status(id)
+	if err != nil {
+		return err
+	}
+	if vm.State != state {
+		return newError("wait", nil, fmt.Errorf("%s is %s", id, vm.State))
+	}
+	return nil
+}
+
+// uploadServer records the binary, the vm is never dialed
+func (p *FakeProvider) uploadServer(ctx context.Context, vm *Instance, user string, signer ssh.Signer, path string) error {
+	return stage(ctx, "upload server", func() error {
+		if _, err := p.Status(vm.ID); err != nil {
+			return err
+		}
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.Uploaded[vm.ID] = path
+		return nil
+	})
+}
+
+// probeServer returns ProbeErr for running vms
+func (p *FakeProvider) probeServer(ctx context.Context, vm *Instance, cfg *Config) error {
+	return stage(ctx, "wait for vpn server", func() error {
+		vm, err := p.Status(vm.ID)
+		if err != nil {
+			return err
+		}
+		if vm.State != StateRunning {
+			return newError("probe server", nil, fmt.Errorf("%s is %s", vm.ID, vm.State))
+		}
+		return p.ProbeErr
+	})
+}
+
+// readStats returns the stats set for the vm
+func (p *FakeProvider) readStats(ctx context.Context, vm *Instance, user string, signer ssh.Signer) (*serverStats, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	stats, ok := p.Stats[vm.ID]
+	if !ok {
+		return nil, newError("read stats", nil, fmt.Errorf("no stats for %s", vm.ID))
+	}
+	return stats, nil
+}
@@ -0,0 +1,134 @@
+package vps
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// default transport of the vpn server
+const (
+	DefaultTransport = "tcp"
+	DefaultPort      = 9001
+)
+
+const (
+	sshPort = 22
+	// answers with the address the request came from
+	callerIPURL = "https://checkip.amazonaws.com"
+)
+
+// Rule allows inbound traffic to a port from a network
+type Rule struct {
+	Protocol string
+	Port     int
+	CIDR     string
+}
+
+// IPv6 tells if the rule is for an ipv6 network
+func (r Rule) IPv6() bool {
+	return strings.Contains(r.CIDR, ":")
+}
+
+func (r Rule) String() string {
+	return fmt.Sprintf("%s/%d from %s", r.Protocol, r.Port, r.CIDR)
+}
+
+// ingressRules builds the firewall of the vm: the vpn port open to everyone
+// and ssh only from the caller
+func ingressRules(cfg *Config) ([]Rule, error) {
+	transport, err := transportProtocol(cfg.Transport)
+	if err != nil {
+		return nil, err
+	}
+	port := cfg.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+
+	sshCIDR := cfg.SSHCIDR
+	if sshCIDR == "" {
+		ip, err := callerIP()
+		if err != nil {
+			return nil, newError("firewall", nil, fmt.Errorf("detect public ip, set the ssh cidr instead: %s", err))
+		}
+		sshCIDR = hostCIDR(ip)
+	}
+	if _, _, err := net.ParseCIDR(sshCIDR); err != nil {
+		return nil, newError("firewall", nil, err)
+	}
+
+	rules := []Rule{
+		{Protocol: transport, Port: port, CIDR: "0.0.0.0/0"},
+		{Protocol: "tcp", Port: sshPort, CIDR: sshCIDR},
+	}
+	if cfg.IPv6 {
+		rules = append(rules, Rule{Protocol: transport, Port: port, CIDR: "::/0"})
+	}
+	return rules, nil
+}
+
+// diffRules returns the wanted rules missing from current and the current
+// rules no longer wanted
+func diffRules(current, wanted []Rule) (missing, extra []Rule) {
+	have := map[Rule]bool{}
+	for _, r := range current {
+		have[r] = true
+	}
+	want := map[Rule]bool{}
+	for _, r := range wanted {
+		if !want[r] && !have[r] {
+			missing = append(missing, r)
+		}
+		want[r] = true
+	}
+	for _, r := range current {
+		if !want[r] {
+			extra = append(extra, r)
+		}
+	}
+	return missing, extra
+}
+
+// transportProtocol returns the protocol a transport of the vpn server goes
+// over, the tls and websocket ones run on tcp
+func transportProtocol(transport string) (string, error) {
+	switch transport {
+	case "", "tcp", "tls", "ws", "wss":
+		return "tcp", nil
+	}
+	return "", newError("firewall", nil, fmt.Errorf("unsupported transport %q", transport))
+}
+
+// callerIP asks a public service for the address this host is seen with
+func callerIP() (net.IP, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(callerIPURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("bad answer %q from %s", body, callerIPURL)
+	}
+	return ip, nil
+}
+
+func hostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
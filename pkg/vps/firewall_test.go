@@ -0,0 +1,131 @@
+package vps
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIngressRules(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want []Rule
+	}{
+		{
+			name: "defaults",
+			cfg:  Config{SSHCIDR: "198.51.100.7/32"},
+			want: []Rule{
+				{Protocol: "tcp", Port: DefaultPort, CIDR: "0.0.0.0/0"},
+				{Protocol: "tcp", Port: sshPort, CIDR: "198.51.100.7/32"},
+			},
+		},
+		{
+			name: "tls on 443 with ipv6",
+			cfg:  Config{Transport: "tls", Port: 443, SSHCIDR: "2001:db8::/64", IPv6: true},
+			want: []Rule{
+				{Protocol: "tcp", Port: 443, CIDR: "0.0.0.0/0"},
+				{Protocol: "tcp", Port: sshPort, CIDR: "2001:db8::/64"},
+				{Protocol: "tcp", Port: 443, CIDR: "::/0"},
+			},
+		},
+		{
+			name: "websocket",
+			cfg:  Config{Transport: "wss", Port: 8443, SSHCIDR: "10.0.0.0/8"},
+			want: []Rule{
+				{Protocol: "tcp", Port: 8443, CIDR: "0.0.0.0/0"},
+				{Protocol: "tcp", Port: sshPort, CIDR: "10.0.0.0/8"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ingressRules(&tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngressRulesRejects(t *testing.T) {
+	for _, cfg := range []Config{
+		{Transport: "quic", SSHCIDR: "198.51.100.7/32"},
+		// the server has no udp transport, the port would be opened for nothing
+		{Transport: "udp", SSHCIDR: "198.51.100.7/32"},
+		{SSHCIDR: "198.51.100.7"},
+		{SSHCIDR: "not a network"},
+	} {
+		if rules, err := ingressRules(&cfg); err == nil {
+			t.Errorf("%+v: got %v, want an error", cfg, rules)
+		}
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	vpn := Rule{Protocol: "tcp", Port: DefaultPort, CIDR: "0.0.0.0/0"}
+	vpn6 := Rule{Protocol: "tcp", Port: DefaultPort, CIDR: "::/0"}
+	sshOld := Rule{Protocol: "tcp", Port: sshPort, CIDR: "198.51.100.7/32"}
+	sshNew := Rule{Protocol: "tcp", Port: sshPort, CIDR: "203.0.113.9/32"}
+	all := Rule{Protocol: "-1", CIDR: "0.0.0.0/0"}
+
+	tests := []struct {
+		name            string
+		current, wanted []Rule
+		missing, extra  []Rule
+	}{
+		{
+			name:    "new group",
+			wanted:  []Rule{vpn, sshNew},
+			missing: []Rule{vpn, sshNew},
+		},
+		{
+			name:    "up to date",
+			current: []Rule{sshNew, vpn},
+			wanted:  []Rule{vpn, sshNew},
+		},
+		{
+			name:    "caller moved",
+			current: []Rule{vpn, sshOld},
+			wanted:  []Rule{vpn, sshNew},
+			missing: []Rule{sshNew},
+			extra:   []Rule{sshOld},
+		},
+		{
+			name:    "ipv6 turned off and a rule added by hand",
+			current: []Rule{vpn, vpn6, sshNew, all},
+			wanted:  []Rule{vpn, sshNew},
+			extra:   []Rule{vpn6, all},
+		},
+		{
+			name:    "wanted twice",
+			wanted:  []Rule{vpn, vpn},
+			missing: []Rule{vpn},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing, extra := diffRules(tt.current, tt.wanted)
+			if !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("missing %v, want %v", missing, tt.missing)
+			}
+			if !reflect.DeepEqual(extra, tt.extra) {
+				t.Errorf("extra %v, want %v", extra, tt.extra)
+			}
+		})
+	}
+}
+
+func TestIPPermissionsRoundTrip(t *testing.T) {
+	rules := []Rule{
+		{Protocol: "tcp", Port: DefaultPort, CIDR: "0.0.0.0/0"},
+		{Protocol: "tcp", Port: DefaultPort, CIDR: "::/0"},
+		{Protocol: "tcp", Port: sshPort, CIDR: "198.51.100.7/32"},
+	}
+	got := fromIPPermissions(toIPPermissions(rules))
+	if !reflect.DeepEqual(got, rules) {
+		t.Errorf("got %v, want %v", got, rules)
+	}
+}
@@ -0,0 +1,101 @@
+package vps
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const knownHostsFile = "known_hosts"
+
+// markers around the host keys cloud-init prints to the console
+const (
+	hostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	hostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// ErrNoHostKeys is returned by Provider.HostKeys while the vm has not published them yet
+var ErrNoHostKeys = errors.New("host keys not published yet")
+
+// pinHostKeys replaces the known keys of addr with keys
+func pinHostKeys(addr string, keys []ssh.PublicKey) error {
+	path, err := statePath(knownHostsFile)
+	if err != nil {
+		return err
+	}
+	host := knownhosts.Normalize(addr)
+
+	// the provider reuses addresses, drop what is known of a previous vm
+	var lines []string
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return newError("pin host keys", nil, err)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(old))
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == host {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	for _, key := range keys {
+		lines = append(lines, knownhosts.Line([]string{host}, key))
+	}
+
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		return newError("pin host keys", nil, err)
+	}
+	return nil
+}
+
+// hostKeyCallback accepts only the host keys pinned by this tool
+func hostKeyCallback() (ssh.HostKeyCallback, error) {
+	path, err := statePath(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, newError("known hosts", nil, err)
+	}
+	return callback, nil
+}
+
+// parseConsoleHostKeys extracts the host keys from the console output of a vm
+func parseConsoleHostKeys(output []byte) ([]ssh.PublicKey, error) {
+	begin := bytes.Index(output, []byte(hostKeysBegin))
+	if begin < 0 {
+		return nil, ErrNoHostKeys
+	}
+	output = output[begin+len(hostKeysBegin):]
+	end := bytes.Index(output, []byte(hostKeysEnd))
+	if end < 0 {
+		return nil, ErrNoHostKeys
+	}
+
+	var keys []ssh.PublicKey
+	for _, line := range bytes.Split(output[:end], []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoHostKeys
+	}
+	return keys, nil
+}
@@ -0,0 +1,130 @@
+package vps
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key)))
+}
+
+func TestParseConsoleHostKeys(t *testing.T) {
+	k1, k2 := newHostKey(t), newHostKey(t)
+	keys := hostKeysBegin + "\n" + authorizedKey(k1) + " root@ip-10-0-0-1\r\n\n" + authorizedKey(k2) + "\n" + hostKeysEnd + "\n"
+
+	tests := []struct {
+		name    string
+		console string
+		want    []ssh.PublicKey
+		err     error
+	}{
+		{
+			name:    "keys between boot messages",
+			console: "[    0.000000] Linux version 6.1\ncloud-init: modules final\n" + keys + "login: ",
+			want:    []ssh.PublicKey{k1, k2},
+		},
+		{
+			name:    "not booted yet",
+			console: "[    0.000000] Linux version 6.1\n",
+			err:     ErrNoHostKeys,
+		},
+		{
+			name:    "cut off before the end marker",
+			console: hostKeysBegin + "\n" + authorizedKey(k1) + "\n",
+			err:     ErrNoHostKeys,
+		},
+		{
+			name:    "no keys between the markers",
+			console: hostKeysBegin + "\n\n" + hostKeysEnd,
+			err:     ErrNoHostKeys,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConsoleHostKeys([]byte(tt.console))
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d keys, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if !bytes.Equal(got[i].Marshal(), tt.want[i].Marshal()) {
+					t.Errorf("key %d is %s, want %s", i, authorizedKey(got[i]), authorizedKey(tt.want[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestParseConsoleHostKeysGarbage(t *testing.T) {
+	console := hostKeysBegin + "\nssh-ed25519 not-base64!\n" + hostKeysEnd
+	_, err := parseConsoleHostKeys([]byte(console))
+	if err == nil || errors.Is(err, ErrNoHostKeys) {
+		t.Errorf("got %v, want a parse error", err)
+	}
+}
+
+func TestPinHostKeys(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	addr := "203.0.113.5:22"
+	other := "203.0.113.6:22"
+	oldKey, newKey, otherKey := newHostKey(t), newHostKey(t), newHostKey(t)
+	remote := &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 22}
+	otherRemote := &net.TCPAddr{IP: net.ParseIP("203.0.113.6"), Port: 22}
+
+	if err := pinHostKeys(addr, []ssh.PublicKey{oldKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pinHostKeys(other, []ssh.PublicKey{otherKey}); err != nil {
+		t.Fatal(err)
+	}
+	// a new vm on the same address replaces the keys of the old one
+	if err := pinHostKeys(addr, []ssh.PublicKey{newKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	callback, err := hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		remote net.Addr
+		host   string
+		key    ssh.PublicKey
+		ok     bool
+	}{
+		{"pinned key", remote, addr, newKey, true},
+		{"key of the previous vm", remote, addr, oldKey, false},
+		{"key of another vm", remote, addr, otherKey, false},
+		{"other vm kept", otherRemote, other, otherKey, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := callback(tt.host, tt.remote, tt.key)
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
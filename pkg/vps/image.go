@@ -0,0 +1,84 @@
+package vps
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// operating systems the vm can run
+const (
+	ImageUbuntu      = "ubuntu"
+	ImageDebian      = "debian"
+	ImageAmazonLinux = "amazon-linux"
+
+	DefaultImage = ImageUbuntu
+)
+
+// cpu architectures of the vm
+const (
+	ArchAMD64 = "amd64"
+	ArchARM64 = "arm64"
+)
+
+// default instance types, the smallest of each architecture
+var defaultInstanceTypes = map[string]string{
+	ArchAMD64: "t2.nano",
+	ArchARM64: "t4g.nano",
+}
+
+// user the images let log in over ssh
+var imageSSHUsers = map[string]string{
+	ImageUbuntu:      "ubuntu",
+	ImageDebian:      "admin",
+	ImageAmazonLinux: "ec2-user",
+}
+
+// graviton families carry a g after the generation, like t4g, c6gn or m7gd
+var armInstanceType = regexp.MustCompile(`^[a-z]+[0-9]+[a-z]*g[a-z]*\.`)
+
+// imageOf returns the os of the vm
+func imageOf(cfg *Config) string {
+	if cfg.Image == "" {
+		return DefaultImage
+	}
+	return cfg.Image
+}
+
+// archOf returns the architecture of the vm, guessed from the instance type when not set
+func archOf(cfg *Config) string {
+	if cfg.Arch != "" {
+		return cfg.Arch
+	}
+	if armInstanceType.MatchString(cfg.InstanceType) {
+		return ArchARM64
+	}
+	return ArchAMD64
+}
+
+// instanceTypeOf returns the instance type of the vm
+func instanceTypeOf(cfg *Config) string {
+	if cfg.InstanceType != "" {
+		return cfg.InstanceType
+	}
+	return defaultInstanceTypes[archOf(cfg)]
+}
+
+// sshUserOf returns the user to log into the vm as
+func sshUserOf(cfg *Config) string {
+	return imageSSHUsers[imageOf(cfg)]
+}
+
+// checkImage rejects unknown images and instance types not matching the architecture
+func checkImage(cfg *Config) error {
+	if _, ok := imageSSHUsers[imageOf(cfg)]; !ok {
+		return newError("image", nil, fmt.Errorf("unknown image %q", imageOf(cfg)))
+	}
+	arch := archOf(cfg)
+	if _, ok := defaultInstanceTypes[arch]; !ok {
+		return newError("image", nil, fmt.Errorf("unknown architecture %q", arch))
+	}
+	if cfg.InstanceType != "" && armInstanceType.MatchString(cfg.InstanceType) != (arch == ArchARM64) {
+		return newError("image", nil, fmt.Errorf("instance type %s does not run %s", cfg.InstanceType, arch))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package vps
+
+import "testing"
+
+func TestArchOf(t *testing.T) {
+	tests := []struct {
+		cfg      Config
+		arch     string
+		instance string
+	}{
+		{Config{}, ArchAMD64, "t2.nano"},
+		{Config{Arch: ArchARM64}, ArchARM64, "t4g.nano"},
+		{Config{InstanceType: "t4g.small"}, ArchARM64, "t4g.small"},
+		{Config{InstanceType: "c6gn.large"}, ArchARM64, "c6gn.large"},
+		{Config{InstanceType: "m7gd.medium"}, ArchARM64, "m7gd.medium"},
+		{Config{InstanceType: "t3.micro"}, ArchAMD64, "t3.micro"},
+		{Config{InstanceType: "m5.large"}, ArchAMD64, "m5.large"},
+	}
+	for _, tt := range tests {
+		if got := archOf(&tt.cfg); got != tt.arch {
+			t.Errorf("%+v: arch %s, want %s", tt.cfg, got, tt.arch)
+		}
+		if got := instanceTypeOf(&tt.cfg); got != tt.instance {
+			t.Errorf("%+v: instance type %s, want %s", tt.cfg, got, tt.instance)
+		}
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"default", Config{}, false},
+		{"debian arm", Config{Image: ImageDebian, Arch: ArchARM64}, false},
+		{"unknown image", Config{Image: "windows"}, true},
+		{"unknown arch", Config{Arch: "riscv64"}, true},
+		{"x86 type on arm", Config{Arch: ArchARM64, InstanceType: "t3.micro"}, true},
+		{"graviton on amd64", Config{Arch: ArchAMD64, InstanceType: "t4g.nano"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkImage(&tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}
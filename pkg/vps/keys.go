@@ -0,0 +1,133 @@
+package vps
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const sshKeyFile = "id_ed25519"
+
+// loadOrCreateSSHKey returns the key used to log into the vms, it is made on
+// the first run and kept in the state dir readable only by the user
+func loadOrCreateSSHKey() (ssh.Signer, error) {
+	path, err := statePath(sshKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, newError("load ssh key", nil, err)
+		}
+		return signer, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, newError("load ssh key", nil, err)
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, newError("generate ssh key", nil, err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, newError("generate ssh key", nil, err)
+	}
+	block := &pem.Block{
+		Type:  "OPENSSH PRIVATE KEY",
+		Bytes: marshalED25519PrivateKey(public, private),
+	}
+	// O_EXCL so a key written meanwhile by another run is never replaced
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, newError("save ssh key", nil, err)
+	}
+	if err = pem.Encode(f, block); err != nil {
+		f.Close()
+		return nil, newError("save ssh key", nil, err)
+	}
+	if err = f.Close(); err != nil {
+		return nil, newError("save ssh key", nil, err)
+	}
+	err = ioutil.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644)
+	if err != nil {
+		return nil, newError("save ssh key", nil, err)
+	}
+	return signer, nil
+}
+
+// marshalED25519PrivateKey encodes the key in the unencrypted openssh format,
+// so the saved key also works with `ssh -i`
+func marshalED25519PrivateKey(public ed25519.PublicKey, private ed25519.PrivateKey) []byte {
+	var check [4]byte
+	rand.Read(check[:])
+	pk := struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}{
+		Check1:  binary.BigEndian.Uint32(check[:]),
+		Check2:  binary.BigEndian.Uint32(check[:]),
+		Keytype: ssh.KeyAlgoED25519,
+		Pub:     public,
+		Priv:    private,
+		Comment: instanceName,
+	}
+	// the private block is padded with 1, 2, 3... to the cipher block size
+	for i := 1; (len(ssh.Marshal(pk)))%8 != 0; i++ {
+		pk.Pad = append(pk.Pad, byte(i))
+	}
+
+	pubKey := struct {
+		Keytype string
+		Pub     []byte
+	}{ssh.KeyAlgoED25519, public}
+	w := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       ssh.Marshal(pubKey),
+		PrivKeyBlock: ssh.Marshal(pk),
+	}
+	return append([]byte("openssh-key-v1\x00"), ssh.Marshal(w)...)
+}
+
+// keyMatches tells if a fingerprint printed by a provider is the one of key
+func keyMatches(key ssh.PublicKey, fingerprint string) bool {
+	for _, f := range keyFingerprints(key) {
+		if f == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// keyFingerprints returns how the providers print the fingerprint of an imported key
+func keyFingerprints(key ssh.PublicKey) []string {
+	sum := sha256.Sum256(key.Marshal())
+	return []string{
+		ssh.FingerprintSHA256(key),
+		base64.StdEncoding.EncodeToString(sum[:]),
+		ssh.FingerprintLegacyMD5(key),
+	}
+}
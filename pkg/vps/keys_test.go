@@ -0,0 +1,92 @@
+package vps
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadOrCreateSSHKey(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	signer, err := loadOrCreateSSHKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.PublicKey().Type() != ssh.KeyAlgoED25519 {
+		t.Errorf("got a %s key", signer.PublicKey().Type())
+	}
+	path, err := statePath(sshKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("key saved with mode %v", fi.Mode().Perm())
+	}
+	pub, err := ioutil.ReadFile(path + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub, ssh.MarshalAuthorizedKey(signer.PublicKey())) {
+		t.Error("public key file does not match the key")
+	}
+
+	again, err := loadOrCreateSSHKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.PublicKey().Marshal(), signer.PublicKey().Marshal()) {
+		t.Error("key not reused")
+	}
+}
+
+func TestKeyMatches(t *testing.T) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	signer, err := loadOrCreateSSHKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := signer.PublicKey()
+	for _, f := range keyFingerprints(key) {
+		if !keyMatches(key, f) {
+			t.Errorf("%s does not match", f)
+		}
+	}
+	if keyMatches(key, "SHA256:not-this-one") {
+		t.Error("foreign fingerprint matches")
+	}
+}
+
+func TestStartInstanceReusesKey(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	buf := captureLog(t)
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	first := p.Keys[deploymentName(cfg)]
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Keys[deploymentName(cfg)], first) {
+		t.Error("key pair replaced on the second up")
+	}
+
+	path, err := statePath(sshKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("PRIVATE KEY")) || bytes.Contains(buf.Bytes(), bytes.TrimSpace(private)) {
+		t.Error("private key logged")
+	}
+}
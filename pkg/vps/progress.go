@@ -0,0 +1,93 @@
+package vps
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// waits are polled this often and give up after the timeouts
+const (
+	pollInterval     = 5 * time.Second
+	runningTimeout   = 5 * time.Minute
+	stoppedTimeout   = 5 * time.Minute
+	terminateTimeout = 5 * time.Minute
+	hostKeyTimeout   = 5 * time.Minute
+	sshDialTimeout   = 5 * time.Minute
+	serverTimeout    = 10 * time.Minute
+)
+
+// Progress is told how a long running operation advances, so the cli can show it
+type Progress interface {
+	// Step is called when a stage starts
+	Step(name string)
+	// Waiting is called each time a stage polls for something not there yet
+	Waiting(name string, elapsed time.Duration)
+	// Done is called when a stage ended, err is nil when it succeeded
+	Done(name string, err error)
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context reporting to progress
+func WithProgress(ctx context.Context, progress Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+// progressOf returns the reporter of the context, by default it logs
+func progressOf(ctx context.Context) Progress {
+	if progress, ok := ctx.Value(progressKey{}).(Progress); ok {
+		return progress
+	}
+	return logProgress{}
+}
+
+type logProgress struct{}
+
+func (logProgress) Step(name string) {
+	log.Println(name)
+}
+
+func (logProgress) Waiting(name string, elapsed time.Duration) {
+	log.Printf("%s: waiting %s", name, elapsed.Round(time.Second))
+}
+
+func (logProgress) Done(name string, err error) {
+	if err != nil {
+		log.Printf("%s: %s", name, err)
+	}
+}
+
+// stage runs fn as a named stage of the progress
+func stage(ctx context.Context, name string, fn func() error) error {
+	progress := progressOf(ctx)
+	progress.Step(name)
+	err := fn()
+	progress.Done(name, err)
+	return err
+}
+
+// poll calls try until it is done, ctx is cancelled or timeout passed, on
+// timeout the last error of try is returned if there was one
+func poll(ctx context.Context, name string, timeout time.Duration, try func() (done bool, err error)) error {
+	progress := progressOf(ctx)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	for {
+		done, err := try()
+		if done {
+			return err
+		}
+		progress.Waiting(name, time.Since(start))
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && err != nil {
+				return err
+			}
+			return newError(name, nil, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
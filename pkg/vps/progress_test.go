@@ -0,0 +1,121 @@
+package vps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// recorder keeps what was reported as lines
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) Step(name string) {
+	r.events = append(r.events, "step "+name)
+}
+
+func (r *recorder) Waiting(name string, elapsed time.Duration) {
+	r.events = append(r.events, "waiting "+name)
+}
+
+func (r *recorder) Done(name string, err error) {
+	r.events = append(r.events, fmt.Sprintf("done %s %v", name, err))
+}
+
+func TestPoll(t *testing.T) {
+	fail := errors.New("not yet")
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		try     func() (bool, error)
+		want    error
+		waits   int
+	}{
+		{"done", time.Minute, func() (bool, error) { return true, nil }, nil, 0},
+		{"failed", time.Minute, func() (bool, error) { return true, fail }, fail, 0},
+		{"timeout with error", 10 * time.Millisecond, func() (bool, error) { return false, fail }, fail, 1},
+		{"timeout", 10 * time.Millisecond, func() (bool, error) { return false, nil }, context.DeadlineExceeded, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{}
+			ctx := WithProgress(context.Background(), r)
+			err := poll(ctx, "wait", tt.timeout, tt.try)
+			if !errors.Is(err, tt.want) || (tt.want == nil) != (err == nil) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			if len(r.events) != tt.waits {
+				t.Errorf("reported %v", r.events)
+			}
+		})
+	}
+}
+
+// a cancel is returned as such, not as the last error of the try
+func TestPollCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tries := 0
+	err := poll(ctx, "wait", time.Minute, func() (bool, error) {
+		tries++
+		cancel()
+		return false, errors.New("not yet")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want canceled", err)
+	}
+	if tries != 1 {
+		t.Errorf("tried %d times", tries)
+	}
+}
+
+func TestStage(t *testing.T) {
+	r := &recorder{}
+	ctx := WithProgress(context.Background(), r)
+	fail := errors.New("boom")
+	stage(ctx, "one", func() error { return nil })
+	if err := stage(ctx, "two", func() error { return fail }); err != fail {
+		t.Errorf("got %v", err)
+	}
+	want := []string{"step one", "done one <nil>", "step two", "done two boom"}
+	if fmt.Sprint(r.events) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", r.events, want)
+	}
+}
+
+func TestWaitRunning(t *testing.T) {
+	p, _ := newTestProvider(t)
+	created, err := p.Create("fastvpn-test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := waitRunning(context.Background(), p, created.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !vm.PublicIP.Equal(created.PublicIP) {
+		t.Errorf("got %s", vm.PublicIP)
+	}
+
+	// the static address never shows up, the wait is bounded by ctx
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = waitRunning(ctx, p, created.ID, net.IPv4(198, 51, 100, 99))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("waited %s", time.Since(start))
+	}
+
+	if err = p.Stop(created.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = waitRunning(context.Background(), p, created.ID, nil); err == nil {
+		t.Error("stopped vm reported running")
+	}
+}
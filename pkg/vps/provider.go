@@ -0,0 +1,216 @@
+package vps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// vm states reported by the providers
+const (
+	StatePending    = "pending"
+	StateRunning    = "running"
+	StateStopping   = "stopping"
+	StateStopped    = "stopped"
+	StateTerminated = "terminated"
+)
+
+// kinds of resources a provider creates
+const (
+	KindInstance      = "instance"
+	KindSecurityGroup = "security-group"
+	KindKeyPair       = "key-pair"
+	KindAddress       = "address"
+)
+
+// a vm still not bootstrapped after this long is considered left behind
+const orphanAge = 30 * time.Minute
+
+// Instance is a vm seen by a provider
+type Instance struct {
+	ID         string
+	Name       string
+	State      string
+	PublicIP   net.IP
+	LaunchTime time.Time
+	Type       string
+	// KeyName is the key pair which may log into the vm
+	KeyName string
+	// Ready is set once the bootstrap finished
+	Ready bool
+	// Deployment and Owner are the name and user given on up
+	Deployment string
+	Owner      string
+	Region     string
+	Zone       string
+	// Spot vms can be interrupted by the provider, Interrupted tells it happened
+	Spot        bool
+	Interrupted bool
+	// TLSFingerprint is the sha256 of the certificate of the server, once
+	// read by Provider.TLSFingerprint
+	TLSFingerprint string
+}
+
+// Resource is something created by this tool that costs or clutters the account
+type Resource struct {
+	Kind string
+	ID   string
+	Name string
+}
+
+// Config selects the provider backend and how it is set up
+type Config struct {
+	Provider string
+	// Name tells apart the deployments of Owner, so one user can run
+	// several servers and a team can share an account
+	Name   string
+	Owner  string
+	Region string
+	// Regions are the candidates the one with the lowest latency is picked
+	// from, optionally only those in Country
+	Regions []string
+	Country string
+	// Image is the os of the vm, Arch its cpu architecture, guessed from
+	// InstanceType when empty, and InstanceType its size
+	Image        string
+	Arch         string
+	InstanceType string
+	// Transport and Port are what the vpn server listens on
+	Transport string
+	Port      int
+	// SSHCIDR may ssh into the vm, the public ip of the caller if empty
+	SSHCIDR string
+	// IPv6 also opens the vpn port to ipv6 clients
+	IPv6 bool
+	// ServerURL is where the vm downloads the server binary from, checked
+	// against ServerSHA256, when empty ServerBinary is uploaded over ssh
+	ServerURL    string
+	ServerSHA256 string
+	// ServerBinary defaults to the running executable
+	ServerBinary string
+	// the vm powers itself off, which terminates it, after IdleTimeout
+	// without vpn traffic or after running MaxLifetime, zero disables them
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	// KeepStopped stops the vm on down and starts it again on up, instead of
+	// terminating it, the server and its keys stay on the disk
+	KeepStopped bool
+	// StaticIP keeps the address of a kept vm, an elastic ip on aws
+	StaticIP bool
+	// Spot asks for spare capacity up to SpotMaxPrice per hour, the on-demand
+	// price when empty, and falls back to on-demand when there is none
+	Spot         bool
+	SpotMaxPrice string
+	// Zone to launch in, the provider picks one avoiding AvoidZones when empty
+	Zone       string
+	AvoidZones []string
+}
+
+// Validate rejects configs no provider can set up
+func (cfg *Config) Validate() error {
+	if err := checkDeployment(cfg); err != nil {
+		return err
+	}
+	if err := checkImage(cfg); err != nil {
+		return err
+	}
+	// one-time spot vms can not be stopped, only terminated
+	if cfg.Spot && cfg.KeepStopped {
+		return newError("config", nil, errors.New("spot vms can not be kept stopped"))
+	}
+	return nil
+}
+
+// Provider is implemented by every vps backend
+type Provider interface {
+	// Create launches a vm tagged with name which runs userData on first boot
+	Create(name string, userData []byte) (*Instance, error)
+	// Find lists the pending, running, stopping and stopped vms tagged with name
+	Find(name string) ([]*Instance, error)
+	// List returns the live vms of owner, or of everybody when owner is empty
+	List(owner string) ([]*Instance, error)
+	// Destroy terminates the vm
+	Destroy(id string) error
+	// Start boots a stopped vm
+	Start(id string) error
+	// Stop shuts the vm down keeping its disk
+	Stop(id string) error
+	// AttachStaticIP gives the vm an address which survives stops and returns it
+	AttachStaticIP(id string) (net.IP, error)
+	// Cleanup removes what is kept between vms of the deployment name, like
+	// its firewall and static ip, the key is removed on its own
+	Cleanup(name string) error
+	// Status returns the current state of the vm
+	Status(id string) (*Instance, error)
+	// Wait blocks until the vm is running, stopped or terminated, or ctx is done
+	Wait(ctx context.Context, id, state string) error
+	// PublicIP returns the address the vm can be reached on
+	PublicIP(id string) (net.IP, error)
+	// InjectSSHKey registers an authorized_keys formatted public key under
+	// name, imported is false when name already held the key
+	InjectSSHKey(name string, publicKey []byte) (imported bool, err error)
+	// HostKeys returns the ssh host keys the vm published, ErrNoHostKeys until it did
+	HostKeys(id string) ([]ssh.PublicKey, error)
+	// TLSFingerprint returns the sha256 of the tls certificate the vm made on
+	// its first boot, ErrNoTLSFingerprint until it published it
+	TLSFingerprint(id string) (string, error)
+	// KeyFingerprint returns the fingerprint of the key registered under name
+	KeyFingerprint(name string) (string, error)
+	// RemoveSSHKey deletes the key registered under name
+	RemoveSSHKey(name string) error
+	// MarkReady records that the vm finished its bootstrap
+	MarkReady(id string) error
+	// Orphans lists the resources made by this tool which no live deployment uses
+	Orphans() ([]Resource, error)
+	// RemoveOrphan deletes a resource returned by Orphans
+	RemoveOrphan(r Resource) error
+	// Regions lists where the provider can run vms
+	Regions() []Region
+}
+
+// Factory builds a provider from the config
+type Factory func(cfg *Config) (Provider, error)
+
+var (
+	providers     = map[string]Factory{}
+	providersLock sync.Mutex
+)
+
+// Register makes a provider available by name
+func Register(name string, factory Factory) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	if _, ok := providers[name]; ok {
+		panic("vps: provider registered twice: " + name)
+	}
+	providers[name] = factory
+}
+
+// Providers returns the names of the registered providers
+func Providers() []string {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the provider selected in the config
+func New(cfg *Config) (Provider, error) {
+	providersLock.Lock()
+	factory, ok := providers[cfg.Provider]
+	providersLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown vps provider %q, available: %v", cfg.Provider, Providers())
+	}
+	return factory(cfg)
+}
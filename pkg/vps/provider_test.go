@@ -0,0 +1,29 @@
+package vps
+
+import "testing"
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"defaults", Config{}, true},
+		{"spot", Config{Spot: true}, true},
+		{"kept", Config{KeepStopped: true, StaticIP: true}, true},
+		{"kept spot", Config{Spot: true, KeepStopped: true}, false},
+		{"bad name", Config{Name: "Tokyo"}, false},
+		{"bad owner", Config{Owner: "a b"}, false},
+		{"unknown image", Config{Image: "windows"}, false},
+		{"arm type on amd64", Config{Arch: ArchAMD64, InstanceType: "t4g.nano"}, false},
+		{"arm type", Config{InstanceType: "t4g.nano"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package vps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// each region is dialed a few times and the fastest handshake counts
+const (
+	probeRounds  = 3
+	probeTimeout = 2 * time.Second
+)
+
+// Region is a location a provider runs vms in
+type Region struct {
+	Name string
+	// Country is the ISO 3166 code of where the region is
+	Country string
+	// Endpoint is a host:port in the region used to measure the latency
+	Endpoint string
+}
+
+// candidateRegions returns the regions of the provider allowed by the config
+func candidateRegions(p Provider, cfg *Config) ([]Region, error) {
+	wanted := map[string]bool{}
+	for _, name := range cfg.Regions {
+		wanted[name] = true
+	}
+	if cfg.Region != "" && len(wanted) == 0 {
+		wanted[cfg.Region] = true
+	}
+
+	var regions []Region
+	for _, r := range p.Regions() {
+		if len(wanted) > 0 && !wanted[r.Name] {
+			continue
+		}
+		if cfg.Country != "" && !strings.EqualFold(cfg.Country, r.Country) {
+			continue
+		}
+		delete(wanted, r.Name)
+		regions = append(regions, r)
+	}
+	for name := range wanted {
+		return nil, newError("regions", nil, fmt.Errorf("unknown region %s", name))
+	}
+	if len(regions) == 0 {
+		return nil, newError("regions", nil, fmt.Errorf("no region in %q", cfg.Country))
+	}
+	return regions, nil
+}
+
+// PickRegion sets the region of the config to the candidate with the lowest
+// latency, candidates are the regions given, or every region of the country
+func PickRegion(ctx context.Context, p Provider, cfg *Config) error {
+	if len(cfg.Regions) == 0 && cfg.Country == "" {
+		return nil
+	}
+	regions, err := candidateRegions(p, cfg)
+	if err != nil {
+		return err
+	}
+	if len(regions) == 1 {
+		cfg.Region = regions[0].Name
+		return nil
+	}
+
+	latencies := probeRegions(ctx, regions)
+	sort.SliceStable(regions, func(i, j int) bool {
+		return latencies[regions[i].Name] < latencies[regions[j].Name]
+	})
+	for _, r := range regions {
+		if latency := latencies[r.Name]; latency < probeTimeout {
+			log.Printf("%s (%s) %s\n", r.Name, r.Country, latency.Round(time.Millisecond))
+		} else {
+			log.Printf("%s (%s) unreachable\n", r.Name, r.Country)
+		}
+	}
+	if latencies[regions[0].Name] >= probeTimeout {
+		return newError("regions", nil, errors.New("no region answered"))
+	}
+	cfg.Region = regions[0].Name
+	log.Printf("using %s\n", cfg.Region)
+	return ctx.Err()
+}
+
+// probeRegions measures the tcp handshake to every region at once, an
+// unreachable region gets probeTimeout
+func probeRegions(ctx context.Context, regions []Region) map[string]time.Duration {
+	latencies := map[string]time.Duration{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, r := range regions {
+		wg.Add(1)
+		go func(r Region) {
+			defer wg.Done()
+			latency := probeLatency(ctx, r.Endpoint)
+			lock.Lock()
+			latencies[r.Name] = latency
+			lock.Unlock()
+		}(r)
+	}
+	wg.Wait()
+	return latencies
+}
+
+func probeLatency(ctx context.Context, endpoint string) time.Duration {
+	best := probeTimeout
+	if endpoint == "" {
+		return best
+	}
+	dialer := net.Dialer{Timeout: probeTimeout}
+	for i := 0; i < probeRounds; i++ {
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", endpoint)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		if latency := time.Since(start); latency < best {
+			best = latency
+		}
+	}
+	return best
+}
+
+// Regional returns a provider for each region a deployment may be in, the
+// candidate regions of the config or else every region of the provider
+func Regional(cfg *Config) ([]Provider, error) {
+	p, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var regions []Region
+	if len(cfg.Regions) > 0 || cfg.Region != "" || cfg.Country != "" {
+		regions, err = candidateRegions(p, cfg)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		regions = p.Regions()
+	}
+
+	var ps []Provider
+	for _, r := range regions {
+		regional := *cfg
+		regional.Region = r.Name
+		p, err := New(&regional)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
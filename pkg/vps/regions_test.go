@@ -0,0 +1,152 @@
+package vps
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// regionsProvider is a fake provider in the given regions
+type regionsProvider struct {
+	*FakeProvider
+	regions []Region
+}
+
+func (p *regionsProvider) Regions() []Region {
+	return p.regions
+}
+
+// listening returns an address accepting connections until the test ends
+func listening(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// refusing returns an address nothing listens on
+func refusing(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestCandidateRegions(t *testing.T) {
+	p := &regionsProvider{NewFakeProvider(), []Region{
+		{Name: "us-1", Country: "US"},
+		{Name: "us-2", Country: "US"},
+		{Name: "jp-1", Country: "JP"},
+	}}
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    []string
+		wantErr bool
+	}{
+		{"all", Config{}, []string{"us-1", "us-2", "jp-1"}, false},
+		{"region", Config{Region: "jp-1"}, []string{"jp-1"}, false},
+		{"list", Config{Regions: []string{"us-2", "jp-1"}}, []string{"us-2", "jp-1"}, false},
+		{"country", Config{Country: "us"}, []string{"us-1", "us-2"}, false},
+		{"list in country", Config{Regions: []string{"us-1", "us-2"}, Country: "US"}, []string{"us-1", "us-2"}, false},
+		{"region outside the country", Config{Regions: []string{"us-2", "jp-1"}, Country: "JP"}, nil, true},
+		{"unknown region", Config{Regions: []string{"eu-1"}}, nil, true},
+		{"unknown country", Config{Country: "FR"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			regions, err := candidateRegions(p, &tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v", err)
+			}
+			var got []string
+			for _, r := range regions {
+				got = append(got, r.Name)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPickRegionFastest(t *testing.T) {
+	// the reachable region wins wherever it is listed
+	for _, reachable := range []int{0, 1, 2} {
+		regions := []Region{
+			{Name: "r-0", Country: "ZZ", Endpoint: refusing(t)},
+			{Name: "r-1", Country: "ZZ", Endpoint: refusing(t)},
+			{Name: "r-2", Country: "ZZ"},
+		}
+		regions[reachable].Endpoint = listening(t)
+		p := &regionsProvider{NewFakeProvider(), regions}
+		cfg := &Config{Country: "ZZ"}
+		if err := PickRegion(context.Background(), p, cfg); err != nil {
+			t.Fatal(err)
+		}
+		if want := regions[reachable].Name; cfg.Region != want {
+			t.Errorf("picked %s, want %s", cfg.Region, want)
+		}
+	}
+}
+
+func TestPickRegionNoneReachable(t *testing.T) {
+	p := &regionsProvider{NewFakeProvider(), []Region{
+		{Name: "r-0", Country: "ZZ", Endpoint: refusing(t)},
+		{Name: "r-1", Country: "ZZ"},
+	}}
+	cfg := &Config{Country: "ZZ"}
+	if err := PickRegion(context.Background(), p, cfg); err == nil {
+		t.Errorf("picked %s", cfg.Region)
+	}
+	if cfg.Region != "" {
+		t.Errorf("region set to %s", cfg.Region)
+	}
+}
+
+func TestPickRegionSingleNotProbed(t *testing.T) {
+	p := &regionsProvider{NewFakeProvider(), []Region{
+		{Name: "r-0", Country: "ZZ", Endpoint: refusing(t)},
+		{Name: "r-1", Country: "YY", Endpoint: refusing(t)},
+	}}
+	cfg := &Config{Country: "YY"}
+	if err := PickRegion(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Region != "r-1" {
+		t.Errorf("picked %s, want r-1", cfg.Region)
+	}
+}
+
+func TestRegional(t *testing.T) {
+	ps, err := Regional(&Config{Provider: "fake"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range ps {
+		got = append(got, p.(*FakeProvider).Region)
+	}
+	if len(got) != 2 || got[0] != "fake-1" || got[1] != "fake-2" {
+		t.Errorf("got providers in %v", got)
+	}
+}
@@ -0,0 +1,34 @@
+package vps
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// stateDirEnv overrides where the tool keeps its files
+const stateDirEnv = "FASTVPN_HOME"
+
+// StateDir returns the directory holding the keys and known hosts of the
+// tool, it is created readable only by the user
+func StateDir() (string, error) {
+	dir := os.Getenv(stateDirEnv)
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", newError("state dir", nil, err)
+		}
+		dir = filepath.Join(home, ".fastvpn")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", newError("state dir", nil, err)
+	}
+	return dir, nil
+}
+
+func statePath(name string) (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
@@ -0,0 +1,51 @@
+package vps
+
+import (
+	"context"
+	"log"
+)
+
+// step is one provisioning action and the compensating action undoing it
+type step struct {
+	name string
+	do   func() error
+	undo func() error
+}
+
+// transaction runs steps and remembers the done ones so they can be rolled back
+type transaction struct {
+	done []step
+}
+
+func (t *transaction) run(s step) error {
+	if err := s.do(); err != nil {
+		return err
+	}
+	t.done = append(t.done, s)
+	return nil
+}
+
+// runStage runs the step as a stage of the progress of ctx
+func (t *transaction) runStage(ctx context.Context, s step) error {
+	return stage(ctx, s.name, func() error { return t.run(s) })
+}
+
+// rollback undoes the done steps in reverse order, all of them are tried even if some fail
+func (t *transaction) rollback() error {
+	var first error
+	for i := len(t.done) - 1; i >= 0; i-- {
+		s := t.done[i]
+		if s.undo == nil {
+			continue
+		}
+		log.Printf("rollback: %s", s.name)
+		if err := s.undo(); err != nil {
+			log.Printf("rollback of %s failed: %s", s.name, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	t.done = nil
+	return first
+}
@@ -0,0 +1,50 @@
+package vps
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// where the first boot puts the certificate of the tls and wss transports,
+// made once so a kept vm keeps the fingerprint the clients pinned
+const (
+	serverTLSCert = "/etc/fastvpn/tls.crt"
+	serverTLSKey  = "/etc/fastvpn/tls.key"
+)
+
+// markers around the certificate fingerprint the user data prints to the console
+const (
+	tlsFingerprintBegin = "-----BEGIN FASTVPN TLS FINGERPRINT-----"
+	tlsFingerprintEnd   = "-----END FASTVPN TLS FINGERPRINT-----"
+)
+
+// ErrNoTLSFingerprint is returned by Provider.TLSFingerprint while the vm has
+// not published it yet
+var ErrNoTLSFingerprint = errors.New("tls fingerprint not published yet")
+
+// usesTLS tells if the server of cfg needs a certificate
+func usesTLS(cfg *Config) bool {
+	return cfg.Transport == "tls" || cfg.Transport == "wss"
+}
+
+// parseConsoleTLSFingerprint extracts the sha256 of the certificate from the
+// console output of a vm
+func parseConsoleTLSFingerprint(output []byte) (string, error) {
+	begin := bytes.Index(output, []byte(tlsFingerprintBegin))
+	if begin < 0 {
+		return "", ErrNoTLSFingerprint
+	}
+	output = output[begin+len(tlsFingerprintBegin):]
+	end := bytes.Index(output, []byte(tlsFingerprintEnd))
+	if end < 0 {
+		return "", ErrNoTLSFingerprint
+	}
+	fingerprint := string(bytes.ToLower(bytes.TrimSpace(output[:end])))
+	if b, err := hex.DecodeString(fingerprint); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("bad tls fingerprint %q", fingerprint)
+	}
+	return fingerprint, nil
+}
@@ -0,0 +1,48 @@
+package vps
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConsoleTLSFingerprint(t *testing.T) {
+	fingerprint := strings.Repeat("0123456789abcdef", 4)
+	tests := []struct {
+		name    string
+		console string
+		want    string
+		noneYet bool
+	}{
+		{
+			name:    "between boot messages",
+			console: "cloud-init: modules final\r\n" + tlsFingerprintBegin + "\r\n" + fingerprint + "\r\n" + tlsFingerprintEnd + "\r\nlogin: ",
+			want:    fingerprint,
+		},
+		{
+			name:    "upper case",
+			console: tlsFingerprintBegin + "\n" + strings.ToUpper(fingerprint) + "\n" + tlsFingerprintEnd,
+			want:    fingerprint,
+		},
+		{name: "not booted yet", console: "[    0.000000] Linux version 6.1\n", noneYet: true},
+		{name: "cut off before the end marker", console: tlsFingerprintBegin + "\n" + fingerprint[:20], noneYet: true},
+		{name: "truncated", console: tlsFingerprintBegin + "\n" + fingerprint[:62] + "\n" + tlsFingerprintEnd},
+		{name: "openssl failed", console: tlsFingerprintBegin + "\nunable to load certificate\n" + tlsFingerprintEnd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConsoleTLSFingerprint([]byte(tt.console))
+			switch {
+			case tt.noneYet:
+				if err != ErrNoTLSFingerprint {
+					t.Errorf("got %q, %v, want %v", got, err, ErrNoTLSFingerprint)
+				}
+			case tt.want == "":
+				if err == nil || err == ErrNoTLSFingerprint {
+					t.Errorf("got %q, %v, want a parse error", got, err)
+				}
+			case err != nil || got != tt.want:
+				t.Errorf("got %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package vps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const instanceName = "fastvpn"
+
+const spotCheckInterval = 15 * time.Second
+
+// create and start the interface, everything created is rolled back when it
+// fails or ctx is cancelled
+func StartInstance(ctx context.Context, p Provider, cfg *Config) (err error) {
+	tx := &transaction{}
+	defer func() {
+		if err != nil {
+			log.Printf("start failed: %s", err)
+			if rerr := tx.rollback(); rerr != nil {
+				log.Printf("rollback incomplete, run `fastvpn vps gc` to clean up: %s", rerr)
+			}
+		}
+	}()
+
+	if err = cfg.Validate(); err != nil {
+		return err
+	}
+	script, err := userData(cfg)
+	if err != nil {
+		return err
+	}
+	var binary string
+	if cfg.ServerURL == "" {
+		if binary, err = localServerBinary(cfg); err != nil {
+			return err
+		}
+	}
+
+	// a kept vm is started again, any other is replaced
+	name := deploymentName(cfg)
+	vms, err := p.Find(name)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if cfg.KeepStopped && vm.Ready {
+			return resumeInstance(ctx, p, cfg, vm, tx)
+		}
+		if err = p.Destroy(vm.ID); err != nil {
+			return err
+		}
+	}
+
+	// set ssh client
+	signer, err := loadOrCreateSSHKey()
+	if err != nil {
+		return err
+	}
+	var imported bool
+	err = tx.runStage(ctx, step{
+		name: "inject ssh key",
+		do: func() (err error) {
+			imported, err = p.InjectSSHKey(name, ssh.MarshalAuthorizedKey(signer.PublicKey()))
+			return err
+		},
+		undo: func() error {
+			// a key pair this run only reused may let the owner into other vms
+			if !imported {
+				return nil
+			}
+			return p.RemoveSSHKey(name)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// start vm, cloud-init sets up the server from the user data
+	var vm *Instance
+	err = tx.runStage(ctx, step{
+		name: "create vm",
+		do: func() (err error) {
+			vm, err = p.Create(name, script)
+			return err
+		},
+		undo: func() error {
+			if err := p.Destroy(vm.ID); err != nil {
+				return err
+			}
+			return p.Cleanup(name)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if vm, err = waitRunning(ctx, p, vm.ID, nil); err != nil {
+		return err
+	}
+	if cfg.KeepStopped && cfg.StaticIP {
+		var ip net.IP
+		err = stage(ctx, "attach static ip", func() (err error) {
+			ip, err = p.AttachStaticIP(vm.ID)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if vm, err = waitRunning(ctx, p, vm.ID, ip); err != nil {
+			return err
+		}
+	}
+
+	// without a download url the server is uploaded over ssh
+	r := remoteOf(p)
+	if binary != "" {
+		if err = r.uploadServer(ctx, vm, sshUserOf(cfg), signer, binary); err != nil {
+			return err
+		}
+	}
+
+	if err = r.probeServer(ctx, vm, cfg); err != nil {
+		return err
+	}
+	if usesTLS(cfg) {
+		if err = waitTLSFingerprint(ctx, p, vm.ID); err != nil {
+			return err
+		}
+	}
+	return stage(ctx, "mark ready", func() error { return p.MarkReady(vm.ID) })
+}
+
+// waitTLSFingerprint logs the fingerprint of the certificate of the server
+// once the vm published it, for the clients to pin
+func waitTLSFingerprint(ctx context.Context, p Provider, id string) error {
+	var fingerprint string
+	err := stage(ctx, "wait for tls fingerprint", func() error {
+		return poll(ctx, "wait for tls fingerprint", hostKeyTimeout, func() (done bool, err error) {
+			fingerprint, err = p.TLSFingerprint(id)
+			return !errors.Is(err, ErrNoTLSFingerprint), err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("tls certificate fingerprint %s\n", fingerprint)
+	return nil
+}
+
+// resumeInstance boots a kept vm, the server on its disk starts with it
+func resumeInstance(ctx context.Context, p Provider, cfg *Config, vm *Instance, tx *transaction) error {
+	if vm.State == StateStopping {
+		err := stage(ctx, "wait for vm to stop", func() error {
+			ctx, cancel := context.WithTimeout(ctx, stoppedTimeout)
+			defer cancel()
+			return p.Wait(ctx, vm.ID, StateStopped)
+		})
+		if err != nil {
+			return err
+		}
+		vm.State = StateStopped
+	}
+	if vm.State == StateStopped {
+		err := tx.runStage(ctx, step{
+			name: "start vm",
+			do:   func() error { return p.Start(vm.ID) },
+			undo: func() error { return p.Stop(vm.ID) },
+		})
+		if err != nil {
+			return err
+		}
+	}
+	vm, err := waitRunning(ctx, p, vm.ID, nil)
+	if err != nil {
+		return err
+	}
+	if err = remoteOf(p).probeServer(ctx, vm, cfg); err != nil {
+		return err
+	}
+	if vm.TLSFingerprint != "" {
+		log.Printf("tls certificate fingerprint %s\n", vm.TLSFingerprint)
+	}
+	return nil
+}
+
+// waitRunning returns the vm once it runs and has a public address, the ip
+// when it is not nil
+func waitRunning(ctx context.Context, p Provider, id string, ip net.IP) (vm *Instance, err error) {
+	err = stage(ctx, "wait for vm", func() error {
+		wctx, cancel := context.WithTimeout(ctx, runningTimeout)
+		defer cancel()
+		if err := p.Wait(wctx, id, StateRunning); err != nil {
+			return err
+		}
+		// an elastic ip shows up a moment after it was associated, until then
+		// the vm still reports the address it was launched with
+		return poll(ctx, "wait for vm address", runningTimeout, func() (bool, error) {
+			vm, err = p.Status(id)
+			if err != nil {
+				return true, err
+			}
+			return vm.PublicIP != nil && (ip == nil || vm.PublicIP.Equal(ip)), nil
+		})
+	})
+	return vm, err
+}
+
+// dialSSH connects to the vm after pinning the host keys it published, so the
+// connection can not be intercepted
+func dialSSH(ctx context.Context, p Provider, vm *Instance, user string, signer ssh.Signer) (*ssh.Client, error) {
+	addr := net.JoinHostPort(vm.PublicIP.String(), "22")
+	err := poll(ctx, "wait for host keys", hostKeyTimeout, func() (bool, error) {
+		keys, err := p.HostKeys(vm.ID)
+		if errors.Is(err, ErrNoHostKeys) {
+			return false, err
+		}
+		if err != nil {
+			return true, err
+		}
+		return true, pinHostKeys(addr, keys)
+	})
+	if errors.Is(err, ErrNoHostKeys) {
+		return nil, newError("host keys", ErrSSHUnreachable, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	callback, err := hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	var hostKeyErr error
+	config := &ssh.ClientConfig{
+		User:    user,
+		Timeout: 10 * time.Second,
+		Auth:    []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = callback(hostname, remote, key)
+			return hostKeyErr
+		},
+	}
+
+	var client *ssh.Client
+	err = poll(ctx, "connect to "+addr, sshDialTimeout, func() (bool, error) {
+		client, err = ssh.Dial("tcp", addr, config)
+		if err == nil {
+			return true, nil
+		}
+		if hostKeyErr != nil {
+			return true, newError("ssh dial", ErrHostKeyMismatch, hostKeyErr)
+		}
+		return false, err
+	})
+	if err != nil {
+		if ctx.Err() != nil || errors.Is(err, ErrHostKeyMismatch) {
+			return nil, err
+		}
+		return nil, newError("ssh dial", ErrSSHUnreachable, err)
+	}
+	// closing the connection aborts the running commands on cancel
+	go func() {
+		<-ctx.Done()
+		client.Close()
+	}()
+	return client, nil
+}
+
+// get vm running status, of every owner when owner is empty
+func StatusInstance(p Provider, owner string) error {
+	vms, err := p.List(owner)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		market := "on-demand"
+		if vm.Spot {
+			market = "spot"
+		}
+		line := fmt.Sprintf("%s %s/%s %s %s %s %s %s",
+			vm.ID, vm.Owner, vm.Deployment, vm.State, vm.PublicIP, vm.Region, vm.Zone, market)
+		if vm.TLSFingerprint != "" {
+			line += " tls " + vm.TLSFingerprint
+		}
+		log.Println(line)
+	}
+	return nil
+}
+
+// KeepSpotAlive watches the spot vm started by StartInstance and starts a new
+// one in another zone when aws reclaims it, it returns when ctx is done or the
+// vm went away for another reason like the idle timeout
+func KeepSpotAlive(ctx context.Context, p Provider, cfg *Config) error {
+	for {
+		vms, err := p.Find(deploymentName(cfg))
+		if err != nil {
+			return err
+		}
+		var vm *Instance
+		for _, v := range vms {
+			if v.State == StateRunning {
+				vm = v
+			}
+		}
+		if vm == nil {
+			return newError("watch spot", ErrNotFound, errors.New("no running vm"))
+		}
+		if !vm.Spot {
+			log.Printf("%s runs on-demand, nothing to watch\n", vm.ID)
+			return nil
+		}
+		id, zone := vm.ID, vm.Zone
+		log.Printf("watching spot vm %s in %s\n", id, zone)
+
+		for {
+			if err = sleep(ctx, spotCheckInterval); err != nil {
+				return err
+			}
+			vm, err = p.Status(id)
+			if errors.Is(err, ErrNotFound) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if vm.Interrupted {
+				break
+			}
+			if vm.State != StateRunning && vm.State != StatePending {
+				log.Printf("%s is %s, stop watching\n", id, vm.State)
+				return nil
+			}
+		}
+
+		log.Printf("spot vm %s was interrupted, starting another one\n", id)
+		if zone != "" {
+			cfg.AvoidZones = append(cfg.AvoidZones, zone)
+		}
+		if err = StartInstance(ctx, p, cfg); err != nil {
+			return err
+		}
+	}
+}
+
+// stio and delete interface, a kept vm is only stopped
+func StopInstance(p Provider, cfg *Config) error {
+	name := deploymentName(cfg)
+	vms, err := p.Find(name)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if cfg.KeepStopped && vm.Ready {
+			if vm.State != StateStopped {
+				if err := p.Stop(vm.ID); err != nil {
+					return err
+				}
+			}
+			log.Printf("%s stopped, it is started again by up\n", vm.ID)
+			continue
+		}
+		if err := p.Destroy(vm.ID); err != nil {
+			return err
+		}
+		log.Printf("%s stopped\n", vm.ID)
+	}
+	if cfg.KeepStopped {
+		return nil
+	}
+	if err = p.Cleanup(name); err != nil {
+		return err
+	}
+	return p.RemoveSSHKey(name)
+}
+
+// GC removes the resources left behind by failed or interrupted runs
+func GC(p Provider, dryRun bool) error {
+	orphans, err := p.Orphans()
+	if err != nil {
+		return err
+	}
+	for _, r := range orphans {
+		if dryRun {
+			log.Printf("orphaned %s %s (%s)", r.Kind, r.ID, r.Name)
+			continue
+		}
+		if err = p.RemoveOrphan(r); err != nil {
+			return err
+		}
+		log.Printf("removed %s %s (%s)", r.Kind, r.ID, r.Name)
+	}
+	return nil
+}
+
+// isManagedName tells if a resource name was given by this tool
+func isManagedName(name string) bool {
+	return name == instanceName || strings.HasPrefix(name, instanceName+"-")
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return newError("wait", nil, ctx.Err())
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,254 @@
+package vps
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProvider returns a fake provider and a config for it, the state dir
+// is a temporary one so the keys and known hosts of the user are not touched
+func newTestProvider(t *testing.T) (*FakeProvider, *Config) {
+	t.Setenv(stateDirEnv, t.TempDir())
+	cfg := &Config{Provider: "fake", ServerBinary: "/usr/local/bin/fastvpn-test"}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*FakeProvider), cfg
+}
+
+func liveInstances(t *testing.T, p *FakeProvider) []*Instance {
+	vms, err := p.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vms
+}
+
+func TestStartInstance(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	vms := liveInstances(t, p)
+	if len(vms) != 1 {
+		t.Fatalf("got %d vms, want 1", len(vms))
+	}
+	vm := vms[0]
+	if !vm.Ready || vm.State != StateRunning {
+		t.Errorf("vm is %s, ready %v", vm.State, vm.Ready)
+	}
+	if p.Uploaded[vm.ID] != cfg.ServerBinary {
+		t.Errorf("uploaded %q, want %q", p.Uploaded[vm.ID], cfg.ServerBinary)
+	}
+	if _, ok := p.Keys[deploymentName(cfg)]; !ok {
+		t.Error("ssh key not injected")
+	}
+	if len(p.UserData[vm.ID]) == 0 {
+		t.Error("no user data")
+	}
+
+	// a second up replaces the vm
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	vms = liveInstances(t, p)
+	if len(vms) != 1 || vms[0].ID == vm.ID {
+		t.Errorf("vm %s not replaced: %v", vm.ID, vms)
+	}
+}
+
+func TestStartInstanceDownloadsServer(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	cfg.ServerURL = "https://example.com/fastvpn"
+	cfg.ServerSHA256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Uploaded) != 0 {
+		t.Errorf("server uploaded though it is downloaded: %v", p.Uploaded)
+	}
+}
+
+func TestStartInstanceRollback(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	p.ProbeErr = errors.New("connection refused")
+	err := StartInstance(context.Background(), p, cfg)
+	if err == nil {
+		t.Fatal("start succeeded with a failing probe")
+	}
+	if vms := liveInstances(t, p); len(vms) != 0 {
+		t.Errorf("vms left behind: %v", vms)
+	}
+	if len(p.Keys) != 0 {
+		t.Errorf("keys left behind: %v", p.Keys)
+	}
+}
+
+func TestStartInstanceRollbackKeepsReusedKey(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	name := deploymentName(cfg)
+	key := p.Keys[name]
+
+	// the second up reuses the key pair of the first and fails
+	p.ProbeErr = errors.New("connection refused")
+	if err := StartInstance(context.Background(), p, cfg); err == nil {
+		t.Fatal("start succeeded with a failing probe")
+	}
+	if got, ok := p.Keys[name]; !ok || string(got) != string(key) {
+		t.Errorf("rollback removed the key pair it did not import")
+	}
+	if vms := liveInstances(t, p); len(vms) != 0 {
+		t.Errorf("vms left behind: %v", vms)
+	}
+}
+
+func TestStopInstance(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := StopInstance(p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if vms := liveInstances(t, p); len(vms) != 0 {
+		t.Errorf("vms left after down: %v", vms)
+	}
+	if len(p.Keys) != 0 {
+		t.Errorf("keys left after down: %v", p.Keys)
+	}
+}
+
+func TestStopInstanceKeepStopped(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	cfg.KeepStopped = true
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	id := liveInstances(t, p)[0].ID
+	if err := StopInstance(p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	vms := liveInstances(t, p)
+	if len(vms) != 1 || vms[0].State != StateStopped {
+		t.Fatalf("kept vm not stopped: %v", vms)
+	}
+	if _, ok := p.Keys[deploymentName(cfg)]; !ok {
+		t.Error("key of the kept vm removed")
+	}
+
+	// up starts the same vm again
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	vms = liveInstances(t, p)
+	if len(vms) != 1 || vms[0].ID != id || vms[0].State != StateRunning {
+		t.Errorf("kept vm %s not resumed: %v", id, vms)
+	}
+}
+
+func TestGC(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	live := liveInstances(t, p)[0]
+
+	// a vm stuck in bootstrap and a key without vm
+	stuck, err := p.Create("fastvpn-stuck", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Instances[stuck.ID].LaunchTime = time.Now().Add(-2 * orphanAge)
+	p.InjectSSHKey("fastvpn-gone", []byte("key"))
+
+	if err = GC(p, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(liveInstances(t, p)) != 2 || len(p.Keys) != 2 {
+		t.Fatal("dry run removed resources")
+	}
+
+	if err = GC(p, false); err != nil {
+		t.Fatal(err)
+	}
+	vms := liveInstances(t, p)
+	if len(vms) != 1 || vms[0].ID != live.ID {
+		t.Errorf("gc left %v, want only %s", vms, live.ID)
+	}
+	if _, ok := p.Keys["fastvpn-gone"]; ok {
+		t.Error("orphaned key not removed")
+	}
+	if _, ok := p.Keys[deploymentName(cfg)]; !ok {
+		t.Error("key of the live vm removed")
+	}
+}
+
+func TestStartInstanceRejectsKeptSpot(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	cfg.Spot = true
+	cfg.KeepStopped = true
+	if err := StartInstance(context.Background(), p, cfg); err == nil {
+		t.Fatal("kept spot vm started")
+	}
+	if vms := liveInstances(t, p); len(vms) != 0 {
+		t.Errorf("vms created: %v", vms)
+	}
+}
+
+func TestStartInstanceTLSFingerprint(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	cfg.Transport = "wss"
+	out := captureLog(t)
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	vm := liveInstances(t, p)[0]
+	if vm.TLSFingerprint == "" {
+		t.Fatal("no tls fingerprint read")
+	}
+	if !strings.Contains(out.String(), "tls certificate fingerprint "+vm.TLSFingerprint) {
+		t.Errorf("up did not report the fingerprint: %q", out.String())
+	}
+
+	out.Reset()
+	if err := StatusInstance(p, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), vm.ID+" ") || !strings.Contains(out.String(), "tls "+vm.TLSFingerprint) {
+		t.Errorf("status did not report the fingerprint: %q", out.String())
+	}
+}
+
+func TestStartInstanceStaticIP(t *testing.T) {
+	p, cfg := newTestProvider(t)
+	cfg.KeepStopped = true
+	cfg.StaticIP = true
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	static := p.StaticIPs[deploymentName(cfg)]
+	if static == nil {
+		t.Fatal("no static ip attached")
+	}
+	vm := liveInstances(t, p)[0]
+	if !vm.PublicIP.Equal(static) {
+		t.Errorf("vm on %s, want the static %s", vm.PublicIP, static)
+	}
+
+	if err := StopInstance(p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartInstance(context.Background(), p, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if vm = liveInstances(t, p)[0]; !vm.PublicIP.Equal(static) {
+		t.Errorf("resumed vm on %s, want the static %s", vm.PublicIP, static)
+	}
+}